@@ -1,7 +1,9 @@
 package main
 
-// AverageByTime average all values in given interval
-func AverageByTime(in Rows, step int64) (out Rows) {
+// AverageByTime consolidate all values in given interval. Each value is
+// consolidated by function of its column (columns are indexed by Value.Column);
+// values of unknown columns are averaged. Averages are weighted by counters.
+func AverageByTime(in Rows, step int64, columns []RRDColumn) (out Rows) {
 	if len(in) < 2 {
 		return in
 	}
@@ -10,7 +12,7 @@ func AverageByTime(in Rows, step int64) (out Rows) {
 	for _, row := range in {
 		rowTS := (row.TS / step)
 		if lastTS != rowTS && len(lastRows) > 0 {
-			row := averageRows(lastRows)
+			row := averageRows(lastRows, columns)
 			out = append(out, row)
 			lastRows = nil
 		}
@@ -18,14 +20,14 @@ func AverageByTime(in Rows, step int64) (out Rows) {
 		lastRows = append(lastRows, row)
 	}
 	if len(lastRows) > 0 {
-		row := averageRows(lastRows)
+		row := averageRows(lastRows, columns)
 		out = append(out, row)
 	}
 	return
 }
 
-// AverageToNumber average values to get no more than given points
-func AverageToNumber(in Rows, maxRows int) (out Rows) {
+// AverageToNumber consolidate values to get no more than given points
+func AverageToNumber(in Rows, maxRows int, columns []RRDColumn) (out Rows) {
 	if len(in) < 2 || len(in) < maxRows {
 		return in
 	}
@@ -34,27 +36,32 @@ func AverageToNumber(in Rows, maxRows int) (out Rows) {
 	maxTS := in[len(in)-1].TS
 	step := (maxTS - minTS) / int64(maxRows)
 
-	return AverageByTime(in, step)
+	return AverageByTime(in, step, columns)
 }
 
-func averageRows(in Rows) (out Row) {
+func averageRows(in Rows, columns []RRDColumn) (out Row) {
 	// count only valid values
 	out.TS = in[0].TS
 	cols := len(in[0].Values)
 	for c := 0; c < cols; c++ {
+		column := in[0].Values[c].Column
+		function := FAverage
+		if column >= 0 && column < len(columns) {
+			function = columns[column].Function
+		}
 		value := Value{
-			TS: out.TS,
+			TS:     out.TS,
+			Column: column,
 		}
 		for _, row := range in {
-			v := row.Values[c]
-			if v.Valid {
-				value.Value += v.Value
-				value.Counter++
-				value.Valid = true
-			}
+			value = function.Merge(value, row.Values[c])
 		}
-		if value.Valid {
-			value.Value = value.Value / float32(value.Counter)
+		value.TS = out.TS
+		value.Column = column
+		value.ArchiveID = in[0].Values[c].ArchiveID
+		if !value.Valid {
+			value.Value = 0
+			value.Counter = 0
 		}
 		out.Values = append(out.Values, value)
 	}
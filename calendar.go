@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// CalendarUnit is calendar period used to group values
+type CalendarUnit int
+
+const (
+	// CalendarDay group values by days (from midnight)
+	CalendarDay CalendarUnit = iota
+	// CalendarWeek group values by weeks starting on monday
+	CalendarWeek
+	// CalendarMonth group values by months
+	CalendarMonth
+	// CalendarYear group values by years
+	CalendarYear
+)
+
+func (u CalendarUnit) String() string {
+	switch u {
+	case CalendarDay:
+		return "day"
+	case CalendarWeek:
+		return "week"
+	case CalendarMonth:
+		return "month"
+	case CalendarYear:
+		return "year"
+	}
+	return "unknown calendar unit"
+}
+
+// ParseCalendarUnit return calendar unit by name
+func ParseCalendarUnit(name string) (CalendarUnit, bool) {
+	switch strings.ToLower(name) {
+	case "day", "daily", "d":
+		return CalendarDay, true
+	case "week", "weekly", "w":
+		return CalendarWeek, true
+	case "month", "monthly", "mo":
+		return CalendarMonth, true
+	case "year", "yearly", "y":
+		return CalendarYear, true
+	}
+	return CalendarDay, false
+}
+
+// Bucket return start of calendar period containing ts and start of next
+// period; periods are aligned to calendar in given location
+func (u CalendarUnit) Bucket(ts int64, loc *time.Location) (start, next int64) {
+	s, n, _ := calendarPeriod(time.Unix(ts, 0).In(loc), u.String())
+	return s.Unix(), n.Unix()
+}
+
+// AverageByCalendar consolidate values in calendar periods (days, weeks,
+// months, years) in given location. Values are consolidated like in
+// AverageByTime; time stamp of result row is start of period.
+func AverageByCalendar(in Rows, unit CalendarUnit, loc *time.Location, columns []RRDColumn) (out Rows) {
+	LogDebug("AverageByCalendar rows=%d, unit=%s, loc=%s", len(in), unit, loc)
+	var start, next int64
+	var bucket []Row
+	for _, row := range in {
+		if len(bucket) > 0 && (row.TS < start || row.TS >= next) {
+			out = append(out, averageBucket(bucket, start, columns))
+			bucket = nil
+		}
+		if len(bucket) == 0 {
+			start, next = unit.Bucket(row.TS, loc)
+		}
+		bucket = append(bucket, row)
+	}
+	if len(bucket) > 0 {
+		out = append(out, averageBucket(bucket, start, columns))
+	}
+	return
+}
+
+func averageBucket(rows Rows, ts int64, columns []RRDColumn) Row {
+	row := averageRows(rows, columns)
+	row.TS = ts
+	for i := range row.Values {
+		row.Values[i].TS = ts
+	}
+	return row
+}
@@ -6,7 +6,9 @@
 package main
 
 import (
+	"fmt"
 	"github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
 	"os"
 	"time"
 )
@@ -21,43 +23,59 @@ type Plot struct {
 	Width          int
 	Height         int
 	UseSecoundAxis bool
+	// Forecast for first column (optional)
+	Forecast *ForecastRange
+	// Trends for columns (optional; nil when not fitted)
+	Trends []*Trend
+	// BaseSeries map columns appended by CompareRows (after base columns)
+	// to base column index
+	BaseSeries  []int
+	CompareMode CompareMode
 }
 
 func (p *Plot) plotChart(filename string) {
 	series := make([]chart.TimeSeries, 0, len(p.Cols))
 	numRows := len(p.Rows)
+	baseCols := len(p.Cols) - len(p.BaseSeries)
+	useSecondAxis := false
 
-	ts := chart.TimeSeries{
-		XValues: make([]time.Time, 0, numRows),
-		YValues: make([]float64, 0, numRows),
-		Name:    p.Cols[0],
-		Style: chart.Style{
-			Show:        true,
-			FontColor:   chart.ColorBlue,
-			StrokeColor: chart.ColorBlue,
-		},
-	}
-	series = append(series, ts)
-
-	if len(p.Cols) == 2 {
+	for idx, name := range p.Cols {
 		ts := chart.TimeSeries{
 			XValues: make([]time.Time, 0, numRows),
 			YValues: make([]float64, 0, numRows),
-			Name:    p.Cols[1],
+			Name:    name,
 			Style: chart.Style{
 				Show:        true,
-				FontColor:   chart.ColorGreen,
-				StrokeColor: chart.ColorGreen,
+				FontColor:   chart.ColorBlue,
+				StrokeColor: chart.ColorBlue,
 			},
 		}
-		if p.UseSecoundAxis {
-			ts.YAxis = chart.YAxisSecondary
+		if idx < baseCols {
+			if idx == 1 {
+				ts.Style.FontColor = chart.ColorGreen
+				ts.Style.StrokeColor = chart.ColorGreen
+				if p.UseSecoundAxis {
+					ts.YAxis = chart.YAxisSecondary
+				}
+			}
+		} else {
+			// compared series - dashed line in color of base series;
+			// differences are drawn on secondary axis
+			base := series[p.BaseSeries[idx-baseCols]]
+			ts.Style.FontColor = base.Style.FontColor
+			ts.Style.StrokeColor = base.Style.StrokeColor
+			ts.Style.StrokeDashArray = []float64{3, 3}
+			ts.YAxis = base.YAxis
+			if p.CompareMode != CompareValues {
+				ts.YAxis = chart.YAxisSecondary
+			}
 		}
+		useSecondAxis = useSecondAxis || ts.YAxis == chart.YAxisSecondary
 		series = append(series, ts)
 	}
 
 	for _, row := range p.Rows {
-		ts := time.Unix(row.TS, 0)
+		ts := time.Unix(row.TS, 0).In(TimeLocation)
 		for serieNo, col := range row.Values {
 			if col.Valid {
 				series[serieNo].XValues = append(series[serieNo].XValues, ts)
@@ -66,6 +84,28 @@ func (p *Plot) plotChart(filename string) {
 		}
 	}
 
+	if p.Forecast != nil {
+		series = append(series, p.forecastSeries()...)
+	}
+	for idx, trend := range p.Trends {
+		if trend == nil {
+			continue
+		}
+		begin, end := p.Rows[0].TS, p.Rows[numRows-1].TS
+		ts := chart.TimeSeries{
+			XValues: []time.Time{time.Unix(begin, 0).In(TimeLocation), time.Unix(end, 0).In(TimeLocation)},
+			YValues: []float64{trend.ValueAt(begin), trend.ValueAt(end)},
+			Name:    p.Cols[idx] + " trend",
+			Style: chart.Style{
+				Show:            true,
+				StrokeColor:     series[idx].Style.StrokeColor,
+				StrokeDashArray: []float64{5, 5},
+			},
+			YAxis: series[idx].YAxis,
+		}
+		series = append(series, ts)
+	}
+
 	cSeries := make([]chart.Series, 0, len(series))
 	for _, s := range series {
 		cSeries = append(cSeries, s)
@@ -91,7 +131,7 @@ func (p *Plot) plotChart(filename string) {
 	if tsRange < 60*60*24*2 { // 2 days
 		graph.XAxis.ValueFormatter = MyTimeMinuteValueFormatter
 	}
-	if len(p.Cols) > 1 && p.UseSecoundAxis {
+	if useSecondAxis {
 		graph.YAxisSecondary = chart.YAxis{
 			Style: chart.Style{
 				Show: true, //enables / displays the secondary y-axis
@@ -107,3 +147,180 @@ func (p *Plot) plotChart(filename string) {
 	defer f.Close()
 	graph.Render(chart.PNG, f)
 }
+
+// forecastSeries create series for confidence band and failures
+// (observed values in failure state)
+func (p *Plot) forecastSeries() (series []chart.TimeSeries) {
+	bandStyle := chart.Style{
+		Show:            true,
+		StrokeColor:     chart.ColorLightGray,
+		StrokeDashArray: []float64{5, 5},
+	}
+	lower := chart.TimeSeries{Name: "lower", Style: bandStyle}
+	upper := chart.TimeSeries{Name: "upper", Style: bandStyle}
+
+	var failure *chart.TimeSeries
+	for _, row := range p.Forecast.Rows {
+		ts := time.Unix(row.TS, 0).In(TimeLocation)
+		for _, v := range row.Values {
+			if !v.Valid {
+				continue
+			}
+			lower.XValues = append(lower.XValues, ts)
+			lower.YValues = append(lower.YValues, float64(v.Lower))
+			upper.XValues = append(upper.XValues, ts)
+			upper.YValues = append(upper.YValues, float64(v.Upper))
+			if !v.Failure || !v.HasObserved {
+				failure = nil
+				continue
+			}
+			if failure == nil {
+				series = append(series, chart.TimeSeries{
+					Name: "failure",
+					Style: chart.Style{
+						Show:        true,
+						StrokeColor: chart.ColorRed,
+						StrokeWidth: 3,
+					},
+				})
+				failure = &series[len(series)-1]
+			}
+			failure.XValues = append(failure.XValues, ts)
+			failure.YValues = append(failure.YValues, float64(v.Observed))
+		}
+	}
+	return append([]chart.TimeSeries{lower, upper}, series...)
+}
+
+// Heatmap render mean values of one column of profile as grid of cells
+// (rows - weekdays, columns - hours) with labels and values scale
+type Heatmap struct {
+	Profile *Profile
+	// Column is index of column in profile
+	Column int
+	Width  int
+	Height int
+}
+
+const (
+	heatmapTitleH = 20
+	heatmapLabelW = 40
+	heatmapAxisH  = 20
+	heatmapScaleH = 30
+)
+
+var heatmapEmptyColor = drawing.Color{R: 200, G: 200, B: 200, A: 255}
+
+// plotHeatmap draw heatmap to png file; colors are scaled from blue (minimum
+// mean) to red (maximum mean); empty buckets are gray
+func (h *Heatmap) plotHeatmap(filename string) error {
+	weekdays, hours := h.Profile.Group.buckets()
+	left := 0
+	if weekdays > 1 {
+		left = heatmapLabelW
+	}
+	top := heatmapTitleH
+	cellW := (h.Width - left) / hours
+	cellH := (h.Height - top - heatmapAxisH - heatmapScaleH) / weekdays
+	if cellW < 2 || cellH < 2 {
+		return fmt.Errorf("heatmap too small")
+	}
+
+	min, max, hasData := h.meanRange()
+
+	r, err := chart.PNG(h.Width, h.Height)
+	if err != nil {
+		return err
+	}
+	font, err := chart.GetDefaultFont()
+	if err != nil {
+		return err
+	}
+	r.SetFont(font)
+	r.SetFontSize(10)
+	r.SetFontColor(chart.ColorBlack)
+
+	fillRect(r, 0, 0, h.Width, h.Height, chart.ColorWhite)
+	r.Text(fmt.Sprintf("%s (mean, %s)", h.Profile.Columns[h.Column], h.Profile.TimeZone), left, 14)
+
+	// label every n-th hour so labels don't overlap
+	labelEvery := 1
+	if w := r.MeasureText("00").Width() + 4; cellW < w {
+		labelEvery = (w + cellW - 1) / cellW
+	}
+	gridBottom := top + weekdays*cellH
+	for idx, b := range h.Profile.Buckets {
+		c := heatmapEmptyColor
+		if s := b.Columns[h.Column]; s.Count > 0 {
+			c = heatColor(s.Mean, min, max)
+		}
+		x0, y0 := left+(idx%hours)*cellW, top+(idx/hours)*cellH
+		// leave 1px gap between cells
+		fillRect(r, x0, y0, x0+cellW-1, y0+cellH-1, c)
+
+		if weekdays > 1 && idx%hours == 0 {
+			r.Text(weekdaysNames[b.Weekday], 4, y0+cellH/2+4)
+		}
+		if hours > 1 && idx < hours && idx%labelEvery == 0 {
+			r.Text(fmt.Sprintf("%02d", b.Hour), x0+2, gridBottom+14)
+		}
+	}
+
+	// values scale: gradient from minimal to maximal mean
+	scaleTop := gridBottom + heatmapAxisH
+	scaleW := hours * cellW
+	if !hasData {
+		fillRect(r, left, scaleTop, left+scaleW, scaleTop+10, heatmapEmptyColor)
+		r.Text("no data", left, scaleTop+24)
+	} else {
+		for x := 0; x < scaleW; x++ {
+			v := min + (max-min)*float64(x)/float64(scaleW)
+			fillRect(r, left+x, scaleTop, left+x+1, scaleTop+10, heatColor(v, min, max))
+		}
+		minL, maxL := formatPerfValue(min), formatPerfValue(max)
+		r.Text(minL, left, scaleTop+24)
+		r.Text(maxL, left+scaleW-r.MeasureText(maxL).Width(), scaleTop+24)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.Save(f)
+}
+
+// meanRange return minimal and maximal mean of column in not empty buckets
+func (h *Heatmap) meanRange() (min, max float64, ok bool) {
+	for _, b := range h.Profile.Buckets {
+		if s := b.Columns[h.Column]; s.Count > 0 {
+			if !ok || s.Mean < min {
+				min = s.Mean
+			}
+			if !ok || s.Mean > max {
+				max = s.Mean
+			}
+			ok = true
+		}
+	}
+	return
+}
+
+// heatColor return color for value scaled from blue (min) to red (max)
+func heatColor(v, min, max float64) drawing.Color {
+	f := 0.5
+	if max > min {
+		f = (v - min) / (max - min)
+	}
+	return drawing.Color{R: uint8(255 * f), G: 64, B: uint8(255 * (1 - f)), A: 255}
+}
+
+func fillRect(r chart.Renderer, x0, y0, x1, y1 int, c drawing.Color) {
+	r.SetFillColor(c)
+	r.MoveTo(x0, y0)
+	r.LineTo(x1, y0)
+	r.LineTo(x1, y1)
+	r.LineTo(x0, y1)
+	r.Close()
+	r.Fill()
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CheckStatus is result of check; values are monitoring plugins exit codes
+type CheckStatus int
+
+const (
+	// CheckOK - value is in range
+	CheckOK CheckStatus = iota
+	// CheckWarning - warning threshold exceeded
+	CheckWarning
+	// CheckCritical - critical threshold exceeded
+	CheckCritical
+	// CheckUnknown - no data or error
+	CheckUnknown
+)
+
+func (s CheckStatus) String() string {
+	switch s {
+	case CheckOK:
+		return "OK"
+	case CheckWarning:
+		return "WARNING"
+	case CheckCritical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
+
+type (
+	// Threshold is range in monitoring plugins format: [@]start:end.
+	// "10" means 0:10, "10:" - 10:inf, "~:10" - -inf:10; alert is raised
+	// when value is out of range (or inside range when prefixed by @).
+	Threshold struct {
+		Start  float64
+		End    float64
+		Inside bool
+
+		def string
+	}
+
+	// CheckOptions define what is checked by Check
+	CheckOptions struct {
+		Column int
+		// Stat is calculated over Window; empty or "last" means last value.
+		// Accepted: last, avg, min, max, sum, count, stddev, first, pNN.
+		Stat   string
+		Window int64
+		// MaxAge ignore data older than MaxAge seconds; 0 = no limit
+		MaxAge   int64
+		Warning  *Threshold
+		Critical *Threshold
+		// Now is current time; 0 = time.Now()
+		Now int64
+	}
+
+	// CheckResult is result of Check
+	CheckResult struct {
+		Status  CheckStatus
+		Value   float64
+		TS      int64
+		Label   string
+		Message string
+		// Perfdata in monitoring plugins format
+		Perfdata string
+	}
+)
+
+// ParseThreshold parse threshold range in monitoring plugins format
+func ParseThreshold(inp string) (*Threshold, error) {
+	t := &Threshold{Start: 0, End: math.Inf(1), def: inp}
+	def := strings.TrimSpace(inp)
+	if strings.HasPrefix(def, "@") {
+		t.Inside = true
+		def = def[1:]
+	}
+	if def == "" {
+		return nil, fmt.Errorf("empty threshold")
+	}
+
+	start, end := "", def
+	if idx := strings.Index(def, ":"); idx >= 0 {
+		start, end = def[:idx], def[idx+1:]
+	}
+	var err error
+	switch start {
+	case "":
+	case "~":
+		t.Start = math.Inf(-1)
+	default:
+		if t.Start, err = strconv.ParseFloat(start, 64); err != nil {
+			return nil, fmt.Errorf("invalid threshold '%s'", inp)
+		}
+	}
+	if end != "" {
+		if t.End, err = strconv.ParseFloat(end, 64); err != nil {
+			return nil, fmt.Errorf("invalid threshold '%s'", inp)
+		}
+	}
+	if t.Start > t.End {
+		return nil, fmt.Errorf("invalid threshold '%s' - start > end", inp)
+	}
+	return t, nil
+}
+
+// Alert return true when value should raise alert
+func (t *Threshold) Alert(v float64) bool {
+	inside := v >= t.Start && v <= t.End
+	return inside == t.Inside
+}
+
+func (t *Threshold) String() string {
+	if t == nil {
+		return ""
+	}
+	return t.def
+}
+
+// Check evaluate last value or statistic over window for column
+// against thresholds
+func (r *RRD) Check(opts CheckOptions) (*CheckResult, error) {
+	LogDebug("RRD.Check opts=%+v", opts)
+
+	if opts.Column < 0 || opts.Column >= len(r.columns) {
+		return nil, fmt.Errorf("invalid column %d", opts.Column)
+	}
+	stat := strings.ToLower(opts.Stat)
+	if stat == "" {
+		stat = "last"
+	}
+	if _, ok := checkStatValue(&ColumnStats{}, stat); !ok {
+		return nil, fmt.Errorf("invalid stat '%s'", opts.Stat)
+	}
+	if stat != "last" && opts.Window < 1 {
+		return nil, fmt.Errorf("missing window for stat %s", stat)
+	}
+
+	now := opts.Now
+	if now == 0 {
+		now = time.Now().Unix()
+	}
+	column := r.columns[opts.Column]
+	res := &CheckResult{Status: CheckUnknown, Label: column.Name}
+	descr := column.Name
+	if stat != "last" {
+		res.Label += "_" + stat
+		descr = fmt.Sprintf("%s %s(%s)", column.Name, stat, FormatDuration(opts.Window))
+	}
+
+	last, err := r.Last()
+	if err != nil {
+		return nil, err
+	}
+	if last < 1 {
+		res.Message = "no data"
+		return res, nil
+	}
+	minTS := int64(0)
+	if opts.MaxAge > 0 {
+		minTS = now - opts.MaxAge
+		if last < minTS {
+			res.Message = fmt.Sprintf("no data since %s", FormatDuration(now-last))
+			return res, nil
+		}
+	}
+
+	found := false
+	if stat == "last" {
+		values, err := r.Get(last, opts.Column)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 1 && values[0].Valid {
+			res.Value, res.TS, found = float64(values[0].Value), last, true
+		} else {
+			// no value in last row - find last valid value
+			rows, err := r.GetRange(minTS, last, []int{opts.Column}, false, false)
+			if err != nil {
+				return nil, err
+			}
+			for i := len(rows) - 1; i >= 0 && !found; i-- {
+				if v := rows[i].Values[0]; v.Valid {
+					res.Value, res.TS, found = float64(v.Value), rows[i].TS, true
+				}
+			}
+		}
+	} else {
+		// window ends now - stale data don't fall into it
+		if begin := now - opts.Window + 1; begin > minTS {
+			minTS = begin
+		}
+		rows, err := r.GetRange(minTS, now, []int{opts.Column}, false, false)
+		if err != nil {
+			return nil, err
+		}
+		cs := &ColumnStats{}
+		for _, row := range rows {
+			if v := row.Values[0]; v.Valid {
+				cs.add(row.TS, float64(v.Value))
+			}
+		}
+		if cs.Count > 0 {
+			var percentiles []float64
+			if strings.HasPrefix(stat, "p") {
+				p, _ := strconv.ParseFloat(stat[1:], 64)
+				percentiles = []float64{p}
+			}
+			cs.finish(percentiles)
+			res.Value, _ = checkStatValue(cs, stat)
+			res.TS, found = cs.LastTS, true
+		}
+	}
+	if !found {
+		res.Message = "no data for " + descr
+		return res, nil
+	}
+
+	res.Status = CheckOK
+	if opts.Critical != nil && opts.Critical.Alert(res.Value) {
+		res.Status = CheckCritical
+	} else if opts.Warning != nil && opts.Warning.Alert(res.Value) {
+		res.Status = CheckWarning
+	}
+	res.Message = fmt.Sprintf("%s = %g", descr, res.Value)
+
+	// perfdata values can't use exponent notation
+	perf := []string{fmt.Sprintf("'%s'=%s", res.Label, formatPerfValue(res.Value)),
+		opts.Warning.String(), opts.Critical.String(), "", ""}
+	if column.HasMinimum {
+		perf[3] = formatPerfValue(float64(column.Minimum))
+	}
+	if column.HasMaximum {
+		perf[4] = formatPerfValue(float64(column.Maximum))
+	}
+	res.Perfdata = strings.TrimRight(strings.Join(perf, ";"), ";")
+	return res, nil
+}
+
+// String return status line in monitoring plugins format
+func (c *CheckResult) String() string {
+	line := "RRD " + c.Status.String() + " - " + c.Message
+	if c.Perfdata != "" {
+		line += " | " + c.Perfdata
+	}
+	return line
+}
+
+func formatPerfValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// checkStatValue return value of stat from calculated statistics
+func checkStatValue(cs *ColumnStats, stat string) (float64, bool) {
+	switch stat {
+	case "last":
+		return cs.Last, true
+	case "first":
+		return cs.First, true
+	case "avg", "average", "mean":
+		return cs.Mean, true
+	case "min", "minimum":
+		return cs.Min, true
+	case "max", "maximum":
+		return cs.Max, true
+	case "sum":
+		return cs.Sum, true
+	case "count":
+		return float64(cs.Count), true
+	case "stddev":
+		return cs.StdDev, true
+	}
+	if strings.HasPrefix(stat, "p") {
+		p, err := strconv.ParseFloat(stat[1:], 64)
+		if err != nil || p < 0 || p > 100 {
+			return 0, false
+		}
+		if len(cs.Percentiles) > 0 {
+			return cs.Percentiles[0].Value, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
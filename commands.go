@@ -2,6 +2,7 @@ package main
 
 import (
 	//	"flag"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"os"
@@ -17,28 +18,67 @@ func initDB(c *cli.Context) {
 		return
 	}
 	filename, _ := getFilenameParam(c)
-	cols := c.String("columns")
-	if !c.IsSet("columns") || cols == "" {
-		LogError("Missing number of columns (--columns)")
+
+	var columns []RRDColumn
+	var archives []RRDArchive
+	var forecasts []RRDForecast
+	var err error
+
+	if like := c.String("like"); c.IsSet("like") && like != "" {
+		if sameFile(like, filename) {
+			LogFatal("Source file (--like) and new file are the same")
+			return
+		}
+		// copy schema from existing file
+		if columns, archives, forecasts, err = LoadRRDSchema(like); err != nil {
+			LogFatal("Open %s error: %s", like, err.Error())
+		}
 	}
 
-	columns, err := parseColumnsDef(cols)
-	if err != nil {
-		LogError("Columns definition error: %s", err.Error())
+	if schemaFile := c.String("schema"); c.IsSet("schema") && schemaFile != "" {
+		schema, err := LoadSchema(schemaFile)
+		if err != nil {
+			LogFatal("Load schema error: %s", err.Error())
+		}
+		if columns, err = schema.RRDColumns(); err != nil {
+			LogError("Schema columns error: %s", err.Error())
+		}
+		if archives, err = schema.RRDArchives(); err != nil {
+			LogError("Schema archives error: %s", err.Error())
+		}
+		if forecasts, err = schema.RRDForecasts(); err != nil {
+			LogError("Schema forecasts error: %s", err.Error())
+		}
+	}
+
+	// columns and archives definitions override copied schema
+	cols := c.String("columns")
+	if c.IsSet("columns") && cols != "" {
+		if columns, err = parseColumnsDef(cols); err != nil {
+			LogError("Columns definition error: %s", err.Error())
+		}
+	} else if len(columns) == 0 {
+		LogError("Missing number of columns (--columns)")
 	}
 
 	archivesDef := c.String("archives")
-	if !c.IsSet("archives") || archivesDef == "" {
+	if c.IsSet("archives") && archivesDef != "" {
+		if archives, err = parseArchiveDef(archivesDef); err != nil {
+			LogError("Archives definition error: " + err.Error())
+		}
+	} else if len(archives) == 0 {
 		LogError("Missing archives definition (--archives)")
 	}
-	archives, err := parseArchiveDef(archivesDef)
-	if err != nil {
-		LogError("Archives definition error: " + err.Error())
+
+	if forecastsDef := c.String("forecasts"); c.IsSet("forecasts") && forecastsDef != "" {
+		if forecasts, err = ParseForecastDef(forecastsDef); err != nil {
+			LogError("Forecasts definition error: " + err.Error())
+		}
 	}
 
 	ExitWhenErrors()
 
-	f, err := NewRRD(filename, columns, archives)
+	f, err := NewRRD(filename, columns, archives, forecasts...)
 	defer close(f)
 	if err != nil {
 		LogFatal("Init db error: " + err.Error())
@@ -120,6 +160,86 @@ func putValues(c *cli.Context) {
 	}
 }
 
+func setValues(c *cli.Context) {
+	if !processGlobalArgs(c) {
+		return
+	}
+	filename, _ := getFilenameParam(c)
+
+	ts := c.String("ts")
+	if !c.IsSet("ts") || ts == "" {
+		LogError("Missing timestamp (--ts)")
+	}
+	timestamp, ok := dateToTs(ts)
+	if !ok {
+		LogError("Parse ts error")
+	}
+
+	if len(c.Args()) == 0 {
+		LogError("Missing values to set")
+	}
+
+	counter := int64(c.Int("counter"))
+	if c.IsSet("counter") && counter < 1 {
+		LogError("Invalid counter (--counter)")
+	}
+
+	var values []Value
+	for idx, a := range c.Args() {
+		if a == "null" || a == "nul" || a == "nil" {
+			continue
+		}
+		v, err := strconv.ParseFloat(a, 32)
+		if err != nil {
+			LogError("Invalid value '%s' on index %d", a, idx+1)
+		}
+		values = append(values, Value{
+			TS:      timestamp,
+			Value:   float32(v),
+			Valid:   true,
+			Counter: counter,
+			Column:  idx,
+		})
+	}
+
+	if len(values) == 0 {
+		LogError("Missing values to set (all null)")
+	}
+
+	ExitWhenErrors()
+
+	f, err := OpenRRD(filename, false)
+	defer close(f)
+	if err != nil {
+		LogFatal("Open db error: %s", err.Error())
+		return
+	}
+
+	if c.IsSet("columns") {
+		colsIDs, err := f.ParseColumnsNames(strings.Split(c.String("columns"), ","))
+		if err != nil {
+			LogFatal("Invalid --columns parameter: %s", err.Error())
+		}
+		if len(colsIDs) != len(c.Args()) {
+			LogFatal("Number of columns (--columns) don't match number of values")
+		}
+		for idx := range values {
+			values[idx].Column = colsIDs[values[idx].Column]
+		}
+	}
+
+	archive := 0
+	if c.IsSet("archive") && c.String("archive") != "" {
+		if archive, err = f.ParseArchiveName(c.String("archive")); err != nil {
+			LogFatal("Invalid --archive parameter: %s", err.Error())
+		}
+	}
+
+	if err = f.SetValues(archive, !c.Bool("no-rederive"), values...); err != nil {
+		LogError("Set error: %s", err.Error())
+	}
+}
+
 func getValue(c *cli.Context) {
 	if !processGlobalArgs(c) {
 		return
@@ -186,24 +306,7 @@ func getRangeValues(c *cli.Context) {
 		return
 	}
 	filename, _ := getFilenameParam(c)
-	tsMin := int64(0)
-	tsMinStr := c.String("begin")
-	if c.IsSet("begin") && tsMinStr != "" {
-		var ok bool
-		tsMin, ok = dateToTs(tsMinStr)
-		if !ok {
-			LogError("Parsing begin date error")
-		}
-	}
-	tsMaxStr := c.String("end")
-	if !c.IsSet("end") || tsMaxStr == "" {
-		tsMaxStr = "now"
-	}
-
-	tsMax, ok := dateToTs(tsMaxStr)
-	if !ok {
-		LogError("Parsing end date error")
-	}
+	tsMin, tsMax := dateRangeToTs(c.String("begin"), c.String("end"))
 
 	ExitWhenErrors()
 
@@ -223,54 +326,129 @@ func getRangeValues(c *cli.Context) {
 		}
 	}
 
-	var timeFmt func(int64) string
-	if c.GlobalIsSet("format-ts") {
-		format := c.GlobalString("custom-ts-format")
-		if format == "" {
-			format = time.RFC3339
-		}
-		timeFmt = func(ts int64) string {
-			return time.Unix(ts, 0).Format(format)
-		}
-	} else {
-		timeFmt = func(ts int64) string {
-			return fmt.Sprintf("%10d", ts)
-		}
-	}
+	timeFmt := tsFormatter(c)
 
 	separator := c.GlobalString("separator")
-	includeInvalid := c.Bool("include-invalid")
-	noRealTime := c.GlobalBool("no-rt")
 	separate := c.Bool("separate-valid-groups")
+	opts, ok := parseRangeOptions(c, f)
+	if !ok {
+		return
+	}
+	exprs, ok := parseExprs(c, f)
+	if !ok {
+		return
+	}
+	downsample, ok := ParseDownsampleMethod(c.String("downsample"))
+	if !ok {
+		LogError("Invalid --downsample parameter")
+		return
+	}
+	transforms, err := ParseTransforms(c.StringSlice("transform"))
+	if err != nil {
+		LogError("Invalid --transform parameter: %s", err.Error())
+		return
+	}
+	loadCols := colsIDs
+	if len(exprs) > 0 {
+		if !c.IsSet("columns") {
+			colsIDs = f.allColumnsIDs()
+		}
+		loadCols = ExprsColumns(colsIDs, exprs)
+	}
 
-	if rows, err := f.GetRange(tsMin, tsMax, colsIDs, includeInvalid, !noRealTime); err == nil {
+	shifts, mode, ok := parseCompare(c)
+	if !ok {
+		return
+	}
+
+	process := func(rows Rows) Rows {
 		if c.IsSet("fix-ranges") {
 			// mark values not matching min-max range
 			rows = RemoveInvalidVals(rows, f.Columns())
 		}
-		if c.IsSet("average-result") {
+		if len(exprs) > 0 {
+			// evaluate expressions on raw rows; results are consolidated like other columns
+			rows = ApplyExprs(rows, loadCols, len(colsIDs), exprs, len(f.Columns()))
+		}
+		if c.IsSet("average-by") {
+			if unit, ok := ParseCalendarUnit(c.String("average-by")); ok {
+				rows = AverageByCalendar(rows, unit, TimeLocation, f.Columns())
+			} else {
+				LogError("Invalid --average-by: %s; ignoring", c.String("average-by"))
+			}
+		} else if c.IsSet("average-result") {
 			if step := c.Int("average-result"); step > 1 {
-				rows = AverageByTime(rows, int64(step))
+				rows = AverageByTime(rows, int64(step), f.Columns())
 			} else {
 				LogError("Invalid --average-result: %s; ignoring", step)
 			}
 		} else if c.IsSet("average-max-count") {
 			if cnt := c.Int("average-max-count"); cnt > 1 {
-				rows = AverageToNumber(rows, cnt)
+				rows = Downsample(rows, cnt, downsample, f.Columns())
 			} else {
 				LogError("Invalid --average-max-count: %s; ignoring", cnt)
 			}
+		} else if c.IsSet("downsample") {
+			LogError("Missing --average-max-count for --downsample; ignoring")
+		}
+		return ApplyTransforms(rows, transforms)
+	}
+
+	if rows, err := f.GetRangeOpts(tsMin, tsMax, loadCols, opts); err == nil {
+		rows = process(rows)
+		baseCols := 0
+		if len(rows) > 0 {
+			baseCols = len(rows[0].Values)
+		}
+		if len(shifts) > 0 {
+			var shifted []Rows
+			for _, shift := range shifts {
+				srows, err := f.GetRangeOpts(tsMin-shift, tsMax-shift, loadCols, opts)
+				if err != nil {
+					LogFatal("Error: %s", err.Error())
+				}
+				shifted = append(shifted, process(srows))
+			}
+			rows = CompareRows(rows, shifted, shifts, mode)
 		}
+		var forecast *ForecastRange
+		if c.IsSet("forecast") {
+			fID, err := f.ParseForecastName(c.String("forecast"))
+			if err != nil {
+				LogFatal("Invalid --forecast parameter: %s", err.Error())
+			}
+			if forecast, err = f.GetForecastRange(fID, tsMin, tsMax, loadCols); err != nil {
+				LogFatal("Load forecast error: %s", err.Error())
+			}
+		}
+		showArchive := c.Bool("show-archive")
+		showCounters := c.Bool("show-counters")
+		if len(shifts) > 0 {
+			printCompareHeader(f, colsIDs, exprs, shifts, mode, separator, showArchive, showCounters, forecast != nil)
+		}
+		archives := f.Archives()
 		prevValid := true
 		for _, row := range rows {
 			valid := false
 			outp := timeFmt(row.TS) + separator
-			for _, col := range row.Values {
+			if showArchive && len(row.Values) > 0 {
+				outp += archives[row.Values[0].ArchiveID].Name + separator
+			}
+			for idx, col := range row.Values {
 				if col.Valid {
 					outp += fmt.Sprintf("%f", col.Value)
 					valid = true
 				}
 				outp += separator
+				if showCounters {
+					if col.Valid {
+						outp += strconv.FormatInt(col.Counter, 10)
+					}
+					outp += separator
+				}
+				if forecast != nil && idx < baseCols {
+					outp += formatForecastValue(forecast, row.TS, col.Column, separator)
+				}
 			}
 			if separate && !valid {
 				if prevValid {
@@ -286,6 +464,484 @@ func getRangeValues(c *cli.Context) {
 	}
 }
 
+// printCompareHeader print labels of columns in get-range output with compared values
+func printCompareHeader(f *RRD, colsIDs []int, exprs []*Expr, shifts []int64, mode CompareMode,
+	separator string, showArchive, showCounters, forecast bool) {
+	if len(colsIDs) == 0 {
+		colsIDs = f.allColumnsIDs()
+	}
+	var names []string
+	for _, col := range colsIDs {
+		names = append(names, f.ColumnName(col))
+	}
+	for _, e := range exprs {
+		names = append(names, e.Name)
+	}
+	baseCols := len(names)
+
+	header := "ts" + separator
+	if showArchive {
+		header += "archive" + separator
+	}
+	for idx, label := range append(names, CompareLabels(names, shifts, mode)...) {
+		header += label + separator
+		if showCounters {
+			header += label + " counter" + separator
+		}
+		if forecast && idx < baseCols {
+			header += label + " predicted" + separator + label + " lower" + separator +
+				label + " upper" + separator + label + " flag" + separator
+		}
+	}
+	fmt.Println(header)
+}
+
+// formatForecastValue return predicted value, confidence band and flag
+// (F - failure, V - violation) for column in row
+func formatForecastValue(fr *ForecastRange, ts int64, column int, separator string) string {
+	fv, ok := fr.Get(ts, column)
+	if !ok || !fv.Valid {
+		return strings.Repeat(separator, 4)
+	}
+	flag := ""
+	if fv.Failure {
+		flag = "F"
+	} else if fv.Violation {
+		flag = "V"
+	}
+	return fmt.Sprintf("%f%s%f%s%f%s%s%s", fv.Predicted, separator, fv.Lower, separator,
+		fv.Upper, separator, flag, separator)
+}
+
+func tsFormatter(c *cli.Context) func(int64) string {
+	if c.GlobalIsSet("format-ts") {
+		format := c.GlobalString("custom-ts-format")
+		if format == "" {
+			format = time.RFC3339
+		}
+		return func(ts int64) string {
+			return time.Unix(ts, 0).In(TimeLocation).Format(format)
+		}
+	}
+	return func(ts int64) string {
+		return fmt.Sprintf("%10d", ts)
+	}
+}
+
+func showStats(c *cli.Context) {
+	if !processGlobalArgs(c) {
+		return
+	}
+	filename, _ := getFilenameParam(c)
+	tsMin, tsMax := dateRangeToTs(c.String("begin"), c.String("end"))
+
+	percentiles := DefaultPercentiles
+	if c.IsSet("percentiles") {
+		percentiles = parsePercentiles(c.String("percentiles"))
+	}
+
+	ExitWhenErrors()
+
+	f, err := OpenRRD(filename, true)
+	defer close(f)
+	if err != nil {
+		LogFatal("Open db error: %s", err.Error())
+	}
+
+	var colsIDs []int
+	if c.IsSet("columns") {
+		colsIDs, err = f.ParseColumnsNames(strings.Split(c.String("columns"), ","))
+		if err != nil {
+			LogError("Invalid --columns parameter: %s", err.Error())
+			return
+		}
+	}
+
+	opts := RangeOptions{RealTime: !c.GlobalBool("no-rt")}
+	if c.IsSet("archive") && c.String("archive") != "" {
+		if opts.Archive, err = f.ParseArchiveName(c.String("archive")); err != nil {
+			LogError("Invalid --archive parameter: %s", err.Error())
+			return
+		}
+		opts.HasArchive = true
+	}
+
+	stats, err := f.Stats(tsMin, tsMax, colsIDs, percentiles, opts)
+	if err != nil {
+		LogFatal("Error: %s", err.Error())
+	}
+
+	timeFmt := tsFormatter(c)
+	for _, s := range stats {
+		fmt.Printf("Column %d: %s\n", s.Column, s.Name)
+		fmt.Printf("   Count:  %d\n", s.Count)
+		if s.Count == 0 {
+			continue
+		}
+		fmt.Printf("   Min:    %f  (%s)\n", s.Min, timeFmt(s.MinTS))
+		fmt.Printf("   Max:    %f  (%s)\n", s.Max, timeFmt(s.MaxTS))
+		fmt.Printf("   Mean:   %f\n", s.Mean)
+		fmt.Printf("   Sum:    %f\n", s.Sum)
+		fmt.Printf("   StdDev: %f\n", s.StdDev)
+		fmt.Printf("   First:  %f  (%s)\n", s.First, timeFmt(s.FirstTS))
+		fmt.Printf("   Last:   %f  (%s)\n", s.Last, timeFmt(s.LastTS))
+		for _, p := range s.Percentiles {
+			fmt.Printf("   P%-5v: %f\n", p.P, p.Value)
+		}
+	}
+}
+
+// parsePercentiles parse comma separated list of percentiles; errors are
+// logged by LogError
+func parsePercentiles(inp string) (percentiles []float64) {
+	for _, p := range strings.Split(inp, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v < 0 || v > 100 {
+			LogError("Invalid percentile '%s'", p)
+		}
+		percentiles = append(percentiles, v)
+	}
+	return
+}
+
+func showProfile(c *cli.Context) {
+	if !processGlobalArgs(c) {
+		return
+	}
+	filename, _ := getFilenameParam(c)
+	tsMin, tsMax := dateRangeToTs(c.String("begin"), c.String("end"))
+
+	group, ok := ParseProfileGroup(c.String("group"))
+	if !ok {
+		LogError("Invalid --group parameter")
+	}
+	var percentiles []float64
+	if c.String("percentiles") != "" {
+		percentiles = parsePercentiles(c.String("percentiles"))
+	}
+
+	ExitWhenErrors()
+
+	f, err := OpenRRD(filename, true)
+	defer close(f)
+	if err != nil {
+		LogFatal("Open db error: %s", err.Error())
+	}
+
+	var colsIDs []int
+	if c.IsSet("columns") {
+		colsIDs, err = f.ParseColumnsNames(strings.Split(c.String("columns"), ","))
+		if err != nil {
+			LogError("Invalid --columns parameter: %s", err.Error())
+			return
+		}
+	}
+
+	opts := RangeOptions{RealTime: !c.GlobalBool("no-rt")}
+	if c.IsSet("archive") && c.String("archive") != "" {
+		if opts.Archive, err = f.ParseArchiveName(c.String("archive")); err != nil {
+			LogError("Invalid --archive parameter: %s", err.Error())
+			return
+		}
+		opts.HasArchive = true
+	}
+
+	profile, err := f.Profile(tsMin, tsMax, colsIDs, group, percentiles, TimeLocation, opts)
+	if err != nil {
+		LogFatal("Error: %s", err.Error())
+	}
+
+	if c.IsSet("heatmap") {
+		h := &Heatmap{Profile: profile, Width: c.Int("width"), Height: c.Int("height")}
+		if err := h.plotHeatmap(c.String("heatmap")); err != nil {
+			LogError("Heatmap error: %s", err.Error())
+		}
+	}
+
+	if c.Bool("json") {
+		j, err := json.MarshalIndent(profile, "", "  ")
+		if err != nil {
+			LogFatal("Encode error: %s", err.Error())
+		}
+		fmt.Println(string(j))
+		return
+	}
+
+	separator := c.GlobalString("separator")
+	for idx, name := range profile.Columns {
+		fmt.Printf("Column %d: %s\n", idx, name)
+		header := []string{group.String(), "count", "mean", "min", "max"}
+		for _, p := range percentiles {
+			header = append(header, fmt.Sprintf("p%v", p))
+		}
+		fmt.Println(strings.Join(header, separator))
+		for _, b := range profile.Buckets {
+			s := b.Columns[idx]
+			line := []string{b.Label(), strconv.FormatInt(s.Count, 10)}
+			if s.Count > 0 {
+				line = append(line, fmt.Sprintf("%f", s.Mean), fmt.Sprintf("%f", s.Min), fmt.Sprintf("%f", s.Max))
+				for _, p := range s.Percentiles {
+					line = append(line, fmt.Sprintf("%f", p.Value))
+				}
+			}
+			fmt.Println(strings.Join(line, separator))
+		}
+	}
+}
+
+func showAnomalies(c *cli.Context) {
+	if !processGlobalArgs(c) {
+		return
+	}
+	filename, _ := getFilenameParam(c)
+	tsMin, tsMax := dateRangeToTs(c.String("begin"), c.String("end"))
+
+	ExitWhenErrors()
+
+	f, err := OpenRRD(filename, true)
+	defer close(f)
+	if err != nil {
+		LogFatal("Open db error: %s", err.Error())
+	}
+
+	var colsIDs []int
+	if c.IsSet("columns") {
+		if colsIDs, err = f.ParseColumnsNames(strings.Split(c.String("columns"), ",")); err != nil {
+			LogError("Invalid --columns parameter: %s", err.Error())
+			return
+		}
+	}
+
+	fID := 0
+	if c.IsSet("forecast") {
+		if fID, err = f.ParseForecastName(c.String("forecast")); err != nil {
+			LogError("Invalid --forecast parameter: %s", err.Error())
+			return
+		}
+	} else if len(f.Forecasts()) == 0 {
+		LogError("No forecasts defined in file")
+		return
+	}
+
+	anomalies, err := f.Anomalies(fID, tsMin, tsMax, colsIDs, c.Bool("violations"))
+	if err != nil {
+		LogFatal("Error: %s", err.Error())
+	}
+
+	timeFmt := tsFormatter(c)
+	separator := c.GlobalString("separator")
+	for _, a := range anomalies {
+		kind := "violation"
+		if a.Failure {
+			kind = "failure"
+		}
+		fmt.Println(strings.Join([]string{
+			timeFmt(a.TS),
+			f.ColumnName(a.Column),
+			fmt.Sprintf("%f", a.Observed),
+			fmt.Sprintf("%f", a.Predicted),
+			fmt.Sprintf("%f", a.Lower),
+			fmt.Sprintf("%f", a.Upper),
+			kind,
+		}, separator))
+	}
+}
+
+func predictTrend(c *cli.Context) {
+	if !processGlobalArgs(c) {
+		return
+	}
+	filename, _ := getFilenameParam(c)
+	tsMin, tsMax := dateRangeToTs(c.String("begin"), c.String("end"))
+	if c.String("begin") == "" {
+		// by default fit trend to week before end
+		tsMin = tsMax - 7*24*60*60
+	}
+	method, ok := ParseTrendMethod(c.String("method"))
+	if !ok {
+		LogError("Invalid --method parameter")
+	}
+	var threshold float64
+	if c.IsSet("threshold") {
+		var err error
+		if threshold, err = strconv.ParseFloat(c.String("threshold"), 64); err != nil {
+			LogError("Invalid --threshold parameter")
+		}
+	}
+
+	ExitWhenErrors()
+
+	f, err := OpenRRD(filename, true)
+	defer close(f)
+	if err != nil {
+		LogFatal("Open db error: %s", err.Error())
+	}
+
+	colsIDs := f.allColumnsIDs()
+	if c.IsSet("columns") {
+		if colsIDs, err = f.ParseColumnsNames(strings.Split(c.String("columns"), ",")); err != nil {
+			LogError("Invalid --columns parameter: %s", err.Error())
+			return
+		}
+	}
+	opts, ok := parseRangeOptions(c, f)
+	if !ok {
+		return
+	}
+
+	rows, err := f.GetRangeOpts(tsMin, tsMax, colsIDs, opts)
+	if err != nil {
+		LogFatal("Error: %s", err.Error())
+	}
+
+	timeFmt := tsFormatter(c)
+	for idx, col := range colsIDs {
+		fmt.Printf("Column %d: %s\n", col, f.ColumnName(col))
+		trend, err := FitTrend(rows, idx, method)
+		if err != nil {
+			fmt.Printf("   %s\n", err.Error())
+			continue
+		}
+		fmt.Printf("   Points:  %d  (%s - %s)\n", trend.Points, timeFmt(trend.Begin), timeFmt(trend.End))
+		fmt.Printf("   Slope:   %f per day\n", trend.SlopePerDay())
+		fmt.Printf("   R2:      %f\n", trend.R2)
+		fmt.Printf("   Current: %f  (%s)\n", trend.ValueAt(trend.End), timeFmt(trend.End))
+		if !c.IsSet("threshold") {
+			continue
+		}
+		switch ts, crossing := trend.Crossing(threshold, trend.End); crossing {
+		case CrossingFuture:
+			fmt.Printf("   Reach %g: %s  (in %s)\n", threshold, timeFmt(ts), FormatDuration(ts-trend.End))
+		case CrossingReached:
+			fmt.Printf("   Reach %g: already reached at %s\n", threshold, timeFmt(ts))
+		default:
+			fmt.Printf("   Reach %g: never\n", threshold)
+		}
+	}
+}
+
+func checkThresholds(c *cli.Context) {
+	// errors are reported as UNKNOWN status
+	unknown := func(format string, a ...interface{}) {
+		fmt.Println("RRD UNKNOWN - " + fmt.Sprintf(format, a...))
+		os.Exit(int(CheckUnknown))
+	}
+
+	if !processGlobalArgs(c) {
+		os.Exit(int(CheckUnknown))
+	}
+	filename, ok := getFilenameParam(c)
+	if !ok {
+		os.Exit(int(CheckUnknown))
+	}
+
+	opts := CheckOptions{Stat: c.String("stat")}
+	var err error
+	if c.IsSet("warning") {
+		if opts.Warning, err = ParseThreshold(c.String("warning")); err != nil {
+			unknown("invalid --warning: %s", err.Error())
+		}
+	}
+	if c.IsSet("critical") {
+		if opts.Critical, err = ParseThreshold(c.String("critical")); err != nil {
+			unknown("invalid --critical: %s", err.Error())
+		}
+	}
+	if c.IsSet("window") {
+		if opts.Window, err = ParseDuration(c.String("window")); err != nil || opts.Window < 1 {
+			unknown("invalid --window")
+		}
+	}
+	if c.IsSet("max-age") {
+		if opts.MaxAge, err = ParseDuration(c.String("max-age")); err != nil || opts.MaxAge < 1 {
+			unknown("invalid --max-age")
+		}
+	}
+
+	f, err := OpenRRD(filename, true)
+	if err != nil {
+		unknown("open db error: %s", err.Error())
+	}
+
+	if opts.Column, err = f.ParseColumnName(c.String("column")); err != nil {
+		unknown("invalid --column: %s", err.Error())
+	}
+
+	res, err := f.Check(opts)
+	if err != nil {
+		unknown("%s", err.Error())
+	}
+	fmt.Println(res.String())
+	close(f)
+	os.Exit(int(res.Status))
+}
+
+func parseCompare(c *cli.Context) (shifts []int64, mode CompareMode, ok bool) {
+	if !c.IsSet("compare") {
+		return nil, CompareValues, true
+	}
+	var err error
+	if shifts, err = ParseShifts(c.String("compare")); err != nil {
+		LogError("Invalid --compare parameter: %s", err.Error())
+		return nil, mode, false
+	}
+	if mode, ok = ParseCompareMode(c.String("compare-mode")); !ok {
+		LogError("Invalid --compare-mode parameter")
+	}
+	return
+}
+
+func parseExprs(c *cli.Context, f *RRD) (exprs []*Expr, ok bool) {
+	for _, def := range c.StringSlice("expr") {
+		e, err := ParseExprDef(def, f)
+		if err != nil {
+			LogError("Invalid --expr parameter: %s", err.Error())
+			return nil, false
+		}
+		exprs = append(exprs, e)
+	}
+	return exprs, true
+}
+
+func parseRangeOptions(c *cli.Context, f *RRD) (opts RangeOptions, ok bool) {
+	opts.IncludeInvalid = c.Bool("include-invalid")
+	opts.RealTime = !c.GlobalBool("no-rt")
+	opts.Stitch = c.Bool("stitch")
+	if c.IsSet("fill") {
+		var err error
+		if opts.Fill, opts.FillValue, err = ParseFill(c.String("fill")); err != nil {
+			LogError("Invalid --fill parameter: %s", err.Error())
+			return opts, false
+		}
+	}
+	if c.IsSet("max-gap") && c.String("max-gap") != "" {
+		var err error
+		if opts.MaxGap, err = ParseDuration(c.String("max-gap")); err != nil || opts.MaxGap < 0 {
+			LogError("Invalid --max-gap parameter")
+			return opts, false
+		}
+	}
+	if c.IsSet("archive") && c.String("archive") != "" {
+		var err error
+		if opts.Archive, err = f.ParseArchiveName(c.String("archive")); err != nil {
+			LogError("Invalid --archive parameter: %s", err.Error())
+			return opts, false
+		}
+		opts.HasArchive = true
+	}
+	if c.IsSet("step") && c.String("step") != "" {
+		var err error
+		if opts.Step, err = ParseDuration(c.String("step")); err != nil || opts.Step < 1 {
+			LogError("Invalid --step parameter")
+			return opts, false
+		}
+	}
+	return opts, true
+}
+
 func showInfo(c *cli.Context) {
 	if !processGlobalArgs(c) {
 		return
@@ -370,7 +1026,7 @@ func dumpData(c *cli.Context) {
 		return
 	}
 
-	if err := f.Dump(output); err != nil {
+	if err := f.Dump(output, c.Bool("gzip")); err != nil {
 		LogFatal("Error: %s", err.Error())
 	} else {
 		Log("Done")
@@ -393,7 +1049,7 @@ func loadData(c *cli.Context) {
 
 	ExitWhenErrors()
 
-	f, err := LoadDumpRRD(input, filename)
+	f, err := LoadDumpRRD(input, filename, c.Bool("validate"))
 	defer close(f)
 	if err != nil {
 		LogFatal("Error: %s", err.Error())
@@ -445,7 +1101,7 @@ func modifyChangeColumn(c *cli.Context) {
 
 	ExitWhenErrors()
 
-	f, err := OpenRRD(filename, false)
+	f, err := OpenRRD(filename, true)
 	defer close(f)
 	if err != nil {
 		LogFatal("Open db error: %s", err.Error())
@@ -471,6 +1127,18 @@ func modifyChangeColumn(c *cli.Context) {
 		}
 	}
 
+	if c.IsSet("function") {
+		funcID, ok := ParseFunctionName(strings.TrimSpace(c.String("function")))
+		if !ok {
+			LogError("Invalid function (--function): %s", c.String("function"))
+			return
+		}
+		if funcID != col.Function {
+			Log("Changing function from %s to %s; only values converted into count and between average and sum are recalculated", col.Function, funcID)
+			col.Function = funcID
+		}
+	}
+
 	if c.Bool("no-min") {
 		col.HasMinimum = false
 	} else if c.IsSet("min") {
@@ -487,32 +1155,50 @@ func modifyChangeColumn(c *cli.Context) {
 		col.HasMaximum = true
 	}
 
-	f.SetColumn(colIdx, col)
+	f.Close()
+	f = nil
 
-	tmpName := filename + ".new"
-	if err = f.SaveAs(tmpName); err != nil {
-		LogFatal("Save file to %s error: %s", filename, err.Error())
+	if err := ModifyChangeColumn(filename, colIdx, col); err != nil {
+		LogFatal("Error: %s", err.Error())
+	} else {
+		Log("Done")
+	}
+}
+
+func modifyDelColumns(c *cli.Context) {
+	if !processGlobalArgs(c) {
+		return
+	}
+	filename, ok := getFilenameParam(c)
+	if !ok {
 		return
 	}
+	cols := c.String("columns")
+	if !c.IsSet("columns") || cols == "" {
+		LogError("Missing columns to delete (--columns)")
+	}
 
-	f.Close()
-	f = nil
-
-	LogDebug("delete old file")
-	if err := os.Remove(filename); err != nil {
-		LogFatal("removing old file %s error: %s", filename, err.Error())
+	r, err := OpenRRD(filename, true)
+	if err != nil {
+		close(r)
 		return
 	}
+	columns, err := r.ParseColumnsNames(strings.Split(cols, ","))
+	if err != nil {
+		LogError("Columns definition error: " + err.Error())
+	}
+	r.Close()
+
+	ExitWhenErrors()
 
-	LogDebug("rename temp file")
-	if err := os.Rename(tmpName, filename); err != nil {
-		LogFatal("renaming file %s to %s error: %s", tmpName, filename, err.Error())
+	if err := ModifyDelColumns(filename, columns); err != nil {
+		LogFatal("Error: %s", err.Error())
 	} else {
 		Log("Done")
 	}
 }
 
-func modifyDelColumns(c *cli.Context) {
+func modifyReorderColumns(c *cli.Context) {
 	if !processGlobalArgs(c) {
 		return
 	}
@@ -522,11 +1208,14 @@ func modifyDelColumns(c *cli.Context) {
 	}
 	cols := c.String("columns")
 	if !c.IsSet("columns") || cols == "" {
-		LogError("Missing columns to delete (--columns)")
+		LogError("Missing columns order (--columns)")
 	}
 
+	ExitWhenErrors()
+
 	r, err := OpenRRD(filename, true)
 	if err != nil {
+		LogFatal("Open db error: %s", err.Error())
 		close(r)
 		return
 	}
@@ -534,11 +1223,11 @@ func modifyDelColumns(c *cli.Context) {
 	if err != nil {
 		LogError("Columns definition error: " + err.Error())
 	}
-	r.Close()
+	close(r)
 
 	ExitWhenErrors()
 
-	if err := ModifyDelColumns(filename, columns); err != nil {
+	if err := ModifyReorderColumns(filename, columns); err != nil {
 		LogFatal("Error: %s", err.Error())
 	} else {
 		Log("Done")
@@ -572,6 +1261,35 @@ func modifyAddArchives(c *cli.Context) {
 	}
 }
 
+func modifySetForecasts(c *cli.Context) {
+	if !processGlobalArgs(c) {
+		return
+	}
+	filename, ok := getFilenameParam(c)
+	if !ok {
+		return
+	}
+
+	var forecasts []RRDForecast
+	forecastsDef := c.String("forecasts")
+	if c.IsSet("forecasts") && forecastsDef != "" {
+		var err error
+		if forecasts, err = ParseForecastDef(forecastsDef); err != nil {
+			LogError("Forecasts definition error: " + err.Error())
+		}
+	} else if !c.Bool("clear") {
+		LogError("Missing forecasts definition (--forecasts) or --clear")
+	}
+
+	ExitWhenErrors()
+
+	if err := ModifySetForecasts(filename, forecasts); err != nil {
+		LogFatal("Error: %s", err.Error())
+	} else {
+		Log("Done")
+	}
+}
+
 func modifyDelArchives(c *cli.Context) {
 	if !processGlobalArgs(c) {
 		return
@@ -610,6 +1328,61 @@ func modifyDelArchives(c *cli.Context) {
 	}
 }
 
+func purgeData(c *cli.Context) {
+	if !processGlobalArgs(c) {
+		return
+	}
+	filename, ok := getFilenameParam(c)
+	if !ok {
+		return
+	}
+
+	var tsMin, tsMax int64
+	tsMinStr, tsMaxStr := c.String("begin"), c.String("end")
+	if tsMinStr == "" {
+		LogError("Missing begin date (--begin)")
+	}
+	if tsMaxStr == "" {
+		LogError("Missing end date (--end)")
+	}
+	if tsMinStr != "" && tsMaxStr != "" {
+		tsMin, tsMax = dateRangeToTs(tsMinStr, tsMaxStr)
+	}
+	if tsMin > tsMax {
+		LogError("Begin date after end date")
+	}
+
+	ExitWhenErrors()
+
+	f, err := OpenRRD(filename, false)
+	defer close(f)
+	if err != nil {
+		LogFatal("Open db error: %s", err.Error())
+	}
+
+	var colsIDs []int
+	if c.IsSet("columns") && c.String("columns") != "" {
+		if colsIDs, err = f.ParseColumnsNames(strings.Split(c.String("columns"), ",")); err != nil {
+			LogError("Invalid --columns parameter: %s", err.Error())
+			return
+		}
+	}
+
+	var archIDs []int
+	if c.IsSet("archives") && c.String("archives") != "" {
+		if archIDs, err = f.ParseArchiveNames(strings.Split(c.String("archives"), ",")); err != nil {
+			LogError("Invalid --archives parameter: %s", err.Error())
+			return
+		}
+	}
+
+	purged, err := f.Purge(tsMin, tsMax, colsIDs, archIDs)
+	if err != nil {
+		LogFatal("Purge error: %s", err.Error())
+	}
+	Log("Cleared %d rows", purged)
+}
+
 func modifyResizeArchive(c *cli.Context) {
 	if !processGlobalArgs(c) {
 		return
@@ -652,6 +1425,55 @@ func modifyResizeArchive(c *cli.Context) {
 	}
 }
 
+func modifyChangeArchive(c *cli.Context) {
+	if !processGlobalArgs(c) {
+		return
+	}
+	filename, ok := getFilenameParam(c)
+	if !ok {
+		return
+	}
+
+	archivesDef := c.String("archive")
+	if !c.IsSet("archive") || archivesDef == "" {
+		LogError("Missing archive (--archive)")
+	}
+	name := strings.TrimSpace(c.String("name"))
+	var step int64
+	if c.IsSet("step") {
+		var err error
+		if step, err = ParseDuration(c.String("step")); err != nil || step < 1 {
+			LogError("Invalid step (--step)")
+		}
+	}
+	if name == "" && step < 1 {
+		LogError("Missing new name (--name) or step (--step)")
+	}
+
+	ExitWhenErrors()
+
+	f, err := OpenRRD(filename, true)
+	if err != nil {
+		LogFatal("Open db error: %s", err.Error())
+		close(f)
+		return
+	}
+
+	archive, err := f.ParseArchiveName(archivesDef)
+	if err != nil {
+		LogError("Archives definition error: " + err.Error())
+		close(f)
+		return
+	}
+	close(f)
+
+	if err := ModifyChangeArchive(filename, archive, name, step); err != nil {
+		LogFatal("Error: %s", err.Error())
+	} else {
+		Log("Done")
+	}
+}
+
 func updateRRDfile(c *cli.Context) {
 	if !processGlobalArgs(c) {
 		return
@@ -670,29 +1492,94 @@ func updateRRDfile(c *cli.Context) {
 	}
 }
 
-func genRandomData(c *cli.Context) {
+func mergeFiles(c *cli.Context) {
 	if !processGlobalArgs(c) {
 		return
 	}
-	filename, _ := getFilenameParam(c)
-	tsMin := int64(0)
-	tsMinStr := c.String("begin")
-	if c.IsSet("begin") && tsMinStr != "" {
-		var ok bool
-		tsMin, ok = dateToTs(tsMinStr)
-		if !ok {
-			LogError("Parsing begin date error")
-		}
+	filename, ok := getFilenameParam(c)
+	if !ok {
+		return
+	}
+
+	sources := c.Args()
+	if len(sources) == 0 {
+		LogError("Missing source files")
+	}
+
+	policy, ok := ParseMergePolicy(c.String("policy"))
+	if !ok {
+		LogError("Invalid merge policy (--policy): %s", c.String("policy"))
 	}
-	tsMaxStr := c.String("end")
-	if !c.IsSet("end") || tsMaxStr == "" {
-		tsMaxStr = "now"
+
+	ExitWhenErrors()
+
+	if err := MergeRRD(filename, sources, policy); err != nil {
+		LogFatal("Error: %s", err.Error())
+	} else {
+		Log("Done")
 	}
+}
 
-	tsMax, ok := dateToTs(tsMaxStr)
+func schemaApply(c *cli.Context) {
+	if !processGlobalArgs(c) {
+		return
+	}
+	filename, ok := getFilenameParam(c)
 	if !ok {
-		LogError("Parsing end date error")
+		return
+	}
+
+	schemaFile := c.String("schema")
+	if !c.IsSet("schema") || schemaFile == "" {
+		LogError("Missing schema file (--schema)")
+	}
+
+	ExitWhenErrors()
+
+	schema, err := LoadSchema(schemaFile)
+	if err != nil {
+		LogFatal("Load schema error: %s", err.Error())
+	}
+
+	f, err := OpenRRD(filename, true)
+	if err != nil {
+		LogFatal("Open db error: %s", err.Error())
+		close(f)
+		return
 	}
+	changes, err := PlanSchemaChanges(f, schema)
+	close(f)
+	if err != nil {
+		LogFatal("Error: %s", err.Error())
+	}
+
+	if len(changes) == 0 {
+		Log("No changes")
+		return
+	}
+	for _, ch := range changes {
+		fmt.Println(ch.Description)
+	}
+	if c.Bool("dry-run") {
+		return
+	}
+
+	if err := ApplySchemaChanges(filename, changes); err != nil {
+		LogFatal("Error: %s", err.Error())
+	}
+
+	if f, err = OpenRRD(filename, true); err == nil {
+		printRRDInfo(f)
+	}
+	close(f)
+}
+
+func genRandomData(c *cli.Context) {
+	if !processGlobalArgs(c) {
+		return
+	}
+	filename, _ := getFilenameParam(c)
+	tsMin, tsMax := dateRangeToTs(c.String("begin"), c.String("end"))
 
 	step := int64(c.Int("step"))
 	if !c.IsSet("step") || step < 1 {
@@ -720,38 +1607,30 @@ func genRandomData(c *cli.Context) {
 	}
 }
 
-var timeFormats = []string{
-	time.RFC822,
-	time.RFC822Z,
-	time.RFC3339,
-	time.RFC3339Nano,
-	"2006-01-02T15:04:05",
-	"2006-01-02T15:04",
-	"2006-01-02T15",
-	"2006-01-02 15:04:05",
-	"2006-01-02 15:04",
-	"2006-01-02 15",
-	"2006-01-02",
-}
-
 func dateToTs(ts string) (int64, bool) {
-	if ts == "N" || ts == "NOW" || ts == "now" {
-		return time.Now().Unix(), true
-	}
-	if res, err := strconv.ParseInt(ts, 10, 64); err == nil {
-		return res, true
+	res, err := ParseTimeExpr(ts, time.Now(), nil)
+	if err != nil {
+		LogDebug("dateToTs error: %s", err.Error())
+		return time.Now().Unix(), false
 	}
+	return res, true
+}
 
-	if d, err := time.ParseDuration(ts); err == nil {
-		return time.Now().Add(d).Unix(), true
+// dateRangeToTs parse begin and end dates; empty begin means 0 and empty end - now.
+// Errors are logged by LogError.
+func dateRangeToTs(begin, end string) (int64, int64) {
+	if begin == "" {
+		begin = "0"
 	}
-
-	for _, format := range timeFormats {
-		if t, err := time.Parse(format, ts); err == nil {
-			return t.Unix(), true
-		}
+	if end == "" {
+		end = "now"
+	}
+	tsMin, tsMax, err := ParseTimeRange(begin, end, time.Now())
+	if err != nil {
+		LogError("Parsing date error: %s", err.Error())
+		return 0, 0
 	}
-	return time.Now().Unix(), false
+	return tsMin, tsMax
 }
 
 func parseArchiveDef(inp string) (archives []RRDArchive, err error) {
@@ -769,18 +1648,29 @@ func parseArchiveDef(inp string) (archives []RRDArchive, err error) {
 		} else {
 			a.Name = fmt.Sprintf("a%02d", idx+1)
 		}
-		var numRows int
-		numRows, err = strconv.Atoi(adef[0])
-		if err != nil {
-			return nil, fmt.Errorf("invalid archive definition on index %d: '%s' - invalid rows number", idx+1, v)
+		numRows, errRows := strconv.Atoi(adef[0])
+		step, errStep := strconv.Atoi(adef[1])
+		if errRows == nil && errStep == nil {
+			// rows:step
+			a.Rows = int32(numRows)
+			a.Step = int64(step)
+		} else {
+			// step:retention with units; mixed form (i.e. 1m:2880 or 10:1m) is ambiguous
+			if errRows == nil || errStep == nil {
+				return nil, fmt.Errorf("invalid archive definition on index %d: '%s' - step and retention require units", idx+1, v)
+			}
+			if a.Step, err = ParseDuration(adef[0]); err != nil || a.Step < 1 {
+				return nil, fmt.Errorf("invalid archive definition on index %d: '%s' - invalid step", idx+1, v)
+			}
+			var retention int64
+			if retention, err = ParseDuration(adef[1]); err != nil || retention < a.Step {
+				return nil, fmt.Errorf("invalid archive definition on index %d: '%s' - invalid retention", idx+1, v)
+			}
+			a.Rows = int32((retention + a.Step - 1) / a.Step)
 		}
-		a.Rows = int32(numRows)
-		var step int
-		step, err = strconv.Atoi(adef[1])
-		if err != nil {
-			return nil, fmt.Errorf("invalid archive definition on index %d: '%s' - invalid step", idx+1, v)
+		if a.Rows < 1 || a.Step < 1 {
+			return nil, fmt.Errorf("invalid archive definition on index %d: '%s' - invalid rows number or step", idx+1, v)
 		}
-		a.Step = int64(step)
 		archives = append(archives, a)
 	}
 	return
@@ -853,10 +1743,10 @@ func printRRDInfo(f *RRD) {
 		fmt.Printf("Archives: %d\n", info.ArchivesCount)
 		for idx, a := range info.Archives {
 			fmt.Printf(" %2d. %-16s\n", idx, a.Name)
-			tstep := time.Duration(a.Step) * time.Second
-			fmt.Printf("     Rows: %5d   Step: %d  (%s)\n", a.Rows, a.Step, tstep.String())
+			fmt.Printf("     Rows: %5d   Step: %d  (%s)   Retention: %s\n", a.Rows, a.Step,
+				FormatDuration(a.Step), FormatDuration(a.Step*int64(a.Rows)))
 			fmt.Printf("     TS range: %d - %d (%s - %s)\n", a.MinTS, a.MaxTS,
-				time.Unix(a.MinTS, 0).String(), time.Unix(a.MaxTS, 0).String())
+				time.Unix(a.MinTS, 0).In(TimeLocation).String(), time.Unix(a.MaxTS, 0).In(TimeLocation).String())
 			fmt.Printf("     Used rows: %d (%0.1f%%)\n", a.UsedRows,
 				100.0*float32(a.UsedRows)/float32(a.Rows))
 			valuesInRows := float32(0)
@@ -867,11 +1757,35 @@ func printRRDInfo(f *RRD) {
 			fmt.Printf("     Inserted values: %d (%0.1f%% in rows; %0.1f%% in database)\n",
 				a.Values, 100.0*valuesInRows, 100.0*valuesInDb)
 		}
+		if len(info.Forecasts) > 0 {
+			fmt.Printf("Forecasts: %d\n", len(info.Forecasts))
+			for idx, fc := range info.Forecasts {
+				fmt.Printf(" %2d. %-16s\n", idx, fc.Name)
+				fmt.Printf("     Rows: %5d   Step: %d  (%s)   Season: %s   Retention: %s\n", fc.Rows, fc.Step,
+					FormatDuration(fc.Step), FormatDuration(fc.Step*int64(fc.Season)),
+					FormatDuration(fc.Step*int64(fc.Rows)))
+				fmt.Printf("     Alpha: %g   Beta: %g   Gamma: %g   Delta: %g   Failure: %d of %d\n",
+					fc.Alpha, fc.Beta, fc.Gamma, fc.Delta, fc.Threshold, fc.Window)
+			}
+		}
 	} else {
 		fmt.Println("Error: " + err.Error())
 	}
 }
 
+// sameFile check if both names point to the same existing file
+func sameFile(name1, name2 string) bool {
+	fi1, err := os.Stat(name1)
+	if err != nil {
+		return false
+	}
+	fi2, err := os.Stat(name2)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi1, fi2)
+}
+
 func processGlobalArgs(c *cli.Context) (ok bool) {
 	if c.GlobalIsSet("debug-level") {
 		Debug = c.GlobalInt("debug-level")
@@ -879,6 +1793,12 @@ func processGlobalArgs(c *cli.Context) (ok bool) {
 	if c.GlobalBool("debug") && Debug <= 0 {
 		Debug = 1
 	}
+	if tz := c.GlobalString("timezone"); tz != "" {
+		if err := SetTimeZone(tz); err != nil {
+			LogError("Invalid --timezone: %s", err.Error())
+			return false
+		}
+	}
 	return true
 }
 
@@ -897,24 +1817,7 @@ func plotRangeValues(c *cli.Context) {
 		return
 	}
 	filename, _ := getFilenameParam(c)
-	tsMin := int64(0)
-	tsMinStr := c.String("begin")
-	if c.IsSet("begin") && tsMinStr != "" {
-		var ok bool
-		tsMin, ok = dateToTs(tsMinStr)
-		if !ok {
-			LogError("Parsing begin date error")
-		}
-	}
-
-	tsMaxStr := c.String("end")
-	if !c.IsSet("end") || tsMaxStr == "" {
-		tsMaxStr = "now"
-	}
-	tsMax, ok := dateToTs(tsMaxStr)
-	if !ok {
-		LogError("Parsing end date error")
-	}
+	tsMin, tsMax := dateRangeToTs(c.String("begin"), c.String("end"))
 
 	f, err := OpenRRD(filename, true)
 	defer close(f)
@@ -930,11 +1833,23 @@ func plotRangeValues(c *cli.Context) {
 			LogError("Invalid --columns parameter: %s", err.Error())
 			return
 		}
-		if len(colsIDs) > 2 || len(colsIDs) == 0 {
-			LogError("Wrong number of columns; 1 or 2 columns are requred")
-		}
-	} else {
-		LogError("Missing columns; 1 or 2 columns are requred")
+	}
+	exprs, ok := parseExprs(c, f)
+	if !ok {
+		return
+	}
+	downsample, ok := ParseDownsampleMethod(c.String("downsample"))
+	if !ok {
+		LogError("Invalid --downsample parameter")
+		return
+	}
+	transforms, err := ParseTransforms(c.StringSlice("transform"))
+	if err != nil {
+		LogError("Invalid --transform parameter: %s", err.Error())
+		return
+	}
+	if cnt := len(colsIDs) + len(exprs); cnt > 2 || cnt == 0 {
+		LogError("Wrong number of columns; 1 or 2 columns or expressions are requred")
 	}
 
 	p := &Plot{}
@@ -957,35 +1872,104 @@ func plotRangeValues(c *cli.Context) {
 		Log("Output filename not given - using 'chart.png'")
 		outFilename = "chart.png"
 	}
-	includeInvalid := c.Bool("include-invalid")
-	noRealTime := c.GlobalBool("no-rt")
+	opts, ok := parseRangeOptions(c, f)
+	if !ok {
+		return
+	}
+	loadCols := ExprsColumns(colsIDs, exprs)
+	shifts, mode, ok := parseCompare(c)
+	if !ok {
+		return
+	}
 
-	if rows, err := f.GetRange(tsMin, tsMax, colsIDs, includeInvalid, !noRealTime); err == nil {
+	process := func(rows Rows) Rows {
 		if c.IsSet("fix-ranges") {
 			// mark values not matching min-max range
 			rows = RemoveInvalidVals(rows, f.Columns())
 		}
-		if c.IsSet("average-result") {
+		if len(exprs) > 0 {
+			// evaluate expressions on raw rows; results are consolidated like other columns
+			rows = ApplyExprs(rows, loadCols, len(colsIDs), exprs, len(f.Columns()))
+		}
+		if c.IsSet("average-by") {
+			if unit, ok := ParseCalendarUnit(c.String("average-by")); ok {
+				rows = AverageByCalendar(rows, unit, TimeLocation, f.Columns())
+			} else {
+				LogError("Invalid --average-by: %s; ignoring", c.String("average-by"))
+			}
+		} else if c.IsSet("average-result") {
 			if step := c.Int("average-result"); step > 1 {
-				rows = AverageByTime(rows, int64(step))
+				rows = AverageByTime(rows, int64(step), f.Columns())
 			} else {
 				LogError("Invalid --average-result: %s; ignoring", step)
 			}
-		} else if c.IsSet("average-max-count") {
-			if cnt := c.Int("average-max-count"); cnt > 1 {
-				rows = AverageToNumber(rows, cnt)
+		} else if c.IsSet("average-max-count") || c.IsSet("downsample") {
+			// by default reduce to chart width
+			cnt := p.Width
+			if c.IsSet("average-max-count") {
+				cnt = c.Int("average-max-count")
+			}
+			if cnt > 1 {
+				rows = Downsample(rows, cnt, downsample, f.Columns())
 			} else {
 				LogError("Invalid --average-max-count: %s; ignoring", cnt)
 			}
 		}
+		return ApplyTransforms(rows, transforms)
+	}
+
+	if rows, err := f.GetRangeOpts(tsMin, tsMax, loadCols, opts); err == nil {
+		rows = process(rows)
 		if len(rows) < 2 {
 			LogFatal("Not enough points to plot")
 			return
 		}
 		p.Rows = rows
+		if c.IsSet("forecast") && len(colsIDs) > 0 {
+			fID, err := f.ParseForecastName(c.String("forecast"))
+			if err != nil {
+				LogFatal("Invalid --forecast parameter: %s", err.Error())
+			}
+			if p.Forecast, err = f.GetForecastRange(fID, tsMin, tsMax, colsIDs[:1]); err != nil {
+				LogFatal("Load forecast error: %s", err.Error())
+			}
+		}
 		for _, col := range colsIDs {
 			p.Cols = append(p.Cols, f.GetColumn(col).Name)
 		}
+		for _, e := range exprs {
+			p.Cols = append(p.Cols, e.Name)
+		}
+		if len(shifts) > 0 {
+			var shifted []Rows
+			for _, shift := range shifts {
+				srows, err := f.GetRangeOpts(tsMin-shift, tsMax-shift, loadCols, opts)
+				if err != nil {
+					LogFatal("Error: %s", err.Error())
+				}
+				shifted = append(shifted, process(srows))
+			}
+			baseCols := len(p.Cols)
+			p.Rows = CompareRows(rows, shifted, shifts, mode)
+			p.Cols = append(p.Cols, CompareLabels(p.Cols, shifts, mode)...)
+			for idx := baseCols; idx < len(p.Cols); idx++ {
+				p.BaseSeries = append(p.BaseSeries, (idx-baseCols)%baseCols)
+			}
+			p.CompareMode = mode
+		}
+		if c.IsSet("trend") {
+			method, ok := ParseTrendMethod(c.String("trend"))
+			if !ok {
+				LogFatal("Invalid --trend parameter")
+			}
+			for idx := range p.Cols[:len(p.Cols)-len(p.BaseSeries)] {
+				trend, err := FitTrend(rows, idx, method)
+				if err != nil {
+					Log("Trend for %s: %s", p.Cols[idx], err.Error())
+				}
+				p.Trends = append(p.Trends, trend)
+			}
+		}
 		p.plotChart(outFilename)
 	} else {
 		LogFatal("Error: %s", err.Error())
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CompareMode define how time-shifted values are presented
+type CompareMode int
+
+const (
+	// CompareValues append shifted values
+	CompareValues CompareMode = iota
+	// CompareDiff append difference: current - shifted
+	CompareDiff
+	// ComparePercent append percentage change: 100 * (current - shifted) / shifted
+	ComparePercent
+)
+
+func (m CompareMode) String() string {
+	switch m {
+	case CompareValues:
+		return "values"
+	case CompareDiff:
+		return "diff"
+	case ComparePercent:
+		return "pct"
+	}
+	return "unknown compare mode"
+}
+
+// ParseCompareMode return compare mode by name
+func ParseCompareMode(name string) (CompareMode, bool) {
+	switch strings.ToLower(name) {
+	case "", "values", "value":
+		return CompareValues, true
+	case "diff", "difference", "delta":
+		return CompareDiff, true
+	case "pct", "percent", "percentage":
+		return ComparePercent, true
+	}
+	return CompareValues, false
+}
+
+// ParseShifts parse comma separated list of time shifts (durations, i.e. 1d,7d)
+func ParseShifts(inp string) (shifts []int64, err error) {
+	for _, s := range strings.Split(inp, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		shift, err := ParseDuration(s)
+		if err != nil || shift < 1 {
+			return nil, fmt.Errorf("invalid time shift '%s'", s)
+		}
+		shifts = append(shifts, shift)
+	}
+	return
+}
+
+// CompareLabels return labels for columns appended by CompareRows
+func CompareLabels(names []string, shifts []int64, mode CompareMode) (labels []string) {
+	for _, shift := range shifts {
+		for _, name := range names {
+			switch mode {
+			case CompareDiff:
+				labels = append(labels, fmt.Sprintf("%s diff -%s", name, FormatDuration(shift)))
+			case ComparePercent:
+				labels = append(labels, fmt.Sprintf("%s %% -%s", name, FormatDuration(shift)))
+			default:
+				labels = append(labels, fmt.Sprintf("%s -%s", name, FormatDuration(shift)))
+			}
+		}
+	}
+	return
+}
+
+// CompareRows append to each row values from shifted rows (loaded for range
+// moved back by shifts[i]) aligned onto current time axis. For each shift are
+// appended values for all columns; mode define if appended are values,
+// differences or percentage changes. Shifted row match current row when it
+// cover its time (rows may have different resolution).
+func CompareRows(rows Rows, shifted []Rows, shifts []int64, mode CompareMode) Rows {
+	LogDebug("CompareRows rows=%d, shifts=%v, mode=%s", len(rows), shifts, mode)
+
+	steps := make([]int64, len(shifted))
+	for i, srows := range shifted {
+		steps[i] = minRowsInterval(srows)
+	}
+
+	out := make(Rows, 0, len(rows))
+	for _, row := range rows {
+		values := append([]Value(nil), row.Values...)
+		for sIdx, srows := range shifted {
+			srow, found := findCoveringRow(srows, row.TS-shifts[sIdx], steps[sIdx])
+			for c, cur := range row.Values {
+				v := Value{TS: row.TS, Column: cur.Column, ArchiveID: cur.ArchiveID}
+				if found && c < len(srow.Values) && srow.Values[c].Valid {
+					sv := srow.Values[c]
+					v.Counter = sv.Counter
+					switch mode {
+					case CompareDiff:
+						v.Value, v.Valid = cur.Value-sv.Value, cur.Valid
+					case ComparePercent:
+						if sv.Value != 0 {
+							v.Value, v.Valid = 100*(cur.Value-sv.Value)/sv.Value, cur.Valid
+						}
+					default:
+						v.Value, v.Valid = sv.Value, true
+					}
+				}
+				values = append(values, v)
+			}
+		}
+		out = append(out, Row{TS: row.TS, Values: values})
+	}
+	return out
+}
+
+// findCoveringRow find row with given ts or last row before ts that is
+// closer than step
+func findCoveringRow(rows Rows, ts, step int64) (Row, bool) {
+	idx := sort.Search(len(rows), func(i int) bool { return rows[i].TS > ts }) - 1
+	if idx < 0 {
+		return Row{}, false
+	}
+	if rows[idx].TS == ts || ts-rows[idx].TS < step {
+		return rows[idx], true
+	}
+	return Row{}, false
+}
+
+// minRowsInterval return minimal interval between rows; 0 for less than 2 rows
+func minRowsInterval(rows Rows) (step int64) {
+	for i := 1; i < len(rows); i++ {
+		if d := rows[i].TS - rows[i-1].TS; d > 0 && (step == 0 || d < step) {
+			step = d
+		}
+	}
+	return
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// DownsampleMethod define algorithm used for reducing number of rows
+type DownsampleMethod int
+
+const (
+	// DownsampleAverage consolidate values in equal time intervals (AverageToNumber)
+	DownsampleAverage DownsampleMethod = iota
+	// DownsampleLTTB select rows with Largest-Triangle-Three-Buckets algorithm
+	DownsampleLTTB
+	// DownsampleMinMax keep rows with minimal and maximal values in each bucket
+	DownsampleMinMax
+)
+
+func (d DownsampleMethod) String() string {
+	switch d {
+	case DownsampleAverage:
+		return "average"
+	case DownsampleLTTB:
+		return "lttb"
+	case DownsampleMinMax:
+		return "minmax"
+	}
+	return "unknown downsample method"
+}
+
+// ParseDownsampleMethod return downsample method by name
+func ParseDownsampleMethod(name string) (DownsampleMethod, bool) {
+	switch strings.ToLower(name) {
+	case "", "average", "avg":
+		return DownsampleAverage, true
+	case "lttb":
+		return DownsampleLTTB, true
+	case "minmax", "min-max", "envelope":
+		return DownsampleMinMax, true
+	}
+	return DownsampleAverage, false
+}
+
+// Downsample reduce rows to no more than maxRows using given method.
+// LTTB and MinMax return original rows; Average consolidate values by
+// columns functions.
+func Downsample(rows Rows, maxRows int, method DownsampleMethod, columns []RRDColumn) Rows {
+	LogDebug("Downsample rows=%d, maxRows=%d, method=%s", len(rows), maxRows, method)
+	switch method {
+	case DownsampleLTTB:
+		return downsampleLTTB(rows, maxRows)
+	case DownsampleMinMax:
+		return downsampleMinMax(rows, maxRows)
+	}
+	return AverageToNumber(rows, maxRows, columns)
+}
+
+// downsampleLTTB select rows using Largest-Triangle-Three-Buckets algorithm.
+// For many columns triangles areas are summed; values are normalized by
+// columns ranges so each column has this same weight.
+func downsampleLTTB(rows Rows, maxRows int) Rows {
+	if maxRows < 3 || len(rows) <= maxRows {
+		return rows
+	}
+
+	scale := columnsScale(rows)
+	out := make(Rows, 0, maxRows)
+	out = append(out, rows[0])
+
+	every := float64(len(rows)-2) / float64(maxRows-2)
+	a := 0
+	for i := 0; i < maxRows-2; i++ {
+		// average point in next bucket
+		avgStart := int(float64(i+1)*every) + 1
+		avgEnd := int(float64(i+2)*every) + 1
+		if avgEnd > len(rows) {
+			avgEnd = len(rows)
+		}
+		avgTS, avgValues, avgValid := averagePoint(rows[avgStart:avgEnd])
+
+		rangeStart := int(float64(i)*every) + 1
+		rangeEnd := int(float64(i+1)*every) + 1
+
+		maxArea := -1.0
+		next := rangeStart
+		pa := rows[a]
+		for idx := rangeStart; idx < rangeEnd; idx++ {
+			pb := rows[idx]
+			area := 0.0
+			for c, vb := range pb.Values {
+				va := pa.Values[c]
+				if !va.Valid || !vb.Valid || !avgValid[c] {
+					continue
+				}
+				ay, by, cy := float64(va.Value)*scale[c], float64(vb.Value)*scale[c], avgValues[c]*scale[c]
+				area += math.Abs((float64(pa.TS)-avgTS)*(by-ay)-(float64(pa.TS)-float64(pb.TS))*(cy-ay)) / 2
+			}
+			if area > maxArea {
+				maxArea = area
+				next = idx
+			}
+		}
+		out = append(out, rows[next])
+		a = next
+	}
+
+	return append(out, rows[len(rows)-1])
+}
+
+// downsampleMinMax split rows into buckets and keep rows with minimal and
+// maximal value of each column in bucket. When there is too many columns to
+// keep pair of rows for each of them, only rows with minimal and maximal value
+// from all columns are kept.
+func downsampleMinMax(rows Rows, maxRows int) Rows {
+	if maxRows < 2 || len(rows) <= maxRows {
+		return rows
+	}
+
+	cols := len(rows[0].Values)
+	if cols == 0 {
+		return rows
+	}
+	buckets := maxRows / (2 * cols)
+	combined := buckets < 1
+	if combined {
+		buckets = 1
+	}
+	size := float64(len(rows)) / float64(buckets)
+
+	var out Rows
+	for b := 0; b < buckets; b++ {
+		start, end := int(float64(b)*size), int(float64(b+1)*size)
+		if b == buckets-1 {
+			end = len(rows)
+		}
+		selected := make(map[int]bool)
+		minIdx, maxIdx := -1, -1
+		var minV, maxV float32
+		for c := 0; c < cols; c++ {
+			if !combined {
+				minIdx, maxIdx = -1, -1
+			}
+			for idx := start; idx < end; idx++ {
+				v := rows[idx].Values[c]
+				if !v.Valid {
+					continue
+				}
+				if minIdx < 0 || v.Value < minV {
+					minIdx, minV = idx, v.Value
+				}
+				if maxIdx < 0 || v.Value > maxV {
+					maxIdx, maxV = idx, v.Value
+				}
+			}
+			if minIdx >= 0 {
+				selected[minIdx] = true
+				selected[maxIdx] = true
+			}
+		}
+		for idx := start; idx < end; idx++ {
+			if selected[idx] {
+				out = append(out, rows[idx])
+			}
+		}
+	}
+	return out
+}
+
+// averagePoint return average ts and values of rows
+func averagePoint(rows Rows) (ts float64, values []float64, valid []bool) {
+	cols := len(rows[0].Values)
+	values = make([]float64, cols)
+	valid = make([]bool, cols)
+	counts := make([]int, cols)
+	for _, row := range rows {
+		ts += float64(row.TS)
+		for c, v := range row.Values {
+			if v.Valid {
+				values[c] += float64(v.Value)
+				counts[c]++
+			}
+		}
+	}
+	ts /= float64(len(rows))
+	for c := range values {
+		if counts[c] > 0 {
+			values[c] /= float64(counts[c])
+			valid[c] = true
+		}
+	}
+	return
+}
+
+// columnsScale return 1/range for each column
+func columnsScale(rows Rows) []float64 {
+	cols := len(rows[0].Values)
+	minV := make([]float64, cols)
+	maxV := make([]float64, cols)
+	found := make([]bool, cols)
+	for _, row := range rows {
+		for c, v := range row.Values {
+			val := float64(v.Value)
+			if !v.Valid {
+				continue
+			}
+			if !found[c] || val < minV[c] {
+				minV[c] = val
+			}
+			if !found[c] || val > maxV[c] {
+				maxV[c] = val
+			}
+			found[c] = true
+		}
+	}
+	scale := make([]float64, cols)
+	for c := range scale {
+		scale[c] = 1
+		if d := maxV[c] - minV[c]; d > 0 {
+			scale[c] = 1 / d
+		}
+	}
+	return scale
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+Dump file format (json):
+{
+	"Version": 2,
+	"Columns": [...],
+	"Archives": [...],
+	"Forecasts": [...],
+	"Data": [
+		{"ArchiveID": 0, "Rows": [
+			{"TS": ..., "Values": [...]},
+			...
+		]},
+		...
+	],
+	"ForecastsData": [
+		{"ForecastID": 0, "State": {...}, "Rows": [
+			{"TS": ..., "Values": [...]},
+			...
+		]},
+		...
+	]
+}
+
+Columns, Archives and optional Forecasts must precede Data; ArchiveID must
+precede Rows. Optional ForecastsData keep forecasts model state and
+predictions; it must follow Data.
+Dump and load process data row by row, so whole file is never kept in memory.
+
+Version 1 (no "Version" key) contains only valid values; version 2 keeps
+all values with "Valid" flag.
+*/
+
+const dumpVersion = 2
+
+type (
+	// RRDDump is structure dumped to json-file
+	RRDDump struct {
+		Version  int
+		Columns  []RRDColumn
+		Archives []RRDArchive
+		// Forecasts definitions (optional)
+		Forecasts []RRDForecast `json:",omitempty"`
+		Data      []RRDArchiveData
+	}
+	// RRDForecastData keep forecast state and predictions in dump file
+	RRDForecastData struct {
+		ForecastID int
+		State      *ForecastState
+		Rows       []ForecastRow
+	}
+	// RRDArchiveData keep data in dump file for each archive
+	RRDArchiveData struct {
+		ArchiveID int
+		Rows      []RRDDumpRow
+	}
+	// RRDDumpRow is one row in dump file
+	RRDDumpRow struct {
+		TS     int64
+		Values []RRDDumpValue
+	}
+	// RRDDumpValue is one value in dump file
+	RRDDumpValue struct {
+		Value   float32
+		Counter int64
+		Column  int
+		// version 2
+		Valid bool
+	}
+)
+
+// Dump content of rrd file into json-encoded file.
+// Filename "-" means stdout; when compress is set or filename ends with ".gz"
+// output is compressed.
+func (r *RRD) Dump(filename string, compress bool) error {
+	LogDebug("RRD.Dump filename=%s compress=%v", filename, compress)
+
+	var w io.Writer = os.Stdout
+	if filename != "-" {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if compress || strings.HasSuffix(filename, ".gz") {
+		gw := gzip.NewWriter(w)
+		if err := r.DumpTo(gw); err != nil {
+			gw.Close()
+			return err
+		}
+		return gw.Close()
+	}
+
+	return r.DumpTo(w)
+}
+
+// DumpTo write json-encoded content of rrd file into w row by row
+func (r *RRD) DumpTo(w io.Writer) error {
+	LogDebug("RRD.DumpTo")
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+
+	if err := writeDumpHeader(bw, r.columns, r.archives, r.forecasts); err != nil {
+		return err
+	}
+
+	for aID := range r.archives {
+		if aID > 0 {
+			bw.WriteString(",\n")
+		}
+		fmt.Fprintf(bw, "    {\n      \"ArchiveID\": %d,\n      \"Rows\": [", aID)
+		iter, err := r.storage.Iterate(aID, 0, -1, r.allColumnsIDs())
+		if err != nil {
+			return err
+		}
+		first := true
+		for {
+			if err := iter.Next(); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+			row := RRDDumpRow{TS: iter.TS()}
+			values, err := iter.Values()
+			if err != nil {
+				return err
+			}
+			for _, value := range values {
+				row.Values = append(row.Values, RRDDumpValue{
+					Value:   value.Value,
+					Counter: value.Counter,
+					Column:  value.Column,
+					Valid:   value.Valid,
+				})
+			}
+			enc, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			if !first {
+				bw.WriteString(",")
+			}
+			first = false
+			bw.WriteString("\n        ")
+			bw.Write(enc)
+		}
+		bw.WriteString("\n      ]\n    }")
+	}
+	bw.WriteString("\n  ]")
+
+	if len(r.forecasts) > 0 {
+		bw.WriteString(",\n  \"ForecastsData\": [")
+		for fID := range r.forecasts {
+			if fID > 0 {
+				bw.WriteString(",")
+			}
+			if err := r.dumpForecast(bw, fID); err != nil {
+				return err
+			}
+		}
+		bw.WriteString("\n  ]")
+	}
+	bw.WriteString("\n}\n")
+
+	return bw.Flush()
+}
+
+// dumpForecast write state and predictions of forecast
+func (r *RRD) dumpForecast(w *bufio.Writer, fID int) error {
+	f := r.forecasts[fID]
+	state, err := r.storage.LoadForecastState(fID)
+	if err != nil {
+		return err
+	}
+	enc, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n    {\n      \"ForecastID\": %d,\n      \"State\": ", fID)
+	w.Write(enc)
+	w.WriteString(",\n      \"Rows\": [")
+	first := true
+	for ts := state.LastTS - int64(f.Rows-1)*f.Step; ts <= state.LastTS; ts += f.Step {
+		if ts < 1 {
+			continue
+		}
+		values, err := r.storage.GetForecast(fID, ts, r.allColumnsIDs())
+		if err != nil {
+			return err
+		}
+		if values == nil {
+			continue
+		}
+		enc, err := json.Marshal(ForecastRow{TS: ts, Values: values})
+		if err != nil {
+			return err
+		}
+		if !first {
+			w.WriteString(",")
+		}
+		first = false
+		w.WriteString("\n        ")
+		w.Write(enc)
+	}
+	w.WriteString("\n      ]\n    }")
+	return nil
+}
+
+func writeDumpHeader(w *bufio.Writer, columns []RRDColumn, archives []RRDArchive, forecasts []RRDForecast) error {
+	cols, err := json.Marshal(columns)
+	if err != nil {
+		return err
+	}
+	archs, err := json.Marshal(archives)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "{\n  \"Version\": %d,\n  \"Columns\": ", dumpVersion)
+	w.Write(cols)
+	w.WriteString(",\n  \"Archives\": ")
+	w.Write(archs)
+	if len(forecasts) > 0 {
+		fcs, err := json.Marshal(forecasts)
+		if err != nil {
+			return err
+		}
+		w.WriteString(",\n  \"Forecasts\": ")
+		w.Write(fcs)
+	}
+	_, err = w.WriteString(",\n  \"Data\": [\n")
+	return err
+}
+
+// LoadDumpRRD load json-encoded file into new rrd file.
+// Input "-" means stdin; gzip-compressed input is detected automatically.
+// When validate is true values out of columns min-max range are loaded as invalid.
+func LoadDumpRRD(input, rrdFilename string, validate bool) (*RRD, error) {
+	LogDebug("LoadDumpRRD input=%s filename=%s validate=%v", input, rrdFilename, validate)
+
+	var inp io.Reader = os.Stdin
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		inp = f
+	}
+
+	return LoadDump(inp, rrdFilename, validate)
+}
+
+// LoadDump read json-encoded dump row by row and write it into new rrd file
+func LoadDump(input io.Reader, rrdFilename string, validate bool) (*RRD, error) {
+	LogDebug("LoadDump filename=%s", rrdFilename)
+
+	br := bufio.NewReader(input)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		LogDebug("LoadDump gzip input")
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		input = gr
+	} else {
+		input = br
+	}
+
+	dec := json.NewDecoder(input)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	var dump RRDDump
+	var r *RRD
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return closeOnError(r, err)
+		}
+		switch key {
+		case "Version":
+			if err = dec.Decode(&dump.Version); err == nil && dump.Version > dumpVersion {
+				err = fmt.Errorf("unsupported dump version %d", dump.Version)
+			}
+		case "Columns":
+			err = dec.Decode(&dump.Columns)
+		case "Archives":
+			err = dec.Decode(&dump.Archives)
+		case "Forecasts":
+			err = dec.Decode(&dump.Forecasts)
+		case "Data":
+			if r != nil {
+				return closeOnError(r, fmt.Errorf("duplicated Data section"))
+			}
+			if len(dump.Columns) == 0 || len(dump.Archives) == 0 {
+				return nil, fmt.Errorf("missing Columns or Archives before Data")
+			}
+			if r, err = NewRRD(rrdFilename, dump.Columns, dump.Archives, dump.Forecasts...); err != nil {
+				return closeOnError(r, err)
+			}
+			err = loadDumpData(dec, r, dump.Version, validate)
+		case "ForecastsData":
+			if r == nil {
+				return nil, fmt.Errorf("missing Data before ForecastsData")
+			}
+			err = loadDumpForecasts(dec, r)
+		default:
+			LogDebug("LoadDump skipping unknown key %v", key)
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return closeOnError(r, err)
+		}
+	}
+
+	if r == nil {
+		return nil, fmt.Errorf("missing Data section")
+	}
+	return r, expectDelim(dec, '}')
+}
+
+func loadDumpData(dec *json.Decoder, r *RRD, version int, validate bool) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		if err := expectDelim(dec, '{'); err != nil {
+			return err
+		}
+		archiveID := -1
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			switch key {
+			case "ArchiveID":
+				err = dec.Decode(&archiveID)
+				if err == nil && (archiveID < 0 || archiveID >= len(r.archives)) {
+					err = fmt.Errorf("invalid archive %d", archiveID)
+				}
+			case "Rows":
+				if archiveID < 0 {
+					return fmt.Errorf("missing ArchiveID before Rows")
+				}
+				err = loadDumpRows(dec, r, archiveID, version, validate)
+			default:
+				var skip json.RawMessage
+				err = dec.Decode(&skip)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func loadDumpRows(dec *json.Decoder, r *RRD, archiveID int, version int, validate bool) error {
+	LogDebug("loadDumpRows archive=%d, version=%d", archiveID, version)
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	invalidated := 0
+	for dec.More() {
+		var row RRDDumpRow
+		if err := dec.Decode(&row); err != nil {
+			return err
+		}
+		var values []Value
+		for _, dv := range row.Values {
+			if dv.Column < 0 || dv.Column >= len(r.columns) {
+				return fmt.Errorf("invalid column %d in archive %d, row %d", dv.Column, archiveID, row.TS)
+			}
+			v := Value{
+				TS:        row.TS,
+				Value:     dv.Value,
+				Counter:   dv.Counter,
+				Column:    dv.Column,
+				ArchiveID: archiveID,
+				// version 1 dumps contain only valid values
+				Valid: dv.Valid || version < 2,
+			}
+			if validate && v.Valid && !r.columns[v.Column].InRange(v.Value) {
+				LogDebug("loadDumpRows value out of range: %v", v)
+				v.Valid = false
+				invalidated++
+			}
+			values = append(values, v)
+		}
+		if err := r.storage.Put(archiveID, row.TS, values...); err != nil {
+			return err
+		}
+	}
+	if invalidated > 0 {
+		Log("Archive %d: %d values out of range marked as invalid", archiveID, invalidated)
+	}
+	return expectDelim(dec, ']')
+}
+
+func loadDumpForecasts(dec *json.Decoder, r *RRD) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		var fd RRDForecastData
+		if err := dec.Decode(&fd); err != nil {
+			return err
+		}
+		LogDebug("loadDumpForecasts forecast=%d rows=%d", fd.ForecastID, len(fd.Rows))
+		if fd.ForecastID < 0 || fd.ForecastID >= len(r.forecasts) {
+			return fmt.Errorf("invalid forecast %d", fd.ForecastID)
+		}
+		f := r.forecasts[fd.ForecastID]
+		if fd.State != nil {
+			if len(fd.State.Columns) != len(r.columns) {
+				return fmt.Errorf("invalid state of forecast %d", fd.ForecastID)
+			}
+			for _, cs := range fd.State.Columns {
+				if len(cs.Seasonal) != int(f.Season) || len(cs.Deviation) != int(f.Season) {
+					return fmt.Errorf("invalid state of forecast %d", fd.ForecastID)
+				}
+			}
+			if err := r.storage.SaveForecastState(fd.ForecastID, fd.State); err != nil {
+				return err
+			}
+		}
+		for _, row := range fd.Rows {
+			for _, v := range row.Values {
+				if v.Column < 0 || v.Column >= len(r.columns) {
+					return fmt.Errorf("invalid column %d in forecast %d, row %d", v.Column, fd.ForecastID, row.TS)
+				}
+			}
+			if err := r.storage.PutForecast(fd.ForecastID, row.TS, row.Values...); err != nil {
+				return err
+			}
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("invalid dump file; expected '%v', found '%v'", delim, t)
+	}
+	return nil
+}
+
+func closeOnError(r *RRD, err error) (*RRD, error) {
+	if r != nil {
+		r.Close()
+	}
+	return nil, err
+}
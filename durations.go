@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// durationUnit is one unit accepted in durations
+type durationUnit struct {
+	name    string
+	seconds int64
+}
+
+// durationUnits are ordered from the largest
+var durationUnits = []durationUnit{
+	{"y", 365 * 24 * 60 * 60},
+	{"w", 7 * 24 * 60 * 60},
+	{"d", 24 * 60 * 60},
+	{"h", 60 * 60},
+	{"m", 60},
+	{"s", 1},
+}
+
+// ParseDuration parse duration in form number+unit (i.e. 5m, 2d, 1y) or
+// sequence of them (1h30m) and return number of seconds.
+// Accepted units: s, m, h, d (days), w (weeks), y (365 days); number without
+// unit means seconds. Duration may be prefixed by '-' or '+'.
+func ParseDuration(inp string) (int64, error) {
+	s := strings.TrimSpace(inp)
+	sign := int64(1)
+	if strings.HasPrefix(s, "-") {
+		sign = -1
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	if s == "" {
+		return 0, fmt.Errorf("invalid duration '%s'", inp)
+	}
+
+	var result float64
+	for s != "" {
+		numEnd := strings.IndexFunc(s, func(r rune) bool {
+			return (r < '0' || r > '9') && r != '.'
+		})
+		if numEnd == 0 {
+			return 0, fmt.Errorf("invalid duration '%s'", inp)
+		}
+		if numEnd < 0 {
+			numEnd = len(s)
+		}
+		num, err := strconv.ParseFloat(s[:numEnd], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration '%s'", inp)
+		}
+		s = s[numEnd:]
+
+		unitEnd := strings.IndexFunc(s, func(r rune) bool {
+			return (r >= '0' && r <= '9') || r == '.'
+		})
+		if unitEnd < 0 {
+			unitEnd = len(s)
+		}
+		unit := s[:unitEnd]
+		s = s[unitEnd:]
+
+		mult, ok := durationUnitSeconds(unit)
+		if !ok {
+			return 0, fmt.Errorf("invalid duration '%s' - unknown unit '%s'", inp, unit)
+		}
+		result += num * float64(mult)
+	}
+	return sign * int64(result), nil
+}
+
+func durationUnitSeconds(unit string) (int64, bool) {
+	if unit == "" {
+		return 1, true
+	}
+	for _, u := range durationUnits {
+		if u.name == unit {
+			return u.seconds, true
+		}
+	}
+	return 0, false
+}
+
+// FormatDuration format seconds as duration accepted by ParseDuration.
+// Weeks and years are used only when value is divisible by them.
+func FormatDuration(seconds int64) string {
+	if seconds == 0 {
+		return "0s"
+	}
+	var res string
+	if seconds < 0 {
+		res = "-"
+		seconds = -seconds
+	}
+	for _, u := range durationUnits {
+		if (u.name == "y" || u.name == "w") && seconds%u.seconds != 0 {
+			continue
+		}
+		if n := seconds / u.seconds; n > 0 {
+			res += strconv.FormatInt(n, 10) + u.name
+			seconds -= n * u.seconds
+		}
+	}
+	return res
+}
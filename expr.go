@@ -0,0 +1,483 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+Expressions define computed columns. Grammar (infix):
+
+	expr    = term { ("+" | "-") term }
+	term    = unary { ("*" | "/" | "%") unary }
+	unary   = [ "-" ] primary
+	primary = number | column | function "(" expr { "," expr } ")" | "(" expr ")"
+	column  = name | $index | "quoted name"
+
+Functions:
+	abs(x), min(x, y, ...), max(x, y, ...)
+	default(x, v) - v when x is invalid
+	cumsum(x)     - running sum of valid values
+	delta(x)      - difference to previous valid value
+	rate(x)       - delta(x) per second
+
+Result is invalid when any argument is invalid (except default) or on
+division by zero.
+*/
+
+type (
+	// Expr is parsed expression for computed column
+	Expr struct {
+		Name   string
+		Source string
+
+		root    exprNode
+		columns []int
+	}
+
+	exprNode interface {
+		eval(ctx *exprContext) (float64, bool)
+		reset()
+	}
+
+	exprContext struct {
+		row    Row
+		colPos map[int]int
+	}
+
+	exprConst float64
+
+	exprColumn int
+
+	exprUnary struct {
+		arg exprNode
+	}
+
+	exprBinary struct {
+		op          byte
+		left, right exprNode
+	}
+
+	exprFunc struct {
+		name string
+		args []exprNode
+
+		// state for running functions
+		hasPrev bool
+		prev    float64
+		prevTS  int64
+		sum     float64
+	}
+
+	exprParser struct {
+		inp    string
+		pos    int
+		rrd    *RRD
+		cols   map[int]bool
+		colIDs []int
+	}
+)
+
+var exprFuncsArgs = map[string][2]int{
+	// name: min, max number of arguments (-1 = no limit)
+	"abs":     {1, 1},
+	"min":     {1, -1},
+	"max":     {1, -1},
+	"default": {2, 2},
+	"cumsum":  {1, 1},
+	"delta":   {1, 1},
+	"rate":    {1, 1},
+}
+
+// ParseExprDef parse expression definition in form name=expression
+func ParseExprDef(def string, r *RRD) (*Expr, error) {
+	idx := strings.Index(def, "=")
+	if idx < 1 {
+		return nil, fmt.Errorf("invalid expression definition '%s'; expected name=expression", def)
+	}
+	return ParseExpr(strings.TrimSpace(def[:idx]), def[idx+1:], r)
+}
+
+// ParseExpr parse expression; columns are resolved in rrd r
+func ParseExpr(name, inp string, r *RRD) (*Expr, error) {
+	LogDebug("ParseExpr name=%s, inp=%s", name, inp)
+	p := &exprParser{inp: inp, rrd: r, cols: make(map[int]bool)}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.inp) {
+		return nil, p.errorf("unexpected '%s'", p.inp[p.pos:])
+	}
+	if name == "" {
+		name = strings.TrimSpace(inp)
+	}
+	return &Expr{
+		Name:    name,
+		Source:  inp,
+		root:    root,
+		columns: p.colIDs,
+	}, nil
+}
+
+// Columns return columns used in expression
+func (e *Expr) Columns() []int {
+	return e.columns
+}
+
+// ExprsColumns return columns required to load for columns and expressions
+func ExprsColumns(columns []int, exprs []*Expr) []int {
+	res := append([]int(nil), columns...)
+	used := make(map[int]bool)
+	for _, c := range columns {
+		used[c] = true
+	}
+	for _, e := range exprs {
+		for _, c := range e.columns {
+			if !used[c] {
+				used[c] = true
+				res = append(res, c)
+			}
+		}
+	}
+	return res
+}
+
+// ApplyExprs compute expressions for rows loaded for loadedCols columns.
+// Result rows contain values for first numCols columns followed by values of
+// expressions; expressions values have Column = number of rrd columns + expression index.
+func ApplyExprs(rows Rows, loadedCols []int, numCols int, exprs []*Expr, rrdCols int) (out Rows) {
+	LogDebug("ApplyExprs rows=%d, loadedCols=%v, numCols=%d, exprs=%d", len(rows), loadedCols, numCols, len(exprs))
+
+	ctx := &exprContext{colPos: make(map[int]int)}
+	for pos, c := range loadedCols {
+		ctx.colPos[c] = pos
+	}
+	for _, e := range exprs {
+		e.root.reset()
+	}
+
+	for _, row := range rows {
+		ctx.row = row
+		outRow := Row{TS: row.TS, Values: make([]Value, 0, numCols+len(exprs))}
+		outRow.Values = append(outRow.Values, row.Values[:numCols]...)
+		for idx, e := range exprs {
+			res, ok := e.root.eval(ctx)
+			ok = ok && !math.IsNaN(res) && !math.IsInf(res, 0)
+			v := Value{
+				TS:     row.TS,
+				Column: rrdCols + idx,
+				Valid:  ok,
+			}
+			if ok {
+				v.Value = float32(res)
+				v.Counter = 1
+			}
+			outRow.Values = append(outRow.Values, v)
+		}
+		out = append(out, outRow)
+	}
+	return
+}
+
+func (c exprConst) eval(ctx *exprContext) (float64, bool) {
+	return float64(c), true
+}
+
+func (c exprConst) reset() {}
+
+func (c exprColumn) eval(ctx *exprContext) (float64, bool) {
+	pos, ok := ctx.colPos[int(c)]
+	if !ok || pos >= len(ctx.row.Values) {
+		return 0, false
+	}
+	v := ctx.row.Values[pos]
+	return float64(v.Value), v.Valid
+}
+
+func (c exprColumn) reset() {}
+
+func (u *exprUnary) eval(ctx *exprContext) (float64, bool) {
+	v, ok := u.arg.eval(ctx)
+	return -v, ok
+}
+
+func (u *exprUnary) reset() {
+	u.arg.reset()
+}
+
+func (b *exprBinary) eval(ctx *exprContext) (float64, bool) {
+	l, lok := b.left.eval(ctx)
+	r, rok := b.right.eval(ctx)
+	if !lok || !rok {
+		return 0, false
+	}
+	switch b.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	case '/':
+		if r == 0 {
+			return 0, false
+		}
+		return l / r, true
+	case '%':
+		if r == 0 {
+			return 0, false
+		}
+		return math.Mod(l, r), true
+	}
+	return 0, false
+}
+
+func (b *exprBinary) reset() {
+	b.left.reset()
+	b.right.reset()
+}
+
+func (f *exprFunc) eval(ctx *exprContext) (float64, bool) {
+	args := make([]float64, len(f.args))
+	valid := make([]bool, len(f.args))
+	allValid := true
+	for i, a := range f.args {
+		args[i], valid[i] = a.eval(ctx)
+		allValid = allValid && valid[i]
+	}
+
+	switch f.name {
+	case "default":
+		if valid[0] {
+			return args[0], true
+		}
+		return args[1], valid[1]
+	case "cumsum":
+		if valid[0] {
+			f.sum += args[0]
+		}
+		return f.sum, true
+	}
+
+	if !allValid {
+		return 0, false
+	}
+
+	switch f.name {
+	case "abs":
+		return math.Abs(args[0]), true
+	case "min":
+		res := args[0]
+		for _, a := range args[1:] {
+			res = math.Min(res, a)
+		}
+		return res, true
+	case "max":
+		res := args[0]
+		for _, a := range args[1:] {
+			res = math.Max(res, a)
+		}
+		return res, true
+	case "delta", "rate":
+		prev, prevTS, hasPrev := f.prev, f.prevTS, f.hasPrev
+		f.prev, f.prevTS, f.hasPrev = args[0], ctx.row.TS, true
+		if !hasPrev {
+			return 0, false
+		}
+		if f.name == "delta" {
+			return args[0] - prev, true
+		}
+		if ctx.row.TS == prevTS {
+			return 0, false
+		}
+		return (args[0] - prev) / float64(ctx.row.TS-prevTS), true
+	}
+	return 0, false
+}
+
+func (f *exprFunc) reset() {
+	f.hasPrev = false
+	f.prev = 0
+	f.prevTS = 0
+	f.sum = 0
+	for _, a := range f.args {
+		a.reset()
+	}
+}
+
+func (p *exprParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("expression '%s' error at %d: %s", p.inp, p.pos+1, fmt.Sprintf(format, a...))
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.inp) && unicode.IsSpace(rune(p.inp[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek return next non-space character or 0 on end of input
+func (p *exprParser) peek() byte {
+	p.skipSpaces()
+	if p.pos < len(p.inp) {
+		return p.inp[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) parseExpr() (exprNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseTerm() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		arg, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{arg: arg}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	ch := p.peek()
+	switch {
+	case ch == 0:
+		return nil, p.errorf("unexpected end of expression")
+	case ch == '(':
+		p.pos++
+		node, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("missing ')'")
+		}
+		p.pos++
+		return node, nil
+	case ch >= '0' && ch <= '9' || ch == '.':
+		start := p.pos
+		for p.pos < len(p.inp) && (p.inp[p.pos] >= '0' && p.inp[p.pos] <= '9' || p.inp[p.pos] == '.') {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.inp[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("invalid number '%s'", p.inp[start:p.pos])
+		}
+		return exprConst(v), nil
+	case ch == '"' || ch == '\'':
+		p.pos++
+		end := strings.IndexByte(p.inp[p.pos:], ch)
+		if end < 0 {
+			return nil, p.errorf("unterminated column name")
+		}
+		name := p.inp[p.pos : p.pos+end]
+		p.pos += end + 1
+		return p.column(name)
+	case ch == '$':
+		p.pos++
+		start := p.pos
+		for p.pos < len(p.inp) && p.inp[p.pos] >= '0' && p.inp[p.pos] <= '9' {
+			p.pos++
+		}
+		return p.column(p.inp[start:p.pos])
+	case isIdentChar(ch):
+		start := p.pos
+		for p.pos < len(p.inp) && isIdentChar(p.inp[p.pos]) {
+			p.pos++
+		}
+		name := p.inp[start:p.pos]
+		if p.peek() == '(' {
+			return p.parseFunc(name)
+		}
+		return p.column(name)
+	}
+	return nil, p.errorf("unexpected '%c'", ch)
+}
+
+func (p *exprParser) parseFunc(name string) (exprNode, error) {
+	fname := strings.ToLower(name)
+	nargs, ok := exprFuncsArgs[fname]
+	if !ok {
+		return nil, p.errorf("unknown function '%s'", name)
+	}
+	p.pos++ // (
+	f := &exprFunc{name: fname}
+	if p.peek() != ')' {
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			f.args = append(f.args, arg)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+	}
+	if p.peek() != ')' {
+		return nil, p.errorf("missing ')'")
+	}
+	p.pos++
+	if len(f.args) < nargs[0] || (nargs[1] >= 0 && len(f.args) > nargs[1]) {
+		return nil, p.errorf("wrong number of arguments for %s", fname)
+	}
+	return f, nil
+}
+
+func (p *exprParser) column(name string) (exprNode, error) {
+	col, err := p.rrd.ParseColumnName(name)
+	if err != nil {
+		return nil, p.errorf("%s", err.Error())
+	}
+	if !p.cols[col] {
+		p.cols[col] = true
+		p.colIDs = append(p.colIDs, col)
+	}
+	return exprColumn(col), nil
+}
+
+func isIdentChar(ch byte) bool {
+	return ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9'
+}
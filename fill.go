@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FillPolicy define how missing values are filled in range query results
+type FillPolicy int
+
+const (
+	// FillNone keep missing values invalid
+	FillNone FillPolicy = iota
+	// FillPrevious use last valid value
+	FillPrevious
+	// FillLinear interpolate between surrounding valid values
+	FillLinear
+	// FillZero put 0
+	FillZero
+	// FillConstant put RangeOptions.FillValue
+	FillConstant
+)
+
+func (f FillPolicy) String() string {
+	switch f {
+	case FillNone:
+		return "none"
+	case FillPrevious:
+		return "previous"
+	case FillLinear:
+		return "linear"
+	case FillZero:
+		return "zero"
+	case FillConstant:
+		return "constant"
+	}
+	return "unknown fill policy"
+}
+
+// ParseFillPolicy return fill policy by name
+func ParseFillPolicy(name string) (FillPolicy, bool) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return FillNone, true
+	case "previous", "prev", "last":
+		return FillPrevious, true
+	case "linear", "interpolate":
+		return FillLinear, true
+	case "zero", "0":
+		return FillZero, true
+	case "constant", "const", "value":
+		return FillConstant, true
+	}
+	return FillNone, false
+}
+
+// ParseFill parse fill definition: policy name or number (constant fill)
+func ParseFill(inp string) (policy FillPolicy, value float32, err error) {
+	if p, ok := ParseFillPolicy(inp); ok {
+		return p, 0, nil
+	}
+	v, err := strconv.ParseFloat(inp, 32)
+	if err != nil {
+		return FillNone, 0, fmt.Errorf("invalid fill policy '%s'", inp)
+	}
+	return FillConstant, float32(v), nil
+}
+
+// fillGaps fill invalid values in rows according to options.
+// Rows must be continuous (one row per step). Gap is sequence of invalid values
+// in column with valid values on both sides, so values before first and after
+// last stored value are never filled; gaps longer than opts.MaxGap (when > 0)
+// are not filled. Filled values are valid and have Counter = 0.
+func fillGaps(rows Rows, step int64, opts RangeOptions) Rows {
+	LogDebug("fillGaps rows=%d, step=%d, fill=%s, maxGap=%d", len(rows), step, opts.Fill, opts.MaxGap)
+
+	if opts.Fill == FillNone || len(rows) == 0 {
+		return rows
+	}
+
+	for cIdx := range rows[0].Values {
+		for start := 0; start < len(rows); start++ {
+			if rows[start].Values[cIdx].Valid {
+				continue
+			}
+			end := start
+			for end+1 < len(rows) && !rows[end+1].Values[cIdx].Valid {
+				end++
+			}
+			if start == 0 || end == len(rows)-1 {
+				// leading or trailing padding
+				start = end
+				continue
+			}
+			if opts.MaxGap <= 0 || rows[end].TS-rows[start].TS+step <= opts.MaxGap {
+				fillGap(rows, cIdx, start, end, opts)
+			}
+			start = end
+		}
+	}
+	return rows
+}
+
+// fillGap fill values in column cIdx in rows[start..end]; rows[start-1] and
+// rows[end+1] must exist
+func fillGap(rows Rows, cIdx, start, end int, opts RangeOptions) {
+	prev, next := &rows[start-1].Values[cIdx], &rows[end+1].Values[cIdx]
+
+	for i := start; i <= end; i++ {
+		v := &rows[i].Values[cIdx]
+		switch opts.Fill {
+		case FillPrevious:
+			v.Value = prev.Value
+		case FillLinear:
+			pTS, nTS := rows[start-1].TS, rows[end+1].TS
+			v.Value = prev.Value + (next.Value-prev.Value)*float32(rows[i].TS-pTS)/float32(nTS-pTS)
+		case FillZero:
+			v.Value = 0
+		case FillConstant:
+			v.Value = opts.FillValue
+		}
+		v.TS = rows[i].TS
+		v.Valid = true
+		v.Counter = 0
+	}
+}
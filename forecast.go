@@ -0,0 +1,497 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Forecasts implement Holt-Winters (triple exponential smoothing) prediction
+with aberrant behaviour detection, like HWPREDICT/FAILURES RRA in RRDtool.
+
+Each forecast has own step and keeps for every column:
+  - model state: level, trend and seasonal coefficients and deviations
+    (Season values),
+  - ring of Rows rows with predicted value, deviation, observed value and
+    violation/failure flags.
+
+Model is updated in PutValues when value for next step arrive (using last
+observed value in previous step). First season initialize seasonal
+coefficients, second one deviations; predictions are available after that.
+Value is violation when is outside of confidence band
+predicted +/- Delta * deviation; failure is reported when at least
+Threshold of Window last values are violations.
+
+Forecasts state is not copied when columns are merged from other files.
+*/
+
+type (
+	// RRDForecast defines Holt-Winters forecast
+	RRDForecast struct {
+		Name string // byte[16]
+		Step int64
+		// Rows is number of predictions kept
+		Rows int32
+		// Season is season length in steps
+		Season int32
+		// Alpha, Beta and Gamma are smoothing factors for level, trend and
+		// seasonal coefficients
+		Alpha float32
+		Beta  float32
+		Gamma float32
+		// Delta is width of confidence band in deviations
+		Delta float32
+		// Threshold of violations in Window values mark failure
+		Window    int32
+		Threshold int32
+	}
+
+	// ForecastValue is prediction for one column in one step
+	ForecastValue struct {
+		TS          int64
+		Column      int
+		Predicted   float32
+		Deviation   float32
+		Observed    float32
+		Valid       bool
+		HasObserved bool
+		// Violation - observed value is out of confidence band
+		Violation bool
+		// Failure - too many violations in window
+		Failure bool
+
+		// Lower and Upper are confidence band bounds (not stored)
+		Lower float32
+		Upper float32
+	}
+
+	// ForecastColumnState is Holt-Winters model state for one column
+	ForecastColumnState struct {
+		Level   float64
+		Trend   float64
+		Updates int64
+		// TS of last step used to update model
+		TS        int64
+		Seasonal  []float32
+		Deviation []float32
+	}
+
+	// ForecastState is Holt-Winters model state for forecast
+	ForecastState struct {
+		// LastTS is current (not finished) step
+		LastTS  int64
+		Columns []ForecastColumnState
+	}
+
+	// ForecastRow keep forecast values for one step
+	ForecastRow struct {
+		TS     int64
+		Values []ForecastValue
+	}
+
+	// ForecastRange is result of GetForecastRange
+	ForecastRange struct {
+		Forecast RRDForecast
+		Rows     []ForecastRow
+	}
+)
+
+// DefaultForecast keep default forecast parameters (like in RRDtool)
+var DefaultForecast = RRDForecast{
+	Alpha:     0.1,
+	Beta:      0.0035,
+	Gamma:     0.1,
+	Delta:     2,
+	Window:    9,
+	Threshold: 7,
+}
+
+// check forecast definition; set default values for not defined parameters
+func (f *RRDForecast) check() error {
+	if f.Alpha == 0 {
+		f.Alpha = DefaultForecast.Alpha
+	}
+	if f.Beta == 0 {
+		f.Beta = DefaultForecast.Beta
+	}
+	if f.Gamma == 0 {
+		f.Gamma = DefaultForecast.Gamma
+	}
+	if f.Delta == 0 {
+		f.Delta = DefaultForecast.Delta
+	}
+	if f.Window == 0 {
+		f.Window = DefaultForecast.Window
+	}
+	if f.Threshold == 0 {
+		f.Threshold = DefaultForecast.Threshold
+	}
+	if len(f.Name) > 16 {
+		f.Name = f.Name[:16]
+	}
+
+	switch {
+	case f.Step < 1:
+		return fmt.Errorf("invalid step")
+	case f.Season < 2:
+		return fmt.Errorf("invalid season length")
+	case f.Rows < 1:
+		return fmt.Errorf("invalid rows number")
+	case f.Alpha < 0 || f.Alpha > 1, f.Beta < 0 || f.Beta > 1, f.Gamma < 0 || f.Gamma > 1:
+		return fmt.Errorf("smoothing factors should be in range (0, 1]")
+	case f.Delta < 0:
+		return fmt.Errorf("invalid delta")
+	case f.Window < 1 || f.Threshold < 1 || f.Threshold > f.Window:
+		return fmt.Errorf("invalid failure threshold or window")
+	}
+	return nil
+}
+
+// ParseForecastDef parse forecasts definitions in form
+// step:season:retention[:name], i.e. 5m:1d:1w:daily; season and retention
+// should be multiple of step.
+func ParseForecastDef(inp string) (forecasts []RRDForecast, err error) {
+	for idx, v := range strings.Split(inp, ",") {
+		fdef := strings.Split(v, ":")
+		if len(fdef) < 3 || len(fdef) > 4 {
+			return nil, fmt.Errorf("invalid forecast definition on index %d: '%s'", idx+1, v)
+		}
+		f := DefaultForecast
+		if len(fdef) == 4 {
+			f.Name = fdef[3]
+		} else {
+			f.Name = fmt.Sprintf("f%02d", idx+1)
+		}
+		if f.Step, err = ParseDuration(fdef[0]); err != nil || f.Step < 1 {
+			return nil, fmt.Errorf("invalid forecast definition on index %d: '%s' - invalid step", idx+1, v)
+		}
+		season, err := ParseDuration(fdef[1])
+		if err != nil || season < 2*f.Step || season%f.Step != 0 {
+			return nil, fmt.Errorf("invalid forecast definition on index %d: '%s' - invalid season", idx+1, v)
+		}
+		f.Season = int32(season / f.Step)
+		retention, err := ParseDuration(fdef[2])
+		if err != nil || retention < f.Step {
+			return nil, fmt.Errorf("invalid forecast definition on index %d: '%s' - invalid retention", idx+1, v)
+		}
+		f.Rows = int32((retention + f.Step - 1) / f.Step)
+		if err = f.check(); err != nil {
+			return nil, fmt.Errorf("invalid forecast definition on index %d: '%s' - %s", idx+1, v, err.Error())
+		}
+		forecasts = append(forecasts, f)
+	}
+	return
+}
+
+// ParseForecastName find forecast id by name or index
+func (r *RRD) ParseForecastName(name string) (int, error) {
+	name = strings.TrimSpace(name)
+	if idx, err := strconv.Atoi(name); err == nil && idx >= 0 {
+		if idx >= len(r.forecasts) {
+			return 0, fmt.Errorf("Forecast %d not found", idx)
+		}
+		return idx, nil
+	}
+	for idx, f := range r.forecasts {
+		if f.Name == name {
+			return idx, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown forecast %v", name)
+}
+
+func (f *RRDForecast) calcTS(ts int64) int64 {
+	if ts < 1 {
+		return ts
+	}
+	return int64(ts/f.Step) * f.Step
+}
+
+// slot return index of seasonal coefficient for ts
+func (f *RRDForecast) slot(ts int64) int {
+	return int((ts / f.Step) % int64(f.Season))
+}
+
+// learn update model state by observed value
+func (f *RRDForecast) learn(cs *ForecastColumnState, fv ForecastValue) {
+	y := float64(fv.Observed)
+	slot := f.slot(fv.TS)
+	season := int64(f.Season)
+	alpha, beta, gamma := float64(f.Alpha), float64(f.Beta), float64(f.Gamma)
+
+	switch {
+	case cs.Updates < season:
+		// first season - level is mean of values; seasonal coefficients
+		// are deviations from mean
+		cs.Level += (y - cs.Level) / float64(cs.Updates+1)
+		cs.Seasonal[slot] = float32(y)
+		if cs.Updates == season-1 {
+			for i := range cs.Seasonal {
+				cs.Seasonal[i] -= float32(cs.Level)
+			}
+		}
+	default:
+		k := float64(fv.TS-cs.TS) / float64(f.Step)
+		if k < 1 {
+			k = 1
+		}
+		c := float64(cs.Seasonal[slot])
+		predicted := cs.Level + k*cs.Trend + c
+		prevLevel := cs.Level
+		cs.Level = alpha*(y-c) + (1-alpha)*(cs.Level+k*cs.Trend)
+		cs.Trend = beta*(cs.Level-prevLevel)/k + (1-beta)*cs.Trend
+		cs.Seasonal[slot] = float32(gamma*(y-cs.Level) + (1-gamma)*c)
+		dev := math.Abs(y - predicted)
+		if cs.Updates < 2*season {
+			// second season - initial deviations
+			cs.Deviation[slot] = float32(dev)
+		} else {
+			cs.Deviation[slot] = float32(gamma*dev + (1-gamma)*float64(cs.Deviation[slot]))
+		}
+	}
+	cs.TS = fv.TS
+	cs.Updates++
+}
+
+// predict values for all columns for step ts
+func (f *RRDForecast) predict(state *ForecastState, ts int64) []ForecastValue {
+	values := make([]ForecastValue, len(state.Columns))
+	slot := f.slot(ts)
+	for col, cs := range state.Columns {
+		values[col] = ForecastValue{TS: ts, Column: col}
+		if cs.Updates < 2*int64(f.Season) {
+			continue
+		}
+		k := float64(ts-cs.TS) / float64(f.Step)
+		values[col].Predicted = float32(cs.Level + k*cs.Trend + float64(cs.Seasonal[slot]))
+		values[col].Deviation = cs.Deviation[slot]
+		values[col].Valid = true
+	}
+	return values
+}
+
+// updateForecasts put values into all forecasts; values should have this same ts
+func (r *RRD) updateForecasts(values []Value) error {
+	if len(r.forecasts) == 0 || len(values) == 0 {
+		return nil
+	}
+	LogDebug("RRD.updateForecasts values=%v", values)
+
+	allCols := r.allColumnsIDs()
+	for fID := range r.forecasts {
+		f := &r.forecasts[fID]
+		ts := f.calcTS(values[0].TS)
+
+		state, err := r.storage.LoadForecastState(fID)
+		if err != nil {
+			return err
+		}
+		if ts < state.LastTS {
+			LogDebug("RRD.updateForecasts skipping older value in forecast %d", fID)
+			continue
+		}
+		if ts > state.LastTS {
+			// previous step finished - update model by observed values
+			if state.LastTS > 0 {
+				prev, err := r.storage.GetForecast(fID, state.LastTS, allCols)
+				if err != nil {
+					return err
+				}
+				for _, pv := range prev {
+					if pv.HasObserved {
+						f.learn(&state.Columns[pv.Column], pv)
+					}
+				}
+			}
+			state.LastTS = ts
+		}
+
+		current, err := r.storage.GetForecast(fID, ts, allCols)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			current = f.predict(state, ts)
+		}
+		for _, v := range values {
+			fv := &current[v.Column]
+			fv.Observed = v.Value
+			fv.HasObserved = true
+			fv.Violation = fv.Valid &&
+				math.Abs(float64(fv.Observed-fv.Predicted)) > float64(f.Delta*fv.Deviation)
+			violations := 0
+			if fv.Violation {
+				violations++
+			}
+			for i := 1; i < int(f.Window); i++ {
+				prev, err := r.storage.GetForecast(fID, ts-int64(i)*f.Step, []int{v.Column})
+				if err != nil {
+					return err
+				}
+				if len(prev) > 0 && prev[0].Violation {
+					violations++
+				}
+			}
+			fv.Failure = violations >= int(f.Threshold)
+		}
+
+		if err := r.storage.PutForecast(fID, ts, current...); err != nil {
+			return err
+		}
+		if err := r.storage.SaveForecastState(fID, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetForecastRange return predictions for columns in given time range.
+// Empty columns list mean all columns; maxTS < 0 mean last step.
+func (r *RRD) GetForecastRange(forecastID int, minTS, maxTS int64, columns []int) (*ForecastRange, error) {
+	LogDebug("RRD.GetForecastRange forecast=%d, minTS=%d, maxTS=%d, columns=%v",
+		forecastID, minTS, maxTS, columns)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if forecastID < 0 || forecastID >= len(r.forecasts) {
+		return nil, fmt.Errorf("invalid forecast %d", forecastID)
+	}
+	if len(columns) == 0 {
+		columns = r.allColumnsIDs()
+	}
+	f := r.forecasts[forecastID]
+	res := &ForecastRange{Forecast: f}
+
+	state, err := r.storage.LoadForecastState(forecastID)
+	if err != nil {
+		return nil, err
+	}
+	end := f.calcTS(maxTS)
+	if maxTS < 0 || end > state.LastTS {
+		end = state.LastTS
+	}
+	begin := f.calcTS(minTS)
+	if first := end - int64(f.Rows-1)*f.Step; begin < first {
+		begin = first
+	}
+	if begin < f.Step {
+		begin = f.Step
+	}
+
+	for ts := begin; ts <= end; ts += f.Step {
+		values, err := r.storage.GetForecast(forecastID, ts, columns)
+		if err != nil {
+			return nil, err
+		}
+		if values == nil {
+			continue
+		}
+		for i, v := range values {
+			band := f.Delta * v.Deviation
+			values[i].Lower, values[i].Upper = v.Predicted-band, v.Predicted+band
+		}
+		res.Rows = append(res.Rows, ForecastRow{TS: ts, Values: values})
+	}
+	return res, nil
+}
+
+// Get return forecast value for column in step containing ts
+func (fr *ForecastRange) Get(ts int64, column int) (ForecastValue, bool) {
+	ts = fr.Forecast.calcTS(ts)
+	idx := sort.Search(len(fr.Rows), func(i int) bool { return fr.Rows[i].TS >= ts })
+	if idx < len(fr.Rows) && fr.Rows[idx].TS == ts {
+		for _, v := range fr.Rows[idx].Values {
+			if v.Column == column {
+				return v, true
+			}
+		}
+	}
+	return ForecastValue{}, false
+}
+
+// Anomalies return values marked as failures (or violations when
+// violations is true) in given time range
+func (r *RRD) Anomalies(forecastID int, minTS, maxTS int64, columns []int, violations bool) ([]ForecastValue, error) {
+	fr, err := r.GetForecastRange(forecastID, minTS, maxTS, columns)
+	if err != nil {
+		return nil, err
+	}
+	var res []ForecastValue
+	for _, row := range fr.Rows {
+		for _, v := range row.Values {
+			if v.Failure || (violations && v.Violation) {
+				res = append(res, v)
+			}
+		}
+	}
+	return res, nil
+}
+
+// copyForecasts copy forecasts state and predictions from src to dst.
+// Forecasts are matched by name and must have this same definition.
+func copyForecasts(src, dst *RRD, colsMap map[int]int) error {
+	var cols, dstCols []int
+	for c := 0; c < len(src.columns); c++ {
+		if dc, ok := colsMap[c]; ok {
+			cols = append(cols, c)
+			dstCols = append(dstCols, dc)
+		}
+	}
+
+	for fID, f := range dst.forecasts {
+		srcID := -1
+		for idx, sf := range src.forecasts {
+			if sf == f {
+				srcID = idx
+				break
+			}
+		}
+		if srcID < 0 {
+			continue
+		}
+		LogDebug("copyForecasts forecast=%d -> %d", srcID, fID)
+		state, err := src.storage.LoadForecastState(srcID)
+		if err != nil {
+			return err
+		}
+		dstState := &ForecastState{
+			LastTS:  state.LastTS,
+			Columns: make([]ForecastColumnState, len(dst.columns)),
+		}
+		for i := range dstState.Columns {
+			dstState.Columns[i].Seasonal = make([]float32, f.Season)
+			dstState.Columns[i].Deviation = make([]float32, f.Season)
+		}
+		for i, c := range cols {
+			dstState.Columns[dstCols[i]] = state.Columns[c]
+		}
+		if err := dst.storage.SaveForecastState(fID, dstState); err != nil {
+			return err
+		}
+
+		for i := int64(0); i < int64(f.Rows); i++ {
+			ts := state.LastTS - i*f.Step
+			if ts < 1 {
+				break
+			}
+			values, err := src.storage.GetForecast(srcID, ts, cols)
+			if err != nil {
+				return err
+			}
+			if values == nil {
+				continue
+			}
+			for j := range values {
+				values[j].Column = dstCols[j]
+			}
+			if err := dst.storage.PutForecast(fID, ts, values...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -72,6 +72,60 @@ func (f Function) Apply(v1, v2 Value) Value {
 	return v
 }
 
+// Merge combine two already consolidated values (i.e. from different files
+// or rows) into one; counters are summed. v2 is treated as newer value.
+func (f Function) Merge(v1, v2 Value) Value {
+	if !v1.Valid {
+		return v2
+	}
+	if !v2.Valid {
+		return v1
+	}
+	c1, c2 := v1.Counter, v2.Counter
+	if c1 < 1 {
+		c1 = 1
+	}
+	if c2 < 1 {
+		c2 = 1
+	}
+	v := Value(v2)
+	v.Counter = c1 + c2
+	switch f {
+	case FAverage:
+		v.Value = (v1.Value*float32(c1) + v2.Value*float32(c2)) / float32(c1+c2)
+	case FSum, FCount:
+		v.Value = v1.Value + v2.Value
+	case FMinimum:
+		if v.Value > v1.Value {
+			v.Value = v1.Value
+		}
+	case FMaximum:
+		if v.Value < v1.Value {
+			v.Value = v1.Value
+		}
+	case FLast:
+	}
+	return v
+}
+
+// Convert value consolidated by function from into value for function f.
+// Conversions into count, average to sum and sum to average are exact
+// (use number of consolidated values); other values are kept.
+func (f Function) Convert(from Function, v Value) Value {
+	if f == from || !v.Valid {
+		return v
+	}
+	switch {
+	case f == FCount:
+		v.Value = float32(v.Counter)
+	case f == FSum && from == FAverage:
+		v.Value *= float32(v.Counter)
+	case f == FAverage && from == FSum && v.Counter > 0:
+		v.Value /= float32(v.Counter)
+	}
+	return v
+}
+
 // ParseFunctionName return function by name
 func ParseFunctionName(name string) (Function, bool) {
 	var funcID Function
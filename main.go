@@ -29,6 +29,11 @@ func main() {
 			Value: "2006-01-02T15:04:05Z07:00",
 			Usage: "time stamp formatting string",
 		},
+		cli.StringFlag{
+			Name:  "timezone, tz",
+			Value: "",
+			Usage: "time zone used to parse and format dates (i.e. UTC, Europe/Warsaw); default local",
+		},
 		cli.StringFlag{
 			Name:  "separator",
 			Value: "\t",
@@ -60,7 +65,22 @@ func main() {
 				cli.StringFlag{
 					Name:  "archives, a",
 					Value: "",
-					Usage: "archives definitions in form: rows:step[:archive name],rows:step[:name]...",
+					Usage: "archives definitions in form: rows:step[:archive name],... or step:retention[:name],... with units s/m/h/d/w/y in both fields (i.e. 1m:2d,1h:1y)",
+				},
+				cli.StringFlag{
+					Name:  "like, l",
+					Value: "",
+					Usage: "copy columns and archives definitions from existing file; --columns and --archives override them",
+				},
+				cli.StringFlag{
+					Name:  "schema, s",
+					Value: "",
+					Usage: "load columns and archives definitions from json schema file (yaml and toml are not supported); --columns and --archives override them",
+				},
+				cli.StringFlag{
+					Name:  "forecasts",
+					Value: "",
+					Usage: "Holt-Winters forecasts definitions in form: step:season:retention[:name],... (i.e. 5m:1d:1w:daily)",
 				},
 			},
 			Action: initDB,
@@ -72,7 +92,7 @@ func main() {
 				cli.StringFlag{
 					Name:  "ts",
 					Value: "",
-					Usage: "time stamp (in sec, date, N/now/NOW)",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
 				},
 				cli.StringFlag{
 					Name:  "columns, c",
@@ -82,6 +102,63 @@ func main() {
 			},
 			Action: putValues,
 		},
+		{
+			Name:  "set",
+			Usage: "replace values stored in archive (as args) without consolidation",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "ts",
+					Value: "",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
+				},
+				cli.StringFlag{
+					Name:  "columns, c",
+					Value: "",
+					Usage: "optional destination columns number separated by comma",
+				},
+				cli.StringFlag{
+					Name:  "archive, a",
+					Value: "",
+					Usage: "archive to update (default first)",
+				},
+				cli.IntFlag{
+					Name:  "counter",
+					Usage: "number of measurements represented by values (default 1)",
+				},
+				cli.BoolFlag{
+					Name:  "no-rederive",
+					Usage: "don't recalculate coarser archives",
+				},
+			},
+			Action: setValues,
+		},
+		{
+			Name:  "purge",
+			Usage: "mark values in time range as invalid",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "begin, b",
+					Value: "",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
+				},
+				cli.StringFlag{
+					Name:  "end, e",
+					Value: "",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
+				},
+				cli.StringFlag{
+					Name:  "columns, c",
+					Value: "",
+					Usage: "optional columns to purge",
+				},
+				cli.StringFlag{
+					Name:  "archives, a",
+					Value: "",
+					Usage: "optional archives to purge",
+				},
+			},
+			Action: purgeData,
+		},
 		{
 			Name:    "get",
 			Aliases: []string{"g"},
@@ -90,7 +167,7 @@ func main() {
 				cli.StringFlag{
 					Name:  "ts",
 					Value: "",
-					Usage: "time stamp (in sec, date, N/now/NOW, last)",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h, last)",
 				},
 				cli.StringFlag{
 					Name:  "columns, c",
@@ -108,12 +185,12 @@ func main() {
 				cli.StringFlag{
 					Name:  "begin, b",
 					Value: "",
-					Usage: "time stamp (in sec, date, N/now/NOW)",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
 				},
 				cli.StringFlag{
 					Name:  "end, e",
 					Value: "now",
-					Usage: "time stamp (in sec, date, N/now/NOW)",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
 				},
 				cli.BoolFlag{
 					Name:  "include-invalid",
@@ -132,17 +209,275 @@ func main() {
 					Name:  "average-result",
 					Usage: "average output in time interval (sec)",
 				},
+				cli.StringFlag{
+					Name:  "average-by",
+					Value: "",
+					Usage: "average output in calendar periods in --timezone: day, week (from monday), month, year",
+				},
 				cli.IntFlag{
 					Name:  "average-max-count",
 					Usage: "average output to get no more than given results",
 				},
+				cli.StringFlag{
+					Name:  "downsample",
+					Value: "",
+					Usage: "method used to reduce output to --average-max-count rows: average/lttb/minmax",
+				},
 				cli.BoolFlag{
 					Name:  "fix-ranges",
 					Usage: "invalidate values that don't match min-max range",
 				},
+				cli.StringFlag{
+					Name:  "fill",
+					Value: "",
+					Usage: "fill missing values between stored values: none/previous/linear/zero or constant number",
+				},
+				cli.StringFlag{
+					Name:  "max-gap",
+					Value: "",
+					Usage: "don't fill gaps longer than given duration (sec or with units s/m/h/d/w/y)",
+				},
+				cli.BoolFlag{
+					Name:  "stitch",
+					Usage: "load each part of range from the finest archive that cover it",
+				},
+				cli.StringFlag{
+					Name:  "archive, a",
+					Value: "",
+					Usage: "load data from given archive",
+				},
+				cli.StringFlag{
+					Name:  "step, resolution",
+					Value: "",
+					Usage: "consolidate rows to given step (sec or duration with units s/m/h/d/w/y); must be multiple of archive step",
+				},
+				cli.StringSliceFlag{
+					Name:  "expr, x",
+					Usage: "computed column in form name=expression (i.e. total=rx+tx); may be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "transform, t",
+					Usage: "smoothing applied to output: sma:N|duration, ewma:alpha|N, median:N|duration; may be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "show-archive",
+					Usage: "print name of archive for each row",
+				},
+				cli.BoolFlag{
+					Name:  "show-counters",
+					Usage: "print number of consolidated measurements after each value",
+				},
+				cli.StringFlag{
+					Name:  "forecast",
+					Value: "",
+					Usage: "print predicted value, confidence band and failure (F) / violation (V) flag from forecast after each value",
+				},
+				cli.StringFlag{
+					Name:  "compare",
+					Value: "",
+					Usage: "comma separated list of time shifts (i.e. 1d,7d); values from shifted ranges are appended to each row",
+				},
+				cli.StringFlag{
+					Name:  "compare-mode",
+					Value: "values",
+					Usage: "compared values: values, diff (current - shifted), pct (percentage change)",
+				},
 			},
 			Action: getRangeValues,
 		},
+		{
+			Name:  "stats",
+			Usage: "show statistics of values in time range",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "begin, b",
+					Value: "",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
+				},
+				cli.StringFlag{
+					Name:  "end, e",
+					Value: "now",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
+				},
+				cli.StringFlag{
+					Name:  "columns, c",
+					Value: "",
+					Usage: "optional columns",
+				},
+				cli.StringFlag{
+					Name:  "archive, a",
+					Value: "",
+					Usage: "load data from given archive",
+				},
+				cli.StringFlag{
+					Name:  "percentiles, p",
+					Value: "50,90,95,99",
+					Usage: "percentiles to calculate",
+				},
+			},
+			Action: showStats,
+		},
+		{
+			Name:  "profile",
+			Usage: "show seasonal profile - statistics of values by hour of day and/or day of week",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "begin, b",
+					Value: "",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
+				},
+				cli.StringFlag{
+					Name:  "end, e",
+					Value: "now",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
+				},
+				cli.StringFlag{
+					Name:  "columns, c",
+					Value: "",
+					Usage: "optional columns",
+				},
+				cli.StringFlag{
+					Name:  "archive, a",
+					Value: "",
+					Usage: "load data from given archive",
+				},
+				cli.StringFlag{
+					Name:  "group, g",
+					Value: "hour",
+					Usage: "group values by: hour (of day), weekday, weekday-hour; in --timezone",
+				},
+				cli.StringFlag{
+					Name:  "percentiles, p",
+					Value: "50,90",
+					Usage: "percentiles to calculate",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print profile as json",
+				},
+				cli.StringFlag{
+					Name:  "heatmap",
+					Value: "",
+					Usage: "render heatmap of mean values of first column to given png file",
+				},
+				cli.IntFlag{
+					Name:  "width",
+					Value: 960,
+					Usage: "heatmap width",
+				},
+				cli.IntFlag{
+					Name:  "height",
+					Value: 280,
+					Usage: "heatmap height",
+				},
+			},
+			Action: showProfile,
+		},
+		{
+			Name:  "predict",
+			Usage: "fit linear trend to values and predict when threshold will be reached",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "begin, b",
+					Value: "",
+					Usage: "beginning of fitted window (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h); default 7 days before end",
+				},
+				cli.StringFlag{
+					Name:  "end, e",
+					Value: "now",
+					Usage: "end of fitted window (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
+				},
+				cli.StringFlag{
+					Name:  "columns, c",
+					Value: "",
+					Usage: "optional columns",
+				},
+				cli.StringFlag{
+					Name:  "method, m",
+					Value: "lsq",
+					Usage: "fitting method: lsq (least squares), theil-sen (robust)",
+				},
+				cli.StringFlag{
+					Name:  "threshold, t",
+					Value: "",
+					Usage: "print time when trend reach given value",
+				},
+				cli.StringFlag{
+					Name:  "archive, a",
+					Value: "",
+					Usage: "load data from given archive",
+				},
+			},
+			Action: predictTrend,
+		},
+		{
+			Name:  "check",
+			Usage: "check last value or statistic against thresholds; print monitoring plugins status line and exit with 0/1/2/3",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "column",
+					Value: "0",
+					Usage: "column to check",
+				},
+				cli.StringFlag{
+					Name:  "stat, s",
+					Value: "last",
+					Usage: "checked value: last or statistic over --window: avg, min, max, sum, count, stddev, first, pNN (i.e. p95)",
+				},
+				cli.StringFlag{
+					Name:  "window",
+					Value: "",
+					Usage: "time window for statistic (duration, i.e. 15m)",
+				},
+				cli.StringFlag{
+					Name:  "warning, w",
+					Value: "",
+					Usage: "warning threshold range ([@]start:end, i.e. 80, 10:, ~:20, @10:20)",
+				},
+				cli.StringFlag{
+					Name:  "critical, c",
+					Value: "",
+					Usage: "critical threshold range",
+				},
+				cli.StringFlag{
+					Name:  "max-age",
+					Value: "",
+					Usage: "ignore data older than given duration; UNKNOWN when no data",
+				},
+			},
+			Action: checkThresholds,
+		},
+		{
+			Name:  "anomalies",
+			Usage: "list values marked as failures by Holt-Winters forecast",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "begin, b",
+					Value: "",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
+				},
+				cli.StringFlag{
+					Name:  "end, e",
+					Value: "now",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
+				},
+				cli.StringFlag{
+					Name:  "columns, c",
+					Value: "",
+					Usage: "optional columns",
+				},
+				cli.StringFlag{
+					Name:  "forecast",
+					Value: "",
+					Usage: "forecast name or index (default first)",
+				},
+				cli.BoolFlag{
+					Name:  "violations",
+					Usage: "list also single values out of confidence band",
+				},
+			},
+			Action: showAnomalies,
+		},
 		{
 			Name:   "info",
 			Usage:  "show informations about rrdfile",
@@ -173,7 +508,11 @@ func main() {
 				cli.StringFlag{
 					Name:  "output",
 					Value: "",
-					Usage: "output file name",
+					Usage: "output file name; '-' for stdout",
+				},
+				cli.BoolFlag{
+					Name:  "gzip, z",
+					Usage: "compress output with gzip",
 				},
 			},
 			Action: dumpData,
@@ -185,7 +524,11 @@ func main() {
 				cli.StringFlag{
 					Name:  "input",
 					Value: "",
-					Usage: "input file name",
+					Usage: "input file name (plain or gzip-compressed); '-' for stdin",
+				},
+				cli.BoolFlag{
+					Name:  "validate",
+					Usage: "load values out of columns min-max range as invalid",
 				},
 			},
 			Action: loadData,
@@ -204,7 +547,7 @@ func main() {
 		},
 		{
 			Name:  "change-column",
-			Usage: "modify column (name, min, max values)",
+			Usage: "modify column (name, function, min, max values)",
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "column, c",
@@ -216,6 +559,11 @@ func main() {
 					Value: "",
 					Usage: "new name",
 				},
+				cli.StringFlag{
+					Name:  "function",
+					Value: "",
+					Usage: "new function: average/avg/sum/min/minimum/max/maximum/count/last",
+				},
 				cli.Float64Flag{
 					Name:  "min",
 					Usage: "new minimal value",
@@ -235,6 +583,18 @@ func main() {
 			},
 			Action: modifyChangeColumn,
 		},
+		{
+			Name:  "reorder-columns",
+			Usage: "change columns order",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "columns, c",
+					Value: "",
+					Usage: "columns in new order; not listed columns are moved after them",
+				},
+			},
+			Action: modifyReorderColumns,
+		},
 		{
 			Name:  "del-columns",
 			Usage: "remove columns from rrd file",
@@ -254,7 +614,7 @@ func main() {
 				cli.StringFlag{
 					Name:  "archives, a",
 					Value: "",
-					Usage: "archives definitions in form: rows:step[:archive name],rows:step[:name]...",
+					Usage: "archives definitions in form: rows:step[:archive name],... or step:retention[:name],... with units s/m/h/d/w/y in both fields (i.e. 1m:2d,1h:1y)",
 				},
 			},
 			Action: modifyAddArchives,
@@ -271,6 +631,22 @@ func main() {
 			},
 			Action: modifyDelArchives,
 		},
+		{
+			Name:  "set-forecasts",
+			Usage: "replace Holt-Winters forecasts definitions; unchanged forecasts keep their state",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "forecasts",
+					Value: "",
+					Usage: "forecasts definitions in form: step:season:retention[:name],... (i.e. 5m:1d:1w:daily)",
+				},
+				cli.BoolFlag{
+					Name:  "clear",
+					Usage: "remove all forecasts",
+				},
+			},
+			Action: modifySetForecasts,
+		},
 		{
 			Name:  "resize-archive",
 			Usage: "change number of rows in archive",
@@ -287,6 +663,44 @@ func main() {
 			},
 			Action: modifyResizeArchive,
 		},
+		{
+			Name:  "change-archive",
+			Usage: "rename archive and/or change its step (data are resampled, number of rows is changed to keep retention)",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "archive, a",
+					Value: "",
+					Usage: "archive to change",
+				},
+				cli.StringFlag{
+					Name:  "name",
+					Value: "",
+					Usage: "new name",
+				},
+				cli.StringFlag{
+					Name:  "step, s",
+					Value: "",
+					Usage: "new step (sec or duration with units s/m/h/d/w/y)",
+				},
+			},
+			Action: modifyChangeArchive,
+		},
+		{
+			Name:  "schema-apply",
+			Usage: "update rrd file to match schema file (add, delete, change columns and archives)",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "schema, s",
+					Value: "",
+					Usage: "json schema file (yaml and toml are not supported)",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run, n",
+					Usage: "only show required changes",
+				},
+			},
+			Action: schemaApply,
+		},
 		{
 			Name:  "gen-random",
 			Usage: "fill archive with random data",
@@ -294,12 +708,12 @@ func main() {
 				cli.StringFlag{
 					Name:  "begin, b",
 					Value: "",
-					Usage: "time stamp (in sec, date, N/now/NOW)",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
 				},
 				cli.StringFlag{
 					Name:  "end, e",
 					Value: "now",
-					Usage: "time stamp (in sec, date, N/now/NOW)",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
 				},
 				cli.IntFlag{
 					Name:  "step",
@@ -309,6 +723,18 @@ func main() {
 			},
 			Action: genRandomData,
 		},
+		{
+			Name:  "merge",
+			Usage: "merge source files given as arguments into new rrd file",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "policy, p",
+					Value: "newer",
+					Usage: "conflicts resolving policy: newer (prefer file with newer data), first (prefer files in arguments order), function (combine values by column function)",
+				},
+			},
+			Action: mergeFiles,
+		},
 		{
 			Name:   "update-rrd-file",
 			Usage:  "update rrd to never version",
@@ -322,12 +748,12 @@ func main() {
 				cli.StringFlag{
 					Name:  "begin, b",
 					Value: "",
-					Usage: "time stamp (in sec, date, N/now/NOW)",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
 				},
 				cli.StringFlag{
 					Name:  "end, e",
 					Value: "now",
-					Usage: "time stamp (in sec, date, N/now/NOW)",
+					Usage: "time stamp (in sec, date or expression: now-1d, yesterday 06:00, start of month, end-1h)",
 				},
 				cli.BoolFlag{
 					Name:  "include-invalid",
@@ -347,14 +773,56 @@ func main() {
 					Name:  "average-result",
 					Usage: "average output in time interval (sec)",
 				},
+				cli.StringFlag{
+					Name:  "average-by",
+					Value: "",
+					Usage: "average output in calendar periods in --timezone: day, week (from monday), month, year",
+				},
 				cli.IntFlag{
 					Name:  "average-max-count",
 					Usage: "average output to get no more than given results",
 				},
+				cli.StringFlag{
+					Name:  "downsample",
+					Value: "",
+					Usage: "method used to reduce output to --average-max-count rows: average/lttb/minmax",
+				},
 				cli.BoolFlag{
 					Name:  "fix-ranges",
 					Usage: "invalidate values that don't match min-max range",
 				},
+				cli.StringFlag{
+					Name:  "fill",
+					Value: "",
+					Usage: "fill missing values between stored values: none/previous/linear/zero or constant number",
+				},
+				cli.StringFlag{
+					Name:  "max-gap",
+					Value: "",
+					Usage: "don't fill gaps longer than given duration (sec or with units s/m/h/d/w/y)",
+				},
+				cli.BoolFlag{
+					Name:  "stitch",
+					Usage: "load each part of range from the finest archive that cover it",
+				},
+				cli.StringFlag{
+					Name:  "archive, a",
+					Value: "",
+					Usage: "load data from given archive",
+				},
+				cli.StringFlag{
+					Name:  "step, resolution",
+					Value: "",
+					Usage: "consolidate rows to given step (sec or duration with units s/m/h/d/w/y); must be multiple of archive step",
+				},
+				cli.StringSliceFlag{
+					Name:  "expr, x",
+					Usage: "computed column in form name=expression (i.e. total=rx+tx); may be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "transform, t",
+					Usage: "smoothing applied to output: sma:N|duration, ewma:alpha|N, median:N|duration; may be repeated",
+				},
 				cli.IntFlag{
 					Name:  "width",
 					Usage: "chart width",
@@ -369,6 +837,26 @@ func main() {
 					Name:  "second-axies",
 					Usage: "Use separated axis for second column.",
 				},
+				cli.StringFlag{
+					Name:  "forecast",
+					Value: "",
+					Usage: "draw confidence band and failures from forecast for first column",
+				},
+				cli.StringFlag{
+					Name:  "compare",
+					Value: "",
+					Usage: "comma separated list of time shifts (i.e. 1d,7d); shifted series are drawn as dashed lines",
+				},
+				cli.StringFlag{
+					Name:  "compare-mode",
+					Value: "values",
+					Usage: "compared values: values, diff (current - shifted), pct (percentage change)",
+				},
+				cli.StringFlag{
+					Name:  "trend",
+					Value: "",
+					Usage: "draw trend line fitted by given method: lsq, theil-sen",
+				},
 			},
 			Action: plotRangeValues,
 		},
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// MergePolicy define how conflicting values are resolved when merging files
+type MergePolicy int
+
+const (
+	// MergeNewer prefer values from file with newer data
+	MergeNewer MergePolicy = iota
+	// MergeFirst prefer values from file given earlier on sources list
+	MergeFirst
+	// MergeFunction combine conflicting values using column function
+	MergeFunction
+)
+
+func (p MergePolicy) String() string {
+	switch p {
+	case MergeNewer:
+		return "newer"
+	case MergeFirst:
+		return "first"
+	case MergeFunction:
+		return "function"
+	}
+	return "unknown policy"
+}
+
+// ParseMergePolicy return merge policy by name
+func ParseMergePolicy(name string) (MergePolicy, bool) {
+	switch strings.ToLower(name) {
+	case "", "newer", "new":
+		return MergeNewer, true
+	case "first", "order", "source-order":
+		return MergeFirst, true
+	case "function", "func", "combine":
+		return MergeFunction, true
+	}
+	return 0, false
+}
+
+func (p MergePolicy) mergeFunc() mergeFunc {
+	switch p {
+	case MergeFirst:
+		return func(col RRDColumn, prev, value Value) Value {
+			if prev.Valid {
+				return prev
+			}
+			return value
+		}
+	case MergeFunction:
+		return func(col RRDColumn, prev, value Value) Value {
+			return col.Function.Merge(prev, value)
+		}
+	}
+	return func(col RRDColumn, prev, value Value) Value {
+		if value.Valid {
+			return value
+		}
+		return prev
+	}
+}
+
+// MergeRRD create new rrd file and fill it with data from sources files.
+// Sources must have compatible schema (columns functions, archives steps and
+// rows, forecasts) and schema of new file is copied from first source;
+// forecasts state and predictions are copied from the newest source.
+func MergeRRD(filename string, sources []string, policy MergePolicy) error {
+	LogDebug("MergeRRD filename=%s, sources=%v, policy=%s", filename, sources, policy)
+
+	if len(sources) == 0 {
+		return fmt.Errorf("no source files")
+	}
+	if _, err := os.Stat(filename); err == nil {
+		return fmt.Errorf("file %s already exists", filename)
+	}
+
+	var srcs []*RRD
+	defer func() {
+		for _, s := range srcs {
+			s.Close()
+		}
+	}()
+
+	lasts := make(map[*RRD]int64)
+	for _, fname := range sources {
+		s, err := OpenRRD(fname, true)
+		if err != nil {
+			s.Close()
+			return fmt.Errorf("open %s error: %s", fname, err.Error())
+		}
+		srcs = append(srcs, s)
+		if err := checkMergeCompatible(srcs[0], s); err != nil {
+			return fmt.Errorf("file %s is not compatible with %s: %s", fname, sources[0], err.Error())
+		}
+		if lasts[s], err = s.Last(); err != nil {
+			return err
+		}
+	}
+
+	// sources with newer data are copied later
+	ordered := make([]*RRD, len(srcs))
+	copy(ordered, srcs)
+	if policy != MergeFirst {
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return lasts[ordered[i]] < lasts[ordered[j]]
+		})
+	}
+
+	dst, err := NewRRD(filename, srcs[0].columns, srcs[0].archives, srcs[0].forecasts...)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	colsMap := identityMap(len(dst.columns))
+	archMap := identityMap(len(dst.archives))
+	merge := policy.mergeFunc()
+	for _, src := range ordered {
+		LogDebug("MergeRRD copy data from %s", src.filename)
+		if err := copyDataMap(src, dst, colsMap, archMap, merge); err != nil {
+			return fmt.Errorf("copy data from %s error: %s", src.filename, err.Error())
+		}
+	}
+
+	newest := srcs[0]
+	for _, src := range srcs {
+		if lasts[src] > lasts[newest] {
+			newest = src
+		}
+	}
+	if err := copyForecasts(newest, dst, colsMap); err != nil {
+		return fmt.Errorf("copy forecasts from %s error: %s", newest.filename, err.Error())
+	}
+	return nil
+}
+
+func checkMergeCompatible(r1, r2 *RRD) error {
+	if len(r1.columns) != len(r2.columns) {
+		return fmt.Errorf("different number of columns")
+	}
+	for idx, c := range r1.columns {
+		if c.Function != r2.columns[idx].Function {
+			return fmt.Errorf("different function in column %d", idx)
+		}
+	}
+	if len(r1.archives) != len(r2.archives) {
+		return fmt.Errorf("different number of archives")
+	}
+	for idx, a := range r1.archives {
+		if a.Step != r2.archives[idx].Step {
+			return fmt.Errorf("different step in archive %d", idx)
+		}
+		if a.Rows != r2.archives[idx].Rows {
+			return fmt.Errorf("different number of rows in archive %d", idx)
+		}
+	}
+	if len(r1.forecasts) != len(r2.forecasts) {
+		return fmt.Errorf("different number of forecasts")
+	}
+	for idx, f := range r1.forecasts {
+		if f != r2.forecasts[idx] {
+			return fmt.Errorf("different definition of forecast %d", idx)
+		}
+	}
+	return nil
+}
+
+func identityMap(size int) map[int]int {
+	res := make(map[int]int)
+	for i := 0; i < size; i++ {
+		res[i] = i
+	}
+	return res
+}
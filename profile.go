@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ProfileGroup define how rows are grouped in seasonal profile
+type ProfileGroup int
+
+const (
+	// ProfileHour group rows by hour of day
+	ProfileHour ProfileGroup = iota
+	// ProfileWeekday group rows by day of week
+	ProfileWeekday
+	// ProfileWeekdayHour group rows by day of week and hour of day
+	ProfileWeekdayHour
+)
+
+var weekdaysNames = []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+
+func (g ProfileGroup) String() string {
+	switch g {
+	case ProfileHour:
+		return "hour"
+	case ProfileWeekday:
+		return "weekday"
+	case ProfileWeekdayHour:
+		return "weekday-hour"
+	}
+	return "unknown profile group"
+}
+
+// ParseProfileGroup return profile grouping by name
+func ParseProfileGroup(name string) (ProfileGroup, bool) {
+	switch strings.ToLower(name) {
+	case "", "hour", "hour-of-day", "h":
+		return ProfileHour, true
+	case "weekday", "day-of-week", "dow":
+		return ProfileWeekday, true
+	case "weekday-hour", "dow-hour", "both":
+		return ProfileWeekdayHour, true
+	}
+	return ProfileHour, false
+}
+
+// buckets return number of weekdays and hours in profile
+func (g ProfileGroup) buckets() (weekdays, hours int) {
+	switch g {
+	case ProfileWeekday:
+		return 7, 1
+	case ProfileWeekdayHour:
+		return 7, 24
+	}
+	return 1, 24
+}
+
+type (
+	// ProfileBucket keep statistics of values in one bucket of profile
+	ProfileBucket struct {
+		// Weekday is day of week (0 = monday); -1 when not grouped by weekday
+		Weekday int `json:"weekday"`
+		// Hour is hour of day; -1 when not grouped by hour
+		Hour    int            `json:"hour"`
+		Columns []*ColumnStats `json:"columns"`
+	}
+
+	// Profile is seasonal profile of values (statistics by hour of day
+	// and/or day of week)
+	Profile struct {
+		Group    ProfileGroup     `json:"-"`
+		Begin    int64            `json:"begin"`
+		End      int64            `json:"end"`
+		TimeZone string           `json:"timezone"`
+		Columns  []string         `json:"columns"`
+		Buckets  []*ProfileBucket `json:"buckets"`
+	}
+)
+
+// Profile calculate statistics of valid values in range grouped by hour
+// of day and/or day of week in given location. Archive is selected like
+// in GetRangeOpts.
+func (r *RRD) Profile(minTS, maxTS int64, columns []int, group ProfileGroup, percentiles []float64,
+	loc *time.Location, opts RangeOptions) (*Profile, error) {
+	LogDebug("RRD.Profile minTS=%d, maxTS=%d, columns=%v, group=%s, loc=%s", minTS, maxTS, columns, group, loc)
+
+	for _, p := range percentiles {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile %v", p)
+		}
+	}
+	if len(columns) == 0 {
+		columns = r.allColumnsIDs()
+	}
+
+	rows, err := r.GetRangeOpts(minTS, maxTS, columns, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Profile{Group: group, Begin: minTS, End: maxTS, TimeZone: loc.String()}
+	for _, col := range columns {
+		p.Columns = append(p.Columns, r.columns[col].Name)
+	}
+	weekdays, hours := group.buckets()
+	for wd := 0; wd < weekdays; wd++ {
+		for h := 0; h < hours; h++ {
+			b := &ProfileBucket{Weekday: wd, Hour: h}
+			if weekdays == 1 {
+				b.Weekday = -1
+			}
+			if hours == 1 {
+				b.Hour = -1
+			}
+			for _, col := range columns {
+				b.Columns = append(b.Columns, &ColumnStats{Column: col, Name: r.columns[col].Name})
+			}
+			p.Buckets = append(p.Buckets, b)
+		}
+	}
+
+	for _, row := range rows {
+		b := p.Buckets[p.bucketIndex(row.TS, loc)]
+		for i, v := range row.Values {
+			if v.Valid {
+				b.Columns[i].add(row.TS, float64(v.Value))
+			}
+		}
+	}
+	for _, b := range p.Buckets {
+		for _, s := range b.Columns {
+			s.finish(percentiles)
+		}
+	}
+	return p, nil
+}
+
+// bucketIndex return index of bucket for ts
+func (p *Profile) bucketIndex(ts int64, loc *time.Location) int {
+	t := time.Unix(ts, 0).In(loc)
+	weekday := (int(t.Weekday()) + 6) % 7
+	switch p.Group {
+	case ProfileWeekday:
+		return weekday
+	case ProfileWeekdayHour:
+		return weekday*24 + t.Hour()
+	}
+	return t.Hour()
+}
+
+// Label return human-readable name of bucket (i.e. "Mon 06")
+func (b *ProfileBucket) Label() string {
+	switch {
+	case b.Weekday < 0:
+		return fmt.Sprintf("%02d", b.Hour)
+	case b.Hour < 0:
+		return weekdaysNames[b.Weekday]
+	}
+	return fmt.Sprintf("%s %02d", weekdaysNames[b.Weekday], b.Hour)
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,8 +21,9 @@ type (
 		filename string
 		readonly bool
 
-		columns  []RRDColumn
-		archives []RRDArchive
+		columns   []RRDColumn
+		archives  []RRDArchive
+		forecasts []RRDForecast
 	}
 
 	// RRDColumn define one column
@@ -60,8 +60,8 @@ type (
 type (
 	// Storage save/load values from physical storage
 	Storage interface {
-		Create(filename string, columns []RRDColumn, archives []RRDArchive) error
-		Open(filename string, readonly bool) ([]RRDColumn, []RRDArchive, error)
+		Create(filename string, columns []RRDColumn, archives []RRDArchive, forecasts []RRDForecast) error
+		Open(filename string, readonly bool) ([]RRDColumn, []RRDArchive, []RRDForecast, error)
 		Close() error
 		Put(archive int, ts int64, v ...Value) error
 		Get(archive int, ts int64, columns []int) ([]Value, error)
@@ -70,6 +70,11 @@ type (
 		//Loads only given columns.
 		Iterate(archive int, begin, end int64, columns []int) (RowsIterator, error)
 		Flush()
+
+		PutForecast(forecast int, ts int64, v ...ForecastValue) error
+		GetForecast(forecast int, ts int64, columns []int) ([]ForecastValue, error)
+		LoadForecastState(forecast int) (*ForecastState, error)
+		SaveForecastState(forecast int, state *ForecastState) error
 	}
 
 	// RowsIterator allow iterating over database
@@ -88,8 +93,9 @@ type (
 		ColumnsCount  int
 		ArchivesCount int
 
-		Columns  []RRDColumn
-		Archives []RRDArchiveInfo
+		Columns   []RRDColumn
+		Archives  []RRDArchiveInfo
+		Forecasts []RRDForecast
 	}
 
 	// RRDArchiveInfo keeps information about archive
@@ -114,22 +120,23 @@ func OpenRRD(filename string, readonly bool) (*RRD, error) {
 		readonly: readonly,
 	}
 	var err error
-	rrd.columns, rrd.archives, err = rrd.storage.Open(filename, readonly)
+	rrd.columns, rrd.archives, rrd.forecasts, err = rrd.storage.Open(filename, readonly)
 	return rrd, err
 }
 
-// NewRRD create new rrd database
-func NewRRD(filename string, columns []RRDColumn, archives []RRDArchive) (*RRD, error) {
-	LogDebug("NewRRD filename=%s, columns=%v, archives=%v",
-		filename, columns, archives)
+// NewRRD create new rrd database; forecasts are optional
+func NewRRD(filename string, columns []RRDColumn, archives []RRDArchive, forecasts ...RRDForecast) (*RRD, error) {
+	LogDebug("NewRRD filename=%s, columns=%v, archives=%v, forecasts=%v",
+		filename, columns, archives, forecasts)
 	rrd := &RRD{
-		filename: filename,
-		storage:  &BinaryFileStorage{},
-		readonly: false,
-		columns:  columns,
-		archives: archives,
-	}
-	err := rrd.storage.Create(filename, columns, archives)
+		filename:  filename,
+		storage:   &BinaryFileStorage{},
+		readonly:  false,
+		columns:   columns,
+		archives:  archives,
+		forecasts: forecasts,
+	}
+	err := rrd.storage.Create(filename, columns, archives, forecasts)
 	return rrd, err
 }
 
@@ -169,10 +176,21 @@ func (r *RRD) GetColumn(idx int) RRDColumn {
 	return r.columns[idx]
 }
 
+// Columns return columns definitions
 func (r *RRD) Columns() []RRDColumn {
 	return r.columns
 }
 
+// Archives return archives definitions
+func (r *RRD) Archives() []RRDArchive {
+	return r.archives
+}
+
+// Forecasts return forecasts definitions
+func (r *RRD) Forecasts() []RRDForecast {
+	return r.forecasts
+}
+
 // GetColumnIdx search for column by name and return it index
 func (r *RRD) GetColumnIdx(name string) (index int, ok bool) {
 	for idx, v := range r.columns {
@@ -354,9 +372,157 @@ func (r *RRD) PutValues(values ...Value) error {
 			return err
 		}
 	}
+	return r.updateForecasts(filtered)
+}
+
+// SetValues replace values stored in archive (without consolidation with
+// previous values). All values should have this same TS. Value.Counter < 1
+// means one measurement (for count function counter = value).
+// When rederive is true coarser archives are recalculated from finer ones
+// when they still hold all rows for given period.
+func (r *RRD) SetValues(archiveID int, rederive bool, values ...Value) error {
+	LogDebug("RRD.SetValues archive=%d, rederive=%v, values=%v", archiveID, rederive, values)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.readonly {
+		return fmt.Errorf("RRD file open as read-only")
+	}
+	if archiveID < 0 || archiveID >= len(r.archives) {
+		return fmt.Errorf("invalid archive %d", archiveID)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	ts := r.archives[archiveID].calcTS(values[0].TS)
+	var cols []int
+	var toSet []Value
+	for _, v := range values {
+		if v.Column < 0 || v.Column >= len(r.columns) {
+			return fmt.Errorf("invalid column %d", v.Column)
+		}
+		colDef := r.columns[v.Column]
+		if !colDef.InRange(v.Value) {
+			return fmt.Errorf("value %f out of range in column %d", v.Value, v.Column)
+		}
+		v.TS = ts
+		v.ArchiveID = archiveID
+		v.Valid = true
+		if colDef.Function == FCount {
+			v.Counter = int64(v.Value)
+		} else if v.Counter < 1 {
+			v.Counter = 1
+		}
+		toSet = append(toSet, v)
+		cols = append(cols, v.Column)
+	}
+
+	if err := r.storage.Put(archiveID, ts, toSet...); err != nil {
+		if err == errOlderValue {
+			return fmt.Errorf("archive %d no longer holds data for %d", archiveID, ts)
+		}
+		return err
+	}
+
+	if !rederive {
+		return nil
+	}
+
+	// archives updated so far - possible sources for coarser archives
+	sources := []int{archiveID}
+	for aID := archiveID + 1; aID < len(r.archives); aID++ {
+		a := r.archives[aID]
+		begin := a.calcTS(ts)
+		srcID, err := r.findDeriveSource(sources, a, begin)
+		if err != nil {
+			return err
+		}
+		if srcID < 0 {
+			LogDebug("RRD.SetValues no source to rederive archive %d", aID)
+			continue
+		}
+		merged, err := r.deriveValues(srcID, begin, begin+a.Step-1, cols)
+		if err != nil {
+			return err
+		}
+		for i := range merged {
+			merged[i].TS = begin
+			merged[i].ArchiveID = aID
+		}
+		LogDebug("RRD.SetValues rederive archive %d from %d: %v", aID, srcID, merged)
+		if err := r.storage.Put(aID, begin, merged...); err != nil {
+			if err == errOlderValue {
+				// archive keeps newer data in this row
+				continue
+			}
+			return err
+		}
+		sources = append(sources, aID)
+	}
 	return nil
 }
 
+// findDeriveSource return first archive from sources that hold all rows
+// for period starting at begin in archive a; -1 when not found
+func (r *RRD) findDeriveSource(sources []int, a RRDArchive, begin int64) (int, error) {
+	for _, srcID := range sources {
+		src := r.archives[srcID]
+		if a.Step%src.Step != 0 || a.Step/src.Step > int64(src.Rows) {
+			continue
+		}
+		last, err := r.archiveLast(srcID)
+		if err != nil {
+			return -1, err
+		}
+		if begin >= last-int64(src.Rows-1)*src.Step {
+			return srcID, nil
+		}
+	}
+	return -1, nil
+}
+
+// deriveValues merge values from archive in range [begin, end]
+func (r *RRD) deriveValues(archiveID int, begin, end int64, cols []int) ([]Value, error) {
+	a := r.archives[archiveID]
+	merged := make([]Value, len(cols))
+	for i, col := range cols {
+		merged[i] = Value{Column: col}
+	}
+	for ts := begin; ts <= end; ts += a.Step {
+		values, err := r.storage.Get(archiveID, ts, cols)
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			merged[i] = r.columns[cols[i]].Function.Merge(merged[i], v)
+		}
+	}
+	return merged, nil
+}
+
+// archiveLast return newest timestamp stored in archive
+func (r *RRD) archiveLast(archiveID int) (int64, error) {
+	var last int64 = -1
+	i, err := r.storage.Iterate(archiveID, 0, -1, nil)
+	if err != nil {
+		return -1, err
+	}
+	for {
+		if err := i.Next(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return -1, err
+		}
+		if ts := i.TS(); ts > last {
+			last = ts
+		}
+	}
+	return last, nil
+}
+
 // Get get values for timestamp.
 func (r *RRD) Get(ts int64, columns ...int) ([]Value, error) {
 	LogDebug("RRD.Get ts=%s, columns=%v", ts, columns)
@@ -381,6 +547,70 @@ func (r *RRD) Get(ts int64, columns ...int) ([]Value, error) {
 	return nil, nil
 }
 
+// Purge mark values in time range [minTS, maxTS] as invalid and reset its
+// counters. Empty columns or archives lists mean all columns / archives.
+// In each archive are cleared all rows that overlap given range.
+// Return number of cleared rows.
+func (r *RRD) Purge(minTS, maxTS int64, columns []int, archives []int) (int, error) {
+	LogDebug("RRD.Purge minTS=%d, maxTS=%d, columns=%v, archives=%v", minTS, maxTS, columns, archives)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.readonly {
+		return 0, fmt.Errorf("RRD file open as read-only")
+	}
+	if minTS > maxTS {
+		return 0, fmt.Errorf("invalid range")
+	}
+
+	if len(columns) == 0 {
+		columns = r.allColumnsIDs()
+	}
+	if len(archives) == 0 {
+		for aID := range r.archives {
+			archives = append(archives, aID)
+		}
+	}
+
+	purged := 0
+	for _, aID := range archives {
+		a := r.archives[aID]
+		aMinTS, aMaxTS := a.calcTS(minTS), a.calcTS(maxTS)
+
+		// rows in archive are not ordered by ts so check all
+		iter, err := r.storage.Iterate(aID, 0, -1, nil)
+		if err != nil {
+			return purged, err
+		}
+		var rowsTS []int64
+		for {
+			if err := iter.Next(); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return purged, err
+			}
+			if ts := iter.TS(); ts >= aMinTS && ts <= aMaxTS {
+				rowsTS = append(rowsTS, ts)
+			}
+		}
+
+		LogDebug("RRD.Purge archive %d: %d rows to clear", aID, len(rowsTS))
+		for _, ts := range rowsTS {
+			values := make([]Value, 0, len(columns))
+			for _, col := range columns {
+				values = append(values, Value{TS: ts, Column: col, ArchiveID: aID})
+			}
+			if err := r.storage.Put(aID, ts, values...); err != nil {
+				return purged, err
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
 func (r *RRD) getFromArchive(aID int, ts int64, columns []int) ([]Value, error) {
 	a := r.archives[aID]
 	ts = a.calcTS(ts)
@@ -424,9 +654,40 @@ func (r *RRD) last() (int64, error) {
 	return last, nil
 }
 
+// RangeOptions define how GetRangeOpts load and process data
+type RangeOptions struct {
+	// IncludeInvalid add rows with no data
+	IncludeInvalid bool
+	// RealTime - use current time (not last ts in file) for selecting archive
+	RealTime bool
+	// Fill define how missing values are filled
+	Fill FillPolicy
+	// FillValue is used for FillConstant
+	FillValue float32
+	// MaxGap is maximal gap (in seconds) that is filled; 0 = no limit
+	MaxGap int64
+	// Stitch load each part of range from the finest archive that cover it;
+	// source archive is stored in Value.ArchiveID
+	Stitch bool
+	// HasArchive force loading data from Archive
+	HasArchive bool
+	Archive    int
+	// Step consolidate rows to given step (in seconds); 0 = archive step
+	Step int64
+}
+
 // GetRange finds all records in given range
 func (r *RRD) GetRange(minTS, maxTS int64, columns []int, includeInvalid bool, realTime bool) (Rows, error) {
-	LogDebug("RRD.GetRange minTS=%d, maxTS=%d, columns=%v", minTS, maxTS, columns)
+	return r.GetRangeOpts(minTS, maxTS, columns, RangeOptions{
+		IncludeInvalid: includeInvalid,
+		RealTime:       realTime,
+	})
+}
+
+// GetRangeOpts finds all records in given range and process it according to options.
+// When filling is enabled rows without any valid value are returned only with IncludeInvalid.
+func (r *RRD) GetRangeOpts(minTS, maxTS int64, columns []int, opts RangeOptions) (Rows, error) {
+	LogDebug("RRD.GetRangeOpts minTS=%d, maxTS=%d, columns=%v, opts=%+v", minTS, maxTS, columns, opts)
 
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -437,7 +698,7 @@ func (r *RRD) GetRange(minTS, maxTS int64, columns []int, includeInvalid bool, r
 	}
 
 	var last int64
-	if realTime {
+	if opts.RealTime {
 		last = time.Now().Unix()
 	} else {
 		var err error
@@ -447,10 +708,90 @@ func (r *RRD) GetRange(minTS, maxTS int64, columns []int, includeInvalid bool, r
 		}
 	}
 
-	archiveID, aMinTS, aMaxTS := r.findArchiveForRange(minTS, maxTS, last)
-	LogDebug("RRD.GetRange archive: using archive=%d, aMinTS=%d, aMaxTS=%d", archiveID, aMinTS, aMaxTS)
+	var rows Rows
+	var err error
+	switch {
+	case opts.HasArchive:
+		if opts.Archive < 0 || opts.Archive >= len(r.archives) {
+			return nil, fmt.Errorf("invalid archive %d", opts.Archive)
+		}
+		if opts.Step > 0 {
+			if err := r.checkStep(opts.Archive, opts.Step); err != nil {
+				return nil, err
+			}
+		}
+		a := r.archives[opts.Archive]
+		rows, err = r.getArchiveRange(opts.Archive, a.calcTS(minTS), maxTS, columns, opts)
+	case opts.Stitch:
+		rows, err = r.getStitchedRange(minTS, maxTS, last, columns, opts)
+		if err == nil && opts.Step > 0 {
+			// each part of range may come from other archive
+			for _, row := range rows {
+				if len(row.Values) == 0 {
+					continue
+				}
+				if err := r.checkStep(row.Values[0].ArchiveID, opts.Step); err != nil {
+					return nil, err
+				}
+			}
+		}
+	default:
+		archiveID, aMinTS, aMaxTS := r.findArchiveForRange(minTS, maxTS, last)
+		if opts.Step > 0 {
+			archiveID, aMinTS, aMaxTS, err = r.findArchiveForStep(minTS, maxTS, last, opts.Step)
+			if err != nil {
+				return nil, err
+			}
+		}
+		LogDebug("RRD.GetRange archive: using archive=%d, aMinTS=%d, aMaxTS=%d", archiveID, aMinTS, aMaxTS)
+		rows, err = r.getArchiveRange(archiveID, aMinTS, aMaxTS, columns, opts)
+	}
+
+	if err == nil && opts.Step > 0 {
+		rows = r.consolidateRows(rows, opts.Step)
+	}
+	return rows, err
+}
+
+// getStitchedRange load data from all archives; each part of range is loaded
+// from the finest archive that cover it. Boundaries between parts are aligned
+// to step of coarser archive, so rows don't overlap.
+func (r *RRD) getStitchedRange(minTS, maxTS, last int64, columns []int, opts RangeOptions) (Rows, error) {
+	end := maxTS
+	if end < 0 || end > last {
+		end = last
+	}
 
-	i, err := r.storage.Iterate(archiveID, aMinTS, aMaxTS, columns)
+	var rows Rows
+	for aID, a := range r.archives {
+		if end < minTS {
+			break
+		}
+		begin := a.calcTS(minTS)
+		if aID < len(r.archives)-1 {
+			oldest := a.calcTS(last) - int64(a.Rows-1)*a.Step
+			if oldest > minTS {
+				nextStep := r.archives[aID+1].Step
+				begin = (oldest + nextStep - 1) / nextStep * nextStep
+			}
+		}
+		if begin > end {
+			continue
+		}
+		LogDebug("RRD.getStitchedRange archive=%d, begin=%d, end=%d", aID, begin, end)
+		aRows, err := r.getArchiveRange(aID, begin, end, columns, opts)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(aRows, rows...)
+		end = begin - 1
+	}
+	return rows, nil
+}
+
+// getArchiveRange load rows from archive in range [minTS, maxTS] ordered by ts
+func (r *RRD) getArchiveRange(archiveID int, minTS, maxTS int64, columns []int, opts RangeOptions) (Rows, error) {
+	i, err := r.storage.Iterate(archiveID, minTS, -1, columns)
 	if err != nil {
 		return nil, err
 	}
@@ -468,6 +809,9 @@ func (r *RRD) GetRange(minTS, maxTS int64, columns []int, includeInvalid bool, r
 			}
 			return nil, err
 		}
+		if maxTS > -1 && i.TS() > maxTS {
+			continue
+		}
 		values, err := i.Values()
 		if err != nil {
 			return nil, err
@@ -485,7 +829,7 @@ func (r *RRD) GetRange(minTS, maxTS int64, columns []int, includeInvalid bool, r
 		}
 	}
 
-	LogDebug("RRD.GetRange found %d + %d records", len(rows1), len(rows2))
+	LogDebug("RRD.getArchiveRange found %d + %d records", len(rows1), len(rows2))
 	if len(rows1) > 0 {
 		if len(rows2) > 0 {
 			rows = append(rows2, rows1...)
@@ -494,10 +838,22 @@ func (r *RRD) GetRange(minTS, maxTS int64, columns []int, includeInvalid bool, r
 		}
 	}
 
-	if includeInvalid {
-		rows = fillData(aMinTS, aMaxTS, r.archives[archiveID].Step, rows, columns)
+	if opts.IncludeInvalid || opts.Fill != FillNone {
+		step := r.archives[archiveID].Step
+		rows = fillData(minTS, maxTS, step, rows, columns)
+		if opts.Fill != FillNone {
+			rows = fillGaps(rows, step, opts)
+			if !opts.IncludeInvalid {
+				rows = removeEmptyRows(rows)
+			}
+		}
+		for _, row := range rows {
+			for i := range row.Values {
+				row.Values[i].ArchiveID = archiveID
+			}
+		}
 	}
-	return rows, err
+	return rows, nil
 }
 
 func (r *RRD) findArchiveForRange(minTS, maxTS, last int64) (archiveID int, aMinTS, aMaxTS int64) {
@@ -519,6 +875,68 @@ func (r *RRD) findArchiveForRange(minTS, maxTS, last int64) (archiveID int, aMin
 	return
 }
 
+// findArchiveForStep find the coarsest archive with step that divide requested
+// step and cover range; when no such archive cover range use the coarsest one
+func (r *RRD) findArchiveForStep(minTS, maxTS, last, step int64) (archiveID int, aMinTS, aMaxTS int64, err error) {
+	LogDebug("RRD.findArchiveForStep minTS=%d, maxTS=%d, step=%d", minTS, maxTS, step)
+
+	archiveID = -1
+	fallback := -1
+	for aID, a := range r.archives {
+		if a.Step > step {
+			break
+		}
+		if step%a.Step != 0 {
+			continue
+		}
+		fallback = aID
+		if aOldestTS := a.calcTS(last - int64(a.Rows)*a.Step); minTS >= aOldestTS {
+			archiveID = aID
+		}
+	}
+	if archiveID < 0 {
+		if fallback < 0 {
+			return -1, 0, 0, fmt.Errorf("step %d is not multiple of any archive step", step)
+		}
+		LogDebug("RRD.findArchiveForStep not found archive covering range, using %d", fallback)
+		archiveID = fallback
+	}
+	return archiveID, r.archives[archiveID].calcTS(minTS), maxTS, nil
+}
+
+// checkStep verify that rows from archive can be consolidated to step
+func (r *RRD) checkStep(archiveID int, step int64) error {
+	if aStep := r.archives[archiveID].Step; step%aStep != 0 {
+		return fmt.Errorf("step %d is not multiple of archive %d step %d", step, archiveID, aStep)
+	}
+	return nil
+}
+
+// consolidateRows merge rows into buckets of given step using columns functions
+func (r *RRD) consolidateRows(rows Rows, step int64) (out Rows) {
+	LogDebug("RRD.consolidateRows rows=%d, step=%d", len(rows), step)
+	for _, row := range rows {
+		ts := row.TS / step * step
+		if len(out) == 0 || out[len(out)-1].TS != ts {
+			values := make([]Value, len(row.Values))
+			for i, v := range row.Values {
+				v.TS = ts
+				values[i] = v
+			}
+			out = append(out, Row{TS: ts, Values: values})
+			continue
+		}
+		values := out[len(out)-1].Values
+		for i, v := range row.Values {
+			archiveID := values[i].ArchiveID
+			values[i] = r.columns[v.Column].Function.Merge(values[i], v)
+			values[i].TS = ts
+			values[i].ArchiveID = archiveID
+		}
+	}
+	return
+}
+
 func (r *RRD) allColumnsIDs() (cols []int) {
 	for i := 0; i < len(r.columns); i++ {
 		cols = append(cols, i)
@@ -536,6 +954,7 @@ func (r *RRD) Info() (*RRDFileInfo, error) {
 		ColumnsCount:  len(r.columns),
 		ArchivesCount: len(r.archives),
 		Columns:       r.columns,
+		Forecasts:     r.forecasts,
 	}
 
 	for aID, a := range r.archives {
@@ -629,63 +1048,12 @@ func (r *RRD) LowLevelDebugDump() string {
 	return strings.Join(res, "\n")
 }
 
-type (
-	// RRDDump is structure dumped to json-file
-	RRDDump struct {
-		Columns  []RRDColumn
-		Archives []RRDArchive
-		Data     []RRDArchiveData
-	}
-	// RRDArchiveData keep data in dump file for each archive
-	RRDArchiveData struct {
-		ArchiveID int
-		Rows      Rows
-	}
-)
-
-// Dump content of rrd file into json-encoded file
-func (r *RRD) Dump(filename string) error {
-	LogDebug("RRD.Dump filename=%s", filename)
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-
-	data := RRDDump{
-		Columns:  r.columns,
-		Archives: r.archives,
-	}
-	for aID := range r.archives {
-		iter, _ := r.storage.Iterate(aID, 0, -1, r.allColumnsIDs())
-		ad := RRDArchiveData{ArchiveID: aID}
-		for {
-			err := iter.Next()
-			if err == io.EOF {
-				break
-			}
-			row := Row{TS: iter.TS()}
-
-			values, _ := iter.Values()
-			for _, value := range values {
-				if value.Valid {
-					row.Values = append(row.Values, value)
-				}
-			}
-			ad.Rows = append(ad.Rows, row)
-		}
-		data.Data = append(data.Data, ad)
-	}
-	enc, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(filename, enc, 0660)
-}
-
 // SaveAs save current rrd to new file (with changes)
 func (r *RRD) SaveAs(filename string) error {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	nRRD, err := NewRRD(filename, r.columns, r.archives)
+	nRRD, err := NewRRD(filename, r.columns, r.archives, r.forecasts...)
 	if err != nil {
 		return err
 	}
@@ -704,40 +1072,6 @@ func (r *RRD) SaveAs(filename string) error {
 	return nil
 }
 
-// LoadDumpRRD load json-encoded file into new rrd file
-func LoadDumpRRD(input, rrdFilename string) (*RRD, error) {
-	LogDebug("LoadDumpRRD input=%s filename=%s", input, rrdFilename)
-
-	var dump RRDDump
-	data, err := ioutil.ReadFile(input)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := json.Unmarshal(data, &dump); err != nil {
-		return nil, err
-	}
-
-	r, err := NewRRD(rrdFilename, dump.Columns, dump.Archives)
-	if err != nil {
-		return nil, err
-	}
-
-	for _, ad := range dump.Data {
-		for _, row := range ad.Rows {
-			var values []Value
-			for _, v := range row.Values {
-				v.Valid = true
-				values = append(values, v)
-			}
-			if err = r.storage.Put(ad.ArchiveID, row.TS, values...); err != nil {
-				return nil, err
-			}
-		}
-	}
-	return r, err
-}
-
 // ModifyAddColumns add new columns to existing rrd file
 func ModifyAddColumns(filename string, columns []RRDColumn) error {
 	r, err := OpenRRD(filename, true)
@@ -763,7 +1097,7 @@ func ModifyAddColumns(filename string, columns []RRDColumn) error {
 		dstCols = append(dstCols, c)
 	}
 
-	nRRD, err := NewRRD(filename+".new", dstCols, r.archives)
+	nRRD, err := NewRRD(filename+".new", dstCols, r.archives, r.forecasts...)
 	if err != nil {
 		return err
 	}
@@ -810,7 +1144,7 @@ func ModifyDelColumns(filename string, columns []int) error {
 		}
 	}
 
-	nRRD, err := NewRRD(filename+".new", dstCols, r.archives)
+	nRRD, err := NewRRD(filename+".new", dstCols, r.archives, r.forecasts...)
 	if err != nil {
 		return err
 	}
@@ -838,6 +1172,164 @@ func ModifyDelColumns(filename string, columns []int) error {
 	return os.Rename(filename+".new", filename)
 }
 
+// ModifyChangeColumn replace definition of column colIdx in rrd file.
+// When column function is changed, values are converted where possible.
+func ModifyChangeColumn(filename string, colIdx int, col RRDColumn) error {
+	r, err := OpenRRD(filename, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r != nil {
+			r.Close()
+		}
+	}()
+
+	if colIdx < 0 || colIdx >= len(r.columns) {
+		return fmt.Errorf("Invalid column %d", colIdx)
+	}
+
+	dstCols := make([]RRDColumn, len(r.columns))
+	copy(dstCols, r.columns)
+	dstCols[colIdx] = col
+
+	nRRD, err := NewRRD(filename+".new", dstCols, r.archives, r.forecasts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nRRD != nil {
+			nRRD.Close()
+		}
+	}()
+
+	if err := copyData(r, nRRD, nil, nil); err != nil {
+		return err
+	}
+
+	nRRD.Close()
+	nRRD = nil
+	r.Close()
+	r = nil
+
+	LogDebug("delete old file")
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+
+	LogDebug("rename temp file")
+	return os.Rename(filename+".new", filename)
+}
+
+// ModifyReorderColumns change order of columns in rrd file. Order is list of
+// columns indexes in new order; columns not listed are moved after them.
+func ModifyReorderColumns(filename string, order []int) error {
+	r, err := OpenRRD(filename, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r != nil {
+			r.Close()
+		}
+	}()
+
+	colsMap := make(map[int]int)
+	var dstCols []RRDColumn
+	for _, c := range order {
+		if c < 0 || c >= len(r.columns) {
+			return fmt.Errorf("Invalid column %d", c)
+		}
+		if _, ok := colsMap[c]; ok {
+			return fmt.Errorf("Column %d given more than once", c)
+		}
+		colsMap[c] = len(dstCols)
+		dstCols = append(dstCols, r.columns[c])
+	}
+	for c, col := range r.columns {
+		if _, ok := colsMap[c]; !ok {
+			colsMap[c] = len(dstCols)
+			dstCols = append(dstCols, col)
+		}
+	}
+
+	nRRD, err := NewRRD(filename+".new", dstCols, r.archives, r.forecasts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nRRD != nil {
+			nRRD.Close()
+		}
+	}()
+
+	if err := copyDataMap(r, nRRD, colsMap, identityMap(len(r.archives)), nil); err != nil {
+		return err
+	}
+
+	nRRD.Close()
+	nRRD = nil
+	r.Close()
+	r = nil
+
+	LogDebug("delete old file")
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+
+	LogDebug("rename temp file")
+	return os.Rename(filename+".new", filename)
+}
+
+// ModifySetForecasts replace forecasts definitions in rrd file; state of
+// forecasts with unchanged definitions is preserved
+func ModifySetForecasts(filename string, forecasts []RRDForecast) error {
+	r, err := OpenRRD(filename, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r != nil {
+			r.Close()
+		}
+	}()
+
+	names := make(map[string]bool)
+	for _, f := range forecasts {
+		if names[f.Name] {
+			return fmt.Errorf("duplicated forecast name %s", f.Name)
+		}
+		names[f.Name] = true
+	}
+
+	nRRD, err := NewRRD(filename+".new", r.columns, r.archives, forecasts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nRRD != nil {
+			nRRD.Close()
+		}
+	}()
+
+	if err := copyData(r, nRRD, nil, nil); err != nil {
+		return err
+	}
+
+	nRRD.Close()
+	nRRD = nil
+	r.Close()
+	r = nil
+
+	LogDebug("delete old file")
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+
+	LogDebug("rename temp file")
+	return os.Rename(filename+".new", filename)
+}
+
 // ModifyAddArchives add new archives to rrd file
 func ModifyAddArchives(filename string, archs []RRDArchive) error {
 	r, err := OpenRRD(filename, true)
@@ -852,7 +1344,11 @@ func ModifyAddArchives(filename string, archs []RRDArchive) error {
 
 	// TODO check names uniques
 
-	nRRD, err := NewRRD(filename+".new", r.columns, append(r.archives, archs...))
+	// new archives are placed according to step
+	dst := append(append([]RRDArchive(nil), r.archives...), archs...)
+	sorted, archMap := sortArchives(dst)
+
+	nRRD, err := NewRRD(filename+".new", r.columns, sorted, r.forecasts...)
 	if err != nil {
 		return err
 	}
@@ -862,7 +1358,7 @@ func ModifyAddArchives(filename string, archs []RRDArchive) error {
 		}
 	}()
 
-	if err := copyData(r, nRRD, nil, nil); err != nil {
+	if err := copyDataMap(r, nRRD, identityMap(len(r.columns)), archMap, nil); err != nil {
 		return err
 	}
 
@@ -880,6 +1376,58 @@ func ModifyAddArchives(filename string, archs []RRDArchive) error {
 	return os.Rename(filename+".new", filename)
 }
 
+// iterateArchive call fn for each row in archive; when ordered is true rows
+// are loaded into memory and processed in time order, otherwise in storage order
+func iterateArchive(r *RRD, archiveID int, columns []int, ordered bool, fn func(ts int64, values []Value) error) error {
+	iter, err := r.storage.Iterate(archiveID, 0, -1, columns)
+	if err != nil {
+		return err
+	}
+	var rows Rows
+	for {
+		if err := iter.Next(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		values, err := iter.Values()
+		if err != nil {
+			return err
+		}
+		if ordered {
+			rows = append(rows, Row{TS: iter.TS(), Values: values})
+		} else if err := fn(iter.TS(), values); err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].TS < rows[j].TS })
+	for _, row := range rows {
+		if err := fn(row.TS, row.Values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortArchives return archives sorted by step (stable) and map old archive
+// index -> new index
+func sortArchives(archives []RRDArchive) (sorted []RRDArchive, archMap map[int]int) {
+	order := make([]int, len(archives))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return archives[order[i]].Step < archives[order[j]].Step
+	})
+	archMap = make(map[int]int)
+	for newID, oldID := range order {
+		archMap[oldID] = newID
+		sorted = append(sorted, archives[oldID])
+	}
+	return
+}
+
 // ModifyDelArchives delete given archives (and data) from rrd file
 func ModifyDelArchives(filename string, archs []int) error {
 	r, err := OpenRRD(filename, true)
@@ -899,7 +1447,7 @@ func ModifyDelArchives(filename string, archs []int) error {
 		}
 	}
 
-	nRRD, err := NewRRD(filename+".new", r.columns, dstArchs)
+	nRRD, err := NewRRD(filename+".new", r.columns, dstArchs, r.forecasts...)
 	if err != nil {
 		return err
 	}
@@ -952,7 +1500,7 @@ func ModifyResizeArchive(filename string, archiveID int, rows int) error {
 	arch.Rows = int32(rows)
 	dst[archiveID] = arch
 
-	nRRD, err := NewRRD(filename+".new", r.columns, dst)
+	nRRD, err := NewRRD(filename+".new", r.columns, dst, r.forecasts...)
 	if err != nil {
 		return err
 	}
@@ -980,6 +1528,85 @@ func ModifyResizeArchive(filename string, archiveID int, rows int) error {
 	return os.Rename(filename+".new", filename)
 }
 
+// ModifyChangeArchive rename archive and/or change its step.
+// Existing rows are resampled into new step using columns functions; number of
+// rows is recalculated to keep archive retention. Archives are reordered from
+// the finest to the coarsest step.
+func ModifyChangeArchive(filename string, archiveID int, name string, step int64) error {
+	r, err := OpenRRD(filename, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r != nil {
+			r.Close()
+		}
+	}()
+
+	if archiveID < 0 || archiveID >= len(r.archives) {
+		return errors.New("Invalid archive number")
+	}
+
+	arch := r.archives[archiveID]
+	if name != "" && name != arch.Name {
+		if len(name) > 16 {
+			name = name[:16]
+		}
+		if _, ok := r.GetArchiveIdx(name); ok {
+			return fmt.Errorf("Archive %s already exists", name)
+		}
+		arch.Name = name
+	}
+	if step > 0 {
+		arch.Rows = arch.rowsForStep(step)
+		arch.Step = step
+	}
+	if arch == r.archives[archiveID] {
+		return errors.New("Archive not changed")
+	}
+
+	dst := make([]RRDArchive, len(r.archives))
+	copy(dst, r.archives)
+	dst[archiveID] = arch
+
+	// keep archives sorted by step
+	sorted, archMap := sortArchives(dst)
+
+	nRRD, err := NewRRD(filename+".new", r.columns, sorted, r.forecasts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if nRRD != nil {
+			nRRD.Close()
+		}
+	}()
+
+	resample := func(col RRDColumn, prev, value Value) Value {
+		return col.Function.Merge(prev, value)
+	}
+	if err := copyDataMap(r, nRRD, identityMap(len(r.columns)), archMap, resample); err != nil {
+		return err
+	}
+	// resampling don't change forecasts - copy state and predictions
+	if err := copyForecasts(r, nRRD, identityMap(len(r.columns))); err != nil {
+		return err
+	}
+
+	nRRD.Close()
+	nRRD = nil
+	r.Close()
+	r = nil
+
+	LogDebug("delete old file")
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+
+	LogDebug("rename temp file")
+	return os.Rename(filename+".new", filename)
+}
+
 // UpdateRRD update version of file
 func UpdateRRD(filename string) error {
 	r, err := OpenRRD(filename, true)
@@ -992,7 +1619,7 @@ func UpdateRRD(filename string) error {
 		}
 	}()
 
-	nRRD, err := NewRRD(filename+".new", r.columns, r.archives)
+	nRRD, err := NewRRD(filename+".new", r.columns, r.archives, r.forecasts...)
 	if err != nil {
 		return err
 	}
@@ -1020,6 +1647,11 @@ func UpdateRRD(filename string) error {
 	return os.Rename(filename+".new", filename)
 }
 
+// InRange check is value in column min-max range
+func (c *RRDColumn) InRange(v float32) bool {
+	return (!c.HasMinimum || c.Minimum <= v) && (!c.HasMaximum || c.Maximum >= v)
+}
+
 func (a *RRDArchive) calcTS(ts int64) (ats int64) {
 	if ts < 1 {
 		return ts
@@ -1027,6 +1659,15 @@ func (a *RRDArchive) calcTS(ts int64) (ats int64) {
 	return int64(ts/a.Step) * a.Step
 }
 
+// rowsForStep return number of rows that keep archive retention with new step
+func (a *RRDArchive) rowsForStep(step int64) int32 {
+	rows := (int64(a.Rows)*a.Step + step - 1) / step
+	if rows < 1 {
+		rows = 1
+	}
+	return int32(rows)
+}
+
 func (r Rows) Len() int           { return len(r) }
 func (r Rows) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
 func (r Rows) Less(i, j int) bool { return r[i].TS < r[j].TS }
@@ -1036,17 +1677,21 @@ func fillData(minTS, maxTS, step int64, values Rows, columns []int) Rows {
 		step, len(values))
 
 	var result Rows
-	emptyRowValues := make([]Value, 0, len(columns))
-	for _, c := range columns {
-		emptyRowValues = append(emptyRowValues, Value{
-			Valid:  false,
-			Column: c,
-		})
+	emptyRow := func(ts int64) Row {
+		row := Row{TS: ts, Values: make([]Value, 0, len(columns))}
+		for _, c := range columns {
+			row.Values = append(row.Values, Value{
+				TS:     ts,
+				Valid:  false,
+				Column: c,
+			})
+		}
+		return row
 	}
 
 	if len(values) == 0 {
 		for ts := minTS; ts <= maxTS; ts = ts + step {
-			result = append(result, Row{TS: ts, Values: emptyRowValues})
+			result = append(result, emptyRow(ts))
 		}
 		return result
 	}
@@ -1058,55 +1703,96 @@ func fillData(minTS, maxTS, step int64, values Rows, columns []int) Rows {
 			result = append(result, values[vidx])
 			vidx++
 		} else {
-			result = append(result, Row{TS: ts, Values: emptyRowValues})
+			result = append(result, emptyRow(ts))
 		}
 		ts += step
 	}
 	return result
 }
 
+func removeEmptyRows(rows Rows) (out Rows) {
+	for _, row := range rows {
+		for _, v := range row.Values {
+			if v.Valid {
+				out = append(out, row)
+				break
+			}
+		}
+	}
+	return
+}
+
 func copyData(src, dst *RRD, skipColumns []int, skipArchives []int) error {
 	LogDebug("copy data")
-	var cols []int
-	var colsMap map[int]int
-	if len(skipColumns) > 0 {
-		colsMap = make(map[int]int)
-		for c := 0; c < len(src.columns); c++ {
-			if !InList(c, skipColumns) {
-				colsMap[c] = len(cols)
-				cols = append(cols, c)
-			}
+	colsMap := make(map[int]int)
+	for c := 0; c < len(src.columns); c++ {
+		if !InList(c, skipColumns) {
+			colsMap[c] = len(colsMap)
+		}
+	}
+	archMap := make(map[int]int)
+	for aID := range src.archives {
+		if !InList(aID, skipArchives) {
+			archMap[aID] = len(archMap)
+		}
+	}
+	return copyDataMap(src, dst, colsMap, archMap, nil)
+}
+
+// mergeFunc combine value existing in destination file with new value
+type mergeFunc func(col RRDColumn, prev, value Value) Value
+
+// copyDataMap copy data from src to dst using maps src id -> dst id for
+// columns and archives; not mapped columns and archives are skipped.
+// Time stamps are aligned to step of destination archive.
+// When merge is given, copied values are combined with values existing in dst.
+func copyDataMap(src, dst *RRD, colsMap, archMap map[int]int, merge mergeFunc) error {
+	LogDebug("copyDataMap colsMap=%v, archMap=%v", colsMap, archMap)
+	var cols, dstCols []int
+	for c := 0; c < len(src.columns); c++ {
+		if dc, ok := colsMap[c]; ok {
+			cols = append(cols, c)
+			dstCols = append(dstCols, dc)
 		}
-	} else {
-		cols = src.allColumnsIDs()
 	}
 
-	dstAID := 0
 	for aID := range src.archives {
-		if InList(aID, skipArchives) {
+		dstAID, ok := archMap[aID]
+		if !ok {
 			continue
 		}
 
-		iter, _ := src.storage.Iterate(aID, 0, -1, cols)
-		for {
-			err := iter.Next()
-			if err == io.EOF {
-				break
+		// merged rows must be processed in time order (ring may be wrapped)
+		err := iterateArchive(src, aID, cols, merge != nil, func(srcTS int64, values []Value) error {
+			for i, v := range values {
+				v.Column = dstCols[i]
+				values[i] = dst.columns[v.Column].Function.Convert(src.columns[cols[i]].Function, v)
 			}
-			values, _ := iter.Values()
-			if colsMap != nil {
-				var vOut []Value
-				for _, v := range values {
-					v.Column = colsMap[v.Column]
-					vOut = append(vOut, v)
+			ts := dst.archives[dstAID].calcTS(srcTS)
+			if merge != nil {
+				prev, err := dst.storage.Get(dstAID, ts, dstCols)
+				if err != nil {
+					return err
+				}
+				for i, pv := range prev {
+					values[i] = merge(dst.columns[dstCols[i]], pv, values[i])
 				}
-				values = vOut
 			}
-			if err = dst.storage.Put(dstAID, iter.TS(), values...); err != nil {
+			if err := dst.storage.Put(dstAID, ts, values...); err != nil {
+				if err == errOlderValue {
+					LogDebug("copyDataMap skipping older row %d in archive %d", ts, aID)
+					return nil
+				}
 				return err
 			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		dstAID++
+	}
+	if merge == nil {
+		return copyForecasts(src, dst, colsMap)
 	}
 	return nil
 }
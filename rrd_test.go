@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -984,6 +988,213 @@ func TestModDelColumn(t *testing.T) {
 	}
 }
 
+func TestModReorderColumns(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	if err := putTestData(r, 20, 0, 1, 2, 3, 4, 5); err != nil {
+		t.Errorf("Put data error: %v", err)
+		return
+	}
+	closeTestDb(t, r)
+
+	if err := ModifyReorderColumns("tmp.rdb", []int{5, 0}); err != nil {
+		t.Errorf("ModifyReorderColumns error: %s", err.Error())
+		return
+	}
+	if err := ModifyReorderColumns("tmp.rdb", []int{1, 1}); err == nil {
+		t.Errorf("missing error for duplicated column")
+	}
+
+	r2, _ := OpenRRD("tmp.rdb", true)
+	defer r2.Close()
+	cols := []string{"col6", "col1", "col2", "col3", "col4", "col5"}
+	srcCols := []int{5, 0, 1, 2, 3, 4}
+	for idx, name := range cols {
+		if c := r2.GetColumn(idx); c.Name != name {
+			t.Errorf("invalid column %d: %v", idx, c)
+		}
+	}
+	vs, err := r2.getFromArchive(0, 15, r2.allColumnsIDs())
+	if err != nil || len(vs) != 6 {
+		t.Errorf("Get error: %v, %v", err, vs)
+		return
+	}
+	for idx, v := range vs {
+		exp := float32(15 + srcCols[idx] + 1)
+		if srcCols[idx] == 5 { // count
+			exp = 1
+		}
+		for _, err := range checkValue(v, exp, 15, true, 0, idx) {
+			t.Error(err)
+		}
+	}
+}
+
+func TestModChangeColumnFunction(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	if err := putTestData(r, 20, 1); err != nil {
+		t.Errorf("Put data error: %v", err)
+		return
+	}
+	col := r.GetColumn(1)
+	closeTestDb(t, r)
+
+	col.Function = FCount
+	if err := ModifyChangeColumn("tmp.rdb", 1, col); err != nil {
+		t.Errorf("ModifyChangeColumn error: %s", err.Error())
+		return
+	}
+
+	r2, _ := OpenRRD("tmp.rdb", true)
+	defer r2.Close()
+	if c := r2.GetColumn(1); c.Function != FCount {
+		t.Errorf("function not changed: %v", c)
+	}
+	// archive 1 keeps 10 values in each row
+	vs, err := r2.getFromArchive(1, 10, []int{1})
+	if err != nil || len(vs) != 1 {
+		t.Errorf("Get error: %v, %v", err, vs)
+		return
+	}
+	if vs[0].Value != 10 || vs[0].Counter != 10 {
+		t.Errorf("wrong value after function change: %v", vs[0])
+	}
+
+	convs := []struct {
+		from, to Function
+		value    float32
+		expected float32
+	}{
+		{FAverage, FSum, 2.5, 10},
+		{FSum, FAverage, 10, 2.5},
+		{FAverage, FCount, 2.5, 4},
+		{FSum, FCount, 10, 4},
+		{FMaximum, FSum, 3, 3},
+	}
+	for _, c := range convs {
+		v := c.to.Convert(c.from, Value{Value: c.value, Counter: 4, Valid: true})
+		if v.Value != c.expected || v.Counter != 4 {
+			t.Errorf("wrong conversion %s -> %s: %v, expected %v", c.from, c.to, v.Value, c.expected)
+		}
+	}
+}
+
+func TestSchemaApply(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	if err := putTestData(r, 20, 0, 1); err != nil {
+		t.Errorf("Put data error: %v", err)
+		return
+	}
+
+	schemaDef := `{
+		"columns": [
+			{"name": "new1", "function": "sum"},
+			{"name": "col2", "function": "max"},
+			{"name": "col1", "function": "last", "min": 0, "max": 1000000},
+			{"name": "col5", "function": "maximum"},
+			{"name": "col6", "function": "count"}
+		],
+		"archives": [
+			{"name": "a0", "step": 1, "rows": 20},
+			{"name": "a1", "step": 5, "rows": 10},
+			{"name": "a3", "step": 1000, "rows": 5}
+		]}`
+	var schema Schema
+	if err := json.Unmarshal([]byte(schemaDef), &schema); err != nil {
+		t.Errorf("Unmarshal schema error: %s", err.Error())
+		return
+	}
+	changes, err := PlanSchemaChanges(r, &schema)
+	closeTestDb(t, r)
+	if err != nil {
+		t.Errorf("PlanSchemaChanges error: %s", err.Error())
+		return
+	}
+	// del columns, change col2, add new1, reorder, del a2, step a1 (keeps retention),
+	// resize a0 and a1, add a3
+	if len(changes) != 9 {
+		for _, ch := range changes {
+			t.Log(ch.Description)
+		}
+		t.Errorf("wrong number of changes: %d", len(changes))
+	}
+	if err := ApplySchemaChanges("tmp.rdb", changes); err != nil {
+		t.Errorf("ApplySchemaChanges error: %s", err.Error())
+		return
+	}
+
+	r2, _ := OpenRRD("tmp.rdb", true)
+	defer r2.Close()
+	expCols, _ := schema.RRDColumns()
+	for idx, c := range expCols {
+		if !sameColumn(r2.GetColumn(idx), c) {
+			t.Errorf("wrong column %d: %v, expected %v", idx, r2.GetColumn(idx), c)
+		}
+	}
+	expArchs, _ := schema.RRDArchives()
+	if len(r2.archives) != len(expArchs) {
+		t.Errorf("wrong archives: %v", r2.archives)
+	} else {
+		for idx, a := range expArchs {
+			if r2.archives[idx] != a {
+				t.Errorf("wrong archive %d: %v, expected %v", idx, r2.archives[idx], a)
+			}
+		}
+	}
+	vs, err := r2.getFromArchive(0, 15, []int{2})
+	if err != nil || len(vs) != 1 || vs[0].Value != 16 {
+		t.Errorf("wrong value in col1: %v, %v", vs, err)
+	}
+
+	// nothing to do
+	if changes, _ = PlanSchemaChanges(r2, &schema); len(changes) != 0 {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+}
+
+func TestLoadRRDSchema(t *testing.T) {
+	forecasts, _ := ParseForecastDef("1:10:50:f1")
+	r, err := NewRRD("tmp.rdb", []RRDColumn{{Name: "c1", Function: FLast, HasMinimum: true, Minimum: 1},
+		{Name: "c2", Function: FSum}},
+		[]RRDArchive{{Name: "a0", Step: 1, Rows: 100}, {Name: "a1", Step: 60, Rows: 10}}, forecasts...)
+	if err != nil {
+		t.Fatalf("NewRRD error: %s", err.Error())
+	}
+	closeTestDb(t, r)
+
+	// like init --like
+	columns, archives, fcs, err := LoadRRDSchema("tmp.rdb")
+	if err != nil {
+		t.Fatalf("LoadRRDSchema error: %s", err.Error())
+	}
+	os.Remove("tmp2.rdb")
+	r2, err := NewRRD("tmp2.rdb", columns, archives, fcs...)
+	if err != nil {
+		t.Fatalf("NewRRD error: %s", err.Error())
+	}
+	closeTestDb(t, r2)
+
+	r, _ = OpenRRD("tmp.rdb", true)
+	defer closeTestDb(t, r)
+	r2, err = OpenRRD("tmp2.rdb", true)
+	if err != nil {
+		t.Fatalf("OpenRRD error: %s", err.Error())
+	}
+	defer closeTestDb(t, r2)
+	if fmt.Sprintf("%+v", r2.Columns()) != fmt.Sprintf("%+v", r.Columns()) {
+		t.Errorf("wrong columns: %+v, expected %+v", r2.Columns(), r.Columns())
+	}
+	if fmt.Sprintf("%+v", r2.Archives()) != fmt.Sprintf("%+v", r.Archives()) {
+		t.Errorf("wrong archives: %+v, expected %+v", r2.Archives(), r.Archives())
+	}
+	if len(r2.Forecasts()) != 1 || fmt.Sprintf("%+v", r2.Forecasts()) != fmt.Sprintf("%+v", r.Forecasts()) {
+		t.Errorf("wrong forecasts: %+v, expected %+v", r2.Forecasts(), r.Forecasts())
+	}
+
+	if _, _, _, err := LoadRRDSchema("missing.rdb"); err == nil {
+		t.Errorf("missing error for not existing file")
+	}
+}
+
 func TestSaveAs(t *testing.T) {
 	r, _, _ := createTestDB(t)
 	defer closeTestDb(t, r)
@@ -1022,7 +1233,7 @@ func TestDumpLoad(t *testing.T) {
 		t.Errorf("Put data error: %v", err)
 		return
 	}
-	if err := r.Dump("tmp2.dump"); err != nil {
+	if err := r.Dump("tmp2.dump", false); err != nil {
 		t.Errorf("Dump error: %s", err.Error())
 		return
 	}
@@ -1030,7 +1241,7 @@ func TestDumpLoad(t *testing.T) {
 	r.Close()
 	r = nil
 
-	r, err := LoadDumpRRD("tmp2.dump", "tmp2.rdb")
+	r, err := LoadDumpRRD("tmp2.dump", "tmp2.rdb", false)
 	closeTestDb(t, r)
 	if err != nil {
 		t.Errorf("LoadDumpRRD error: %s", err.Error())
@@ -1051,6 +1262,1394 @@ func TestDumpLoad(t *testing.T) {
 
 }
 
+func TestDumpLoadGzip(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	defer closeTestDb(t, r)
+	if err := putTestData(r, 100, 0, 1, 2, 3, 4, 5); err != nil {
+		t.Errorf("Put data error: %v", err)
+		return
+	}
+	if err := r.Dump("tmp2.dump.gz", false); err != nil {
+		t.Errorf("Dump error: %s", err.Error())
+		return
+	}
+
+	// dump should be readable as one json document
+	var buf bytes.Buffer
+	if err := r.DumpTo(&buf); err != nil {
+		t.Errorf("DumpTo error: %s", err.Error())
+		return
+	}
+	var dump RRDDump
+	if err := json.Unmarshal(buf.Bytes(), &dump); err != nil {
+		t.Errorf("Unmarshal dump error: %s", err.Error())
+		return
+	}
+	if len(dump.Columns) != 6 || len(dump.Archives) != 3 || len(dump.Data) != 3 {
+		t.Errorf("invalid dump content: %d, %d, %d", len(dump.Columns), len(dump.Archives), len(dump.Data))
+	}
+	if len(dump.Data[0].Rows) != 10 || len(dump.Data[0].Rows[0].Values) != 6 {
+		t.Errorf("invalid dump rows: %v", dump.Data[0].Rows)
+	}
+
+	r.Close()
+	r = nil
+
+	r, err := LoadDumpRRD("tmp2.dump.gz", "tmp2.rdb", false)
+	closeTestDb(t, r)
+	if err != nil {
+		t.Errorf("LoadDumpRRD error: %s", err.Error())
+		return
+	}
+
+	r1, _ := ioutil.ReadFile("tmp.rdb")
+	r2, _ := ioutil.ReadFile("tmp2.rdb")
+	if !bytes.Equal(r1, r2) {
+		t.Errorf("different files")
+	}
+}
+
+func TestDumpLoadInvalid(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	defer closeTestDb(t, r)
+	// only column 1 has values; others are invalid
+	if err := putTestData(r, 20, 1); err != nil {
+		t.Errorf("Put data error: %v", err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := r.DumpTo(&buf); err != nil {
+		t.Errorf("DumpTo error: %s", err.Error())
+		return
+	}
+	r.Close()
+	r = nil
+
+	r2, err := LoadDump(&buf, "tmp2.rdb", false)
+	defer closeTestDb(t, r2)
+	if err != nil {
+		t.Errorf("LoadDump error: %s", err.Error())
+		return
+	}
+	vs, err := r2.Get(15, 0, 1)
+	if err != nil || len(vs) != 2 {
+		t.Errorf("Get error: %v, %v", err, vs)
+		return
+	}
+	for _, err := range checkValue(vs[0], 0, 15, false, 0, 0) {
+		t.Error(err)
+	}
+	for _, err := range checkValue(vs[1], 17, 15, true, 0, 1) {
+		t.Error(err)
+	}
+	if vs[1].Counter != 1 {
+		t.Errorf("wrong counter: %v", vs[1])
+	}
+}
+
+func TestDumpForecasts(t *testing.T) {
+	forecasts, _ := ParseForecastDef("1:10:50")
+	r, err := NewRRD("tmp.rdb", []RRDColumn{{Name: "c1", Function: FLast}},
+		[]RRDArchive{{Name: "a0", Step: 1, Rows: 100}}, forecasts...)
+	if err != nil {
+		t.Fatalf("NewRRD error: %s", err.Error())
+	}
+	defer closeTestDb(t, r)
+	for ts := int64(1); ts <= 40; ts++ {
+		if err := r.Put(ts, 0, float32(10+ts%10)); err != nil {
+			t.Fatalf("Put error: %s", err.Error())
+		}
+	}
+	var buf bytes.Buffer
+	if err := r.DumpTo(&buf); err != nil {
+		t.Fatalf("DumpTo error: %s", err.Error())
+	}
+
+	r2, err := LoadDump(&buf, "tmp2.rdb", false)
+	defer closeTestDb(t, r2)
+	if err != nil {
+		t.Fatalf("LoadDump error: %s", err.Error())
+	}
+	state, _ := r.storage.LoadForecastState(0)
+	state2, err := r2.storage.LoadForecastState(0)
+	if err != nil || state2.LastTS != state.LastTS || state2.Columns[0].Level != state.Columns[0].Level ||
+		state2.Columns[0].Seasonal[3] != state.Columns[0].Seasonal[3] {
+		t.Errorf("forecast state not loaded: %+v, %v", state2, err)
+	}
+	fr, _ := r.GetForecastRange(0, 0, -1, nil)
+	fr2, _ := r2.GetForecastRange(0, 0, -1, nil)
+	if len(fr2.Rows) != len(fr.Rows) || len(fr.Rows) == 0 {
+		t.Fatalf("forecast rows not loaded: %d, expected %d", len(fr2.Rows), len(fr.Rows))
+	}
+	last, last2 := fr.Rows[len(fr.Rows)-1].Values[0], fr2.Rows[len(fr2.Rows)-1].Values[0]
+	if last != last2 {
+		t.Errorf("wrong forecast value: %+v, expected %+v", last2, last)
+	}
+}
+
+func TestLoadDumpV1Validate(t *testing.T) {
+	dump := `{"Columns": [{"Name": "c1", "Function": 0, "Minimum": 0, "HasMinimum": true, "Maximum": 10, "HasMaximum": true}],
+		"Archives": [{"Name": "a0", "Step": 1, "Rows": 10}],
+		"Data": [{"ArchiveID": 0, "Rows": [
+			{"TS": 1, "Values": [{"Value": 5, "Counter": 2, "Column": 0}]},
+			{"TS": 2, "Values": [{"Value": 50, "Counter": 1, "Column": 0}]}]}]}`
+
+	r, err := LoadDump(strings.NewReader(dump), "tmp2.rdb", true)
+	defer closeTestDb(t, r)
+	if err != nil {
+		t.Errorf("LoadDump error: %s", err.Error())
+		return
+	}
+	if vs, _ := r.Get(1, 0); len(vs) != 1 || !vs[0].Valid || vs[0].Value != 5 || vs[0].Counter != 2 {
+		t.Errorf("wrong value for ts=1: %v", vs)
+	}
+	if vs, _ := r.Get(2, 0); len(vs) != 1 || vs[0].Valid {
+		t.Errorf("value out of range should be invalid: %v", vs)
+	}
+
+	bad := strings.Replace(dump, `"Column": 0}]}]}]}`, `"Column": 3}]}]}]}`, 1)
+	r3, err := LoadDump(strings.NewReader(bad), "tmp3.rdb", false)
+	closeTestDb(t, r3)
+	if err == nil {
+		t.Errorf("missing error for invalid column")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	r, c, a := createTestDB(t)
+	if errors := putTestDataInts(r, []int{1, 2, 3, 4, 5}, 0, 1); len(errors) > 0 {
+		t.Errorf("Put data error: %v", errors)
+		return
+	}
+	closeTestDb(t, r)
+
+	r2, err := NewRRD("tmp3.rdb", c, a)
+	if err != nil {
+		t.Errorf("NewRRD error: %s", err.Error())
+		return
+	}
+	for ts := 4; ts <= 8; ts++ {
+		if err := r2.Put(int64(ts), 1, float32(ts*10)); err != nil {
+			t.Errorf("Put error: %s", err.Error())
+		}
+	}
+	closeTestDb(t, r2)
+
+	data := []struct {
+		policy   MergePolicy
+		sources  []string
+		expected map[int64]float32
+	}{
+		{MergeNewer, []string{"tmp3.rdb", "tmp.rdb"}, map[int64]float32{3: 3, 4: 40, 5: 50, 8: 80}},
+		{MergeFirst, []string{"tmp.rdb", "tmp3.rdb"}, map[int64]float32{3: 3, 4: 4, 5: 5, 8: 80}},
+		{MergeFunction, []string{"tmp.rdb", "tmp3.rdb"}, map[int64]float32{3: 3, 4: 22, 5: 27.5, 8: 80}},
+	}
+	for _, d := range data {
+		os.Remove("tmp2.rdb")
+		if err := MergeRRD("tmp2.rdb", d.sources, d.policy); err != nil {
+			t.Errorf("MergeRRD %s error: %s", d.policy, err.Error())
+			continue
+		}
+		m, err := OpenRRD("tmp2.rdb", true)
+		if err != nil {
+			t.Errorf("OpenRRD error: %s", err.Error())
+			continue
+		}
+		for ts, exp := range d.expected {
+			vs, err := m.getFromArchive(0, ts, []int{1})
+			if err != nil || len(vs) != 1 || !vs[0].Valid || vs[0].Value != exp {
+				t.Errorf("policy %s: wrong value for ts=%d: %v, expected %v (%v)", d.policy, ts, vs, exp, err)
+			}
+		}
+		// column 0 exists only in tmp.rdb
+		if vs, _ := m.getFromArchive(0, 4, []int{0}); len(vs) != 1 || !vs[0].Valid || vs[0].Value != 4 {
+			t.Errorf("policy %s: wrong value for column 0: %v", d.policy, vs)
+		}
+		m.Close()
+	}
+
+	// incompatible schema
+	os.Remove("tmp3.rdb")
+	r3, _ := NewRRD("tmp3.rdb", c[:2], a)
+	closeTestDb(t, r3)
+	os.Remove("tmp2.rdb")
+	if err := MergeRRD("tmp2.rdb", []string{"tmp.rdb", "tmp3.rdb"}, MergeNewer); err == nil {
+		t.Errorf("missing error for incompatible files")
+	}
+
+	// different archive retention
+	os.Remove("tmp3.rdb")
+	a2 := append([]RRDArchive(nil), a...)
+	a2[1].Rows *= 2
+	r4, _ := NewRRD("tmp3.rdb", c, a2)
+	closeTestDb(t, r4)
+	os.Remove("tmp2.rdb")
+	if err := MergeRRD("tmp2.rdb", []string{"tmp.rdb", "tmp3.rdb"}, MergeNewer); err == nil {
+		t.Errorf("missing error for archives with different rows")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	defer closeTestDb(t, r)
+	if errors := putTestDataInts(r, []int{1, 2, 3, 4, 5, 6}, 0, 1); len(errors) > 0 {
+		t.Errorf("Put data error: %v", errors)
+		return
+	}
+
+	// only column 1 in archive 0
+	purged, err := r.Purge(3, 4, []int{1}, []int{0})
+	if err != nil || purged != 2 {
+		t.Errorf("Purge error: %v, purged=%d", err, purged)
+	}
+	for ts := int64(1); ts <= 6; ts++ {
+		vs, _ := r.getFromArchive(0, ts, []int{0, 1})
+		if len(vs) != 2 || !vs[0].Valid {
+			t.Errorf("wrong values for ts=%d: %v", ts, vs)
+			continue
+		}
+		if purgedTS := ts == 3 || ts == 4; vs[1].Valid == purgedTS || (purgedTS && vs[1].Counter != 0) {
+			t.Errorf("wrong column 1 value for ts=%d: %v", ts, vs[1])
+		}
+	}
+	if vs, _ := r.getFromArchive(1, 0, []int{1}); len(vs) != 1 || !vs[0].Valid {
+		t.Errorf("archive 1 should not be purged: %v", vs)
+	}
+
+	// all columns and archives
+	if purged, err = r.Purge(5, 5, nil, nil); err != nil || purged != 3 {
+		t.Errorf("Purge error: %v, purged=%d", err, purged)
+	}
+	for aID := range r.archives {
+		vs, _ := r.getFromArchive(aID, 5, []int{0, 1})
+		if len(vs) != 2 || vs[0].Valid || vs[1].Valid {
+			t.Errorf("archive %d: values not purged: %v", aID, vs)
+		}
+	}
+	if vs, _ := r.getFromArchive(0, 6, []int{0}); len(vs) != 1 || !vs[0].Valid {
+		t.Errorf("value out of range purged: %v", vs)
+	}
+}
+
+func TestSetValues(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	defer closeTestDb(t, r)
+	for ts := 10; ts < 20; ts++ {
+		if err := r.PutValues(Value{TS: int64(ts), Column: 1, Value: 10, Valid: true},
+			Value{TS: int64(ts), Column: 2, Value: 10, Valid: true}); err != nil {
+			t.Errorf("Put error: %s", err.Error())
+		}
+	}
+	// bad value put twice
+	r.Put(12, 1, 110)
+
+	if err := r.SetValues(0, true, Value{TS: 12, Column: 1, Value: 20}, Value{TS: 12, Column: 2, Value: 20}); err != nil {
+		t.Errorf("SetValues error: %s", err.Error())
+		return
+	}
+
+	vs, _ := r.getFromArchive(0, 12, []int{1, 2})
+	if len(vs) != 2 || !vs[0].Valid || vs[0].Value != 20 || vs[0].Counter != 1 || vs[1].Value != 20 {
+		t.Errorf("wrong values in archive 0: %v", vs)
+	}
+	// archive 1 recalculated from archive 0; archive 2 from archive 1
+	for aID, exp := range map[int][]float32{1: {11, 110}, 2: {11, 110}} {
+		vs, _ = r.getFromArchive(aID, 12, []int{1, 2})
+		if len(vs) != 2 || vs[0].Value != exp[0] || vs[0].Counter != 10 || vs[1].Value != exp[1] {
+			t.Errorf("wrong values in archive %d: %v, expected %v", aID, vs, exp)
+		}
+	}
+
+	// without rederive
+	if err := r.SetValues(1, false, Value{TS: 15, Column: 1, Value: 5, Counter: 3}); err != nil {
+		t.Errorf("SetValues error: %s", err.Error())
+	}
+	if vs, _ = r.getFromArchive(1, 15, []int{1}); len(vs) != 1 || vs[0].Value != 5 || vs[0].Counter != 3 {
+		t.Errorf("wrong values in archive 1: %v", vs)
+	}
+	if vs, _ = r.getFromArchive(2, 15, []int{1}); len(vs) != 1 || vs[0].Value != 11 {
+		t.Errorf("archive 2 should not be changed: %v", vs)
+	}
+
+	// out of range and too old
+	if err := r.SetValues(0, true, Value{TS: 12, Column: 0, Value: -1}); err == nil {
+		t.Errorf("missing error for value out of range")
+	}
+	r.Put(102, 1, 1)
+	if err := r.SetValues(0, true, Value{TS: 12, Column: 1, Value: 1}); err == nil {
+		t.Errorf("missing error for overwritten row")
+	}
+}
+
+func TestGetRangeFill(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	defer closeTestDb(t, r)
+	// gaps: 3-4 (2s), 6-8 (3s)
+	if errors := putTestDataInts(r, []int{1, 2, 5, 9, 10}, 0); len(errors) > 0 {
+		t.Errorf("Put data error: %v", errors)
+		return
+	}
+
+	data := []struct {
+		opts     RangeOptions
+		expected []float32 // -1 = invalid
+	}{
+		{RangeOptions{Fill: FillNone, IncludeInvalid: true}, []float32{1, 2, -1, -1, 5, -1, -1, -1, 9, 10}},
+		{RangeOptions{Fill: FillPrevious}, []float32{1, 2, 2, 2, 5, 5, 5, 5, 9, 10}},
+		{RangeOptions{Fill: FillLinear}, []float32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{RangeOptions{Fill: FillZero, MaxGap: 2, IncludeInvalid: true}, []float32{1, 2, 0, 0, 5, -1, -1, -1, 9, 10}},
+		{RangeOptions{Fill: FillConstant, FillValue: 7, MaxGap: 2}, []float32{1, 2, 7, 7, 5, 9, 10}},
+	}
+	for _, d := range data {
+		rows, err := r.GetRangeOpts(1, 10, []int{0}, d.opts)
+		if err != nil {
+			t.Errorf("GetRangeOpts %+v error: %s", d.opts, err.Error())
+			continue
+		}
+		if len(rows) != len(d.expected) {
+			t.Errorf("GetRangeOpts %+v wrong number of rows: %v", d.opts, rows)
+			continue
+		}
+		for i, exp := range d.expected {
+			v := rows[i].Values[0]
+			if (exp < 0 && v.Valid) || (exp >= 0 && (!v.Valid || v.Value != exp)) {
+				t.Errorf("GetRangeOpts %+v wrong value on %d: %v, expected %v", d.opts, i, v, exp)
+			}
+		}
+	}
+
+	// range before first and after last stored value is not filled
+	data = []struct {
+		opts     RangeOptions
+		expected []float32 // -1 = invalid
+	}{
+		{RangeOptions{Fill: FillPrevious}, []float32{1, 2, 2, 2, 5, 5, 5, 5, 9, 10}},
+		{RangeOptions{Fill: FillZero, IncludeInvalid: true}, []float32{-1, 1, 2, 0, 0, 5, 0, 0, 0, 9, 10, -1, -1, -1}},
+		{RangeOptions{Fill: FillConstant, FillValue: 7, IncludeInvalid: true}, []float32{-1, 1, 2, 7, 7, 5, 7, 7, 7, 9, 10, -1, -1, -1}},
+	}
+	for _, d := range data {
+		rows, err := r.GetRangeOpts(0, 13, []int{0}, d.opts)
+		if err != nil || len(rows) != len(d.expected) {
+			t.Errorf("GetRangeOpts %+v wrong rows: %v, %v", d.opts, rows, err)
+			continue
+		}
+		for i, exp := range d.expected {
+			v := rows[i].Values[0]
+			if (exp < 0 && v.Valid) || (exp >= 0 && (!v.Valid || v.Value != exp)) {
+				t.Errorf("GetRangeOpts %+v wrong value on %d: %v, expected %v", d.opts, i, v, exp)
+			}
+		}
+	}
+
+	if p, v, err := ParseFill("2.5"); err != nil || p != FillConstant || v != 2.5 {
+		t.Errorf("ParseFill error: %v %v %v", p, v, err)
+	}
+}
+
+func TestGetRangeStitch(t *testing.T) {
+	c := []RRDColumn{RRDColumn{Name: "col1", Function: FAverage}}
+	a := []RRDArchive{
+		RRDArchive{Name: "a0", Step: 1, Rows: 30},
+		RRDArchive{Name: "a1", Step: 10, Rows: 30},
+		RRDArchive{Name: "a2", Step: 100, Rows: 10},
+	}
+	r, err := NewRRD("tmp.rdb", c, a)
+	if err != nil {
+		t.Errorf("NewRRD error: %s", err.Error())
+		return
+	}
+	defer closeTestDb(t, r)
+	var ts []int
+	for i := 1; i <= 300; i++ {
+		ts = append(ts, i)
+	}
+	if errors := putTestDataInts(r, ts, 0); len(errors) > 0 {
+		t.Errorf("Put data error: %v", errors)
+		return
+	}
+
+	// archive 0 keeps 271-300, archive 1: 10-300, archive 2: 0-300;
+	// boundaries aligned to coarser step: 0-99 from a2, 100-279 from a1, 280-300 from a0
+	rows, err := r.GetRangeOpts(0, 300, []int{0}, RangeOptions{Stitch: true})
+	if err != nil {
+		t.Errorf("GetRangeOpts error: %s", err.Error())
+		return
+	}
+	lastTS := int64(-1)
+	archCnt := make(map[int]int)
+	for _, row := range rows {
+		if row.TS <= lastTS {
+			t.Errorf("rows not ordered: %v", rows)
+			break
+		}
+		lastTS = row.TS
+		archCnt[row.Values[0].ArchiveID]++
+	}
+	if archCnt[0] != 21 || archCnt[1] != 18 || archCnt[2] != 1 {
+		t.Errorf("wrong rows from archives: %v; rows: %v", archCnt, rows)
+	}
+	if last := rows[len(rows)-1]; last.TS != 300 || last.Values[0].Value != 300 {
+		t.Errorf("wrong last row: %v", last)
+	}
+	if first := rows[0]; first.TS != 0 || first.Values[0].Value != 50 || first.Values[0].ArchiveID != 2 {
+		t.Errorf("wrong first row: %v", first)
+	}
+}
+
+func TestGetRangeStep(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	defer closeTestDb(t, r)
+	var ts []int
+	for i := 0; i < 100; i++ {
+		ts = append(ts, i)
+	}
+	if errors := putTestDataInts(r, ts, 1, 2, 3); len(errors) > 0 {
+		t.Errorf("Put data error: %v", errors)
+		return
+	}
+
+	// archive 1 (step 10) keeps data from 0; consolidated to step 20
+	rows, err := r.GetRangeOpts(0, 99, []int{1, 2, 3}, RangeOptions{Step: 20})
+	if err != nil {
+		t.Errorf("GetRangeOpts error: %s", err.Error())
+		return
+	}
+	if len(rows) != 5 {
+		t.Errorf("wrong number of rows: %v", rows)
+		return
+	}
+	for i, row := range rows {
+		ts := int64(i * 20)
+		if row.TS != ts || row.Values[0].ArchiveID != 1 {
+			t.Errorf("wrong row %d: %v", i, row)
+		}
+		// average, sum, min
+		exp := []float32{float32(ts) + 9.5, float32(ts)*20 + 190, float32(ts)}
+		for j, v := range row.Values {
+			if !v.Valid || v.Value != exp[j] || v.Counter != 20 {
+				t.Errorf("wrong value in row %d col %d: %v, expected %v", i, j, v, exp[j])
+			}
+		}
+	}
+
+	// forced archive
+	rows, err = r.GetRangeOpts(90, 99, []int{1}, RangeOptions{HasArchive: true, Archive: 0})
+	if err != nil || len(rows) != 10 || rows[0].TS != 90 || rows[0].Values[0].ArchiveID != 0 {
+		t.Errorf("wrong rows from archive 0: %v, %v", rows, err)
+	}
+	if _, err = r.GetRangeOpts(0, 99, nil, RangeOptions{HasArchive: true, Archive: 5}); err == nil {
+		t.Errorf("missing error for invalid archive")
+	}
+
+	// steps that can't be consolidated exactly
+	for _, opts := range []RangeOptions{
+		{Step: 5, HasArchive: true, Archive: 1},
+		{Step: 15, Stitch: true},
+	} {
+		if rows, err := r.GetRangeOpts(0, 99, []int{1}, opts); err == nil {
+			t.Errorf("missing error for %+v: %v", opts, rows)
+		}
+	}
+	// step finer than archive covering range - use archive on step grid
+	rows, err = r.GetRangeOpts(0, 99, []int{1}, RangeOptions{Step: 2})
+	if err != nil || len(rows) != 5 || rows[0].TS != 90 || rows[4].TS != 98 {
+		t.Errorf("wrong rows for step 2: %v, %v", rows, err)
+	}
+	// step 150 is not multiple of archive 2 step - use archive 1
+	rows, err = r.GetRangeOpts(0, 99, []int{1}, RangeOptions{Step: 150})
+	if err != nil || len(rows) != 1 || rows[0].TS != 0 || rows[0].Values[0].ArchiveID != 1 || rows[0].Values[0].Counter != 100 {
+		t.Errorf("wrong rows for step 150: %v, %v", rows, err)
+	}
+
+	// step finer than the finest archive
+	os.Remove("tmp3.rdb")
+	r2, err := NewRRD("tmp3.rdb", []RRDColumn{{Name: "c1", Function: FAverage}},
+		[]RRDArchive{{Name: "a0", Step: 10, Rows: 10}})
+	if err != nil {
+		t.Fatalf("NewRRD error: %s", err.Error())
+	}
+	defer closeTestDb(t, r2)
+	if err := r2.Put(50, 0, 1); err != nil {
+		t.Fatalf("Put error: %s", err.Error())
+	}
+	if rows, err := r2.GetRangeOpts(0, 99, nil, RangeOptions{Step: 5}); err == nil {
+		t.Errorf("missing error for step finer than archives: %v", rows)
+	}
+}
+
+func TestExpr(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	defer closeTestDb(t, r)
+
+	rows := Rows{
+		{TS: 10, Values: []Value{{Value: 2, Valid: true}, {Value: 4, Valid: true}}},
+		{TS: 20, Values: []Value{{Value: 3, Valid: true}, {Valid: false}}},
+		{TS: 30, Values: []Value{{Value: 5, Valid: true}, {Value: 0, Valid: true}}},
+	}
+	loaded := []int{1, 2}
+
+	data := []struct {
+		expr     string
+		expected []float32 // -1 = invalid
+	}{
+		{"col2 + col3", []float32{6, -1, 5}},
+		{"col2/col3*100", []float32{50, -1, -1}},
+		{"-(col2 - 1) * 2 + 10 % 4 + 8", []float32{8, 6, 2}},
+		{"default(col3, 1) + $1", []float32{6, 4, 5}},
+		{"cumsum(col3)", []float32{4, 4, 4}},
+		{"delta(col2)", []float32{-1, 1, 2}},
+		{"rate(col2)", []float32{-1, 0.1, 0.2}},
+		{"max(col2, 4, 'col3')", []float32{4, -1, 5}},
+		{"abs(0 - col2)", []float32{2, 3, 5}},
+	}
+	for _, d := range data {
+		e, err := ParseExpr("", d.expr, r)
+		if err != nil {
+			t.Errorf("ParseExpr %s error: %s", d.expr, err.Error())
+			continue
+		}
+		res := ApplyExprs(rows, loaded, 1, []*Expr{e}, len(r.columns))
+		for i, exp := range d.expected {
+			if len(res[i].Values) != 2 || res[i].Values[0] != rows[i].Values[0] {
+				t.Errorf("%s: wrong row %d: %v", d.expr, i, res[i])
+				continue
+			}
+			v := res[i].Values[1]
+			if v.Column != len(r.columns) || (exp < 0 && v.Valid) || (exp >= 0 && (!v.Valid || v.Value != exp)) {
+				t.Errorf("%s: wrong value in row %d: %v, expected %v", d.expr, i, v, exp)
+			}
+		}
+	}
+
+	for _, inp := range []string{"col2 +", "(col2", "unknown + 1", "foo(col2)", "abs(col2, col3)", "col2 col3"} {
+		if _, err := ParseExpr("", inp, r); err == nil {
+			t.Errorf("ParseExpr %s: expected error", inp)
+		}
+	}
+
+	if e, err := ParseExprDef("total=col3+col2", r); err != nil || e.Name != "total" ||
+		fmt.Sprint(ExprsColumns([]int{2, 0}, []*Expr{e})) != "[2 0 1]" {
+		t.Errorf("ParseExprDef error: %v, %v", e, err)
+	}
+
+	// expressions are evaluated on raw rows and then consolidated
+	e, _ := ParseExpr("", "rate(col2)", r)
+	res := AverageByTime(ApplyExprs(rows, loaded, 1, []*Expr{e}, len(r.columns)), 100, r.Columns())
+	if len(res) != 1 || !res[0].Values[1].Valid || math.Abs(float64(res[0].Values[1].Value)-0.15) > 1e-6 {
+		t.Errorf("wrong consolidated expression: %v", res)
+	}
+}
+
+func TestStats(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	defer closeTestDb(t, r)
+	if errors := putTestDataInts(r, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 1); len(errors) > 0 {
+		t.Errorf("Put data error: %v", errors)
+		return
+	}
+	// invalid value
+	r.Purge(5, 5, []int{1}, []int{0})
+
+	stats, err := r.Stats(1, 10, []int{1, 2}, []float64{0, 50, 100}, RangeOptions{})
+	if err != nil {
+		t.Errorf("Stats error: %s", err.Error())
+		return
+	}
+	if len(stats) != 2 {
+		t.Errorf("wrong number of stats: %v", stats)
+		return
+	}
+	s := stats[0]
+	if s.Count != 9 || s.Min != 1 || s.MinTS != 1 || s.Max != 10 || s.MaxTS != 10 || s.Sum != 50 ||
+		s.First != 1 || s.Last != 10 || s.LastTS != 10 {
+		t.Errorf("wrong stats: %+v", s)
+	}
+	if math.Abs(s.Mean-50.0/9) > 0.0001 || math.Abs(s.StdDev-3.0225) > 0.0001 {
+		t.Errorf("wrong mean or stddev: %+v", s)
+	}
+	if len(s.Percentiles) != 3 || s.Percentiles[0].Value != 1 || s.Percentiles[1].Value != 6 ||
+		s.Percentiles[2].Value != 10 {
+		t.Errorf("wrong percentiles: %+v", s.Percentiles)
+	}
+	if stats[1].Count != 0 {
+		t.Errorf("wrong stats for empty column: %+v", stats[1])
+	}
+	if _, err := r.Stats(1, 10, nil, []float64{101}, RangeOptions{}); err == nil {
+		t.Errorf("missing error for invalid percentile")
+	}
+}
+
+func TestAverageByTimeFunctions(t *testing.T) {
+	r, c, _ := createTestDB(t)
+	closeTestDb(t, r)
+	var rows Rows
+	for ts := int64(0); ts < 4; ts++ {
+		row := Row{TS: ts}
+		for col := range c {
+			row.Values = append(row.Values, Value{TS: ts, Column: col, Value: float32(ts + 1), Counter: ts + 1, Valid: true})
+		}
+		rows = append(rows, row)
+	}
+	rows[3].Values[4].Valid = false
+
+	res := AverageByTime(rows, 2, c)
+	if len(res) != 2 {
+		t.Errorf("wrong number of rows: %v", res)
+		return
+	}
+	// last, average (weighted), sum, min, max, count
+	expected := [][]float32{
+		{2, 5.0 / 3, 3, 1, 2, 3},
+		{4, 25.0 / 7, 7, 3, 3, 7},
+	}
+	expCounters := []int64{3, 7}
+	for i, row := range res {
+		for col, v := range row.Values {
+			if !v.Valid || v.Column != col || math.Abs(float64(v.Value-expected[i][col])) > 0.0001 {
+				t.Errorf("wrong value in row %d, col %d: %v, expected %v", i, col, v, expected[i][col])
+			}
+			if col != 4 && v.Counter != expCounters[i] {
+				t.Errorf("wrong counter in row %d, col %d: %v, expected %v", i, col, v, expCounters[i])
+			}
+		}
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	var rows Rows
+	for ts := int64(0); ts < 100; ts++ {
+		v := float32(1)
+		switch ts {
+		case 37:
+			v = 50
+		case 71:
+			v = -20
+		}
+		rows = append(rows, Row{TS: ts, Values: []Value{{TS: ts, Value: v, Valid: true}}})
+	}
+
+	hasSpikes := func(res Rows) bool {
+		found := 0
+		for _, row := range res {
+			if row.TS == 37 && row.Values[0].Value == 50 || row.TS == 71 && row.Values[0].Value == -20 {
+				found++
+			}
+		}
+		return found == 2
+	}
+
+	res := Downsample(rows, 10, DownsampleLTTB, nil)
+	if len(res) != 10 || res[0].TS != 0 || res[9].TS != 99 || !hasSpikes(res) {
+		t.Errorf("wrong LTTB result: %v", res)
+	}
+	res = Downsample(rows, 10, DownsampleMinMax, nil)
+	if len(res) > 10 || !hasSpikes(res) {
+		t.Errorf("wrong MinMax result: %v", res)
+	}
+	for i := 1; i < len(res); i++ {
+		if res[i].TS <= res[i-1].TS {
+			t.Errorf("MinMax result not ordered: %v", res)
+		}
+	}
+	// more columns than pairs of rows fit in limit
+	var wide Rows
+	for _, row := range rows {
+		values := []Value{row.Values[0]}
+		for c := int64(1); c < 6; c++ {
+			values = append(values, Value{TS: row.TS, Value: float32(row.TS * c % 13), Valid: true})
+		}
+		wide = append(wide, Row{TS: row.TS, Values: values})
+	}
+	if res := Downsample(wide, 4, DownsampleMinMax, nil); len(res) > 4 || !hasSpikes(res) {
+		t.Errorf("wrong MinMax result for many columns: %v", res)
+	}
+	if res = Downsample(rows, 10, DownsampleAverage, nil); hasSpikes(res) {
+		t.Errorf("average should flatten spikes: %v", res)
+	}
+	if m, ok := ParseDownsampleMethod("LTTB"); !ok || m != DownsampleLTTB {
+		t.Errorf("ParseDownsampleMethod error")
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	values := []float32{1, 3, 2, -1, 10, 4}
+	var rows Rows
+	for i, v := range values {
+		rows = append(rows, Row{TS: int64(i * 10), Values: []Value{{Value: v, Valid: v >= 0}}})
+	}
+
+	data := []struct {
+		def      string
+		expected []float32 // -1 = invalid
+	}{
+		{"sma:2", []float32{1, 2, 2.5, -1, 10, 7}},
+		{"sma:30s", []float32{1, 2, 2, -1, 6, 7}},
+		{"median:3", []float32{1, 2, 2, -1, 6, 7}},
+		{"ewma:0.5", []float32{1, 2, 2, -1, 6, 5}},
+		{"ewma:3", []float32{1, 2, 2, -1, 6, 5}},
+	}
+	for _, d := range data {
+		tr, err := ParseTransform(d.def)
+		if err != nil {
+			t.Errorf("ParseTransform %s error: %s", d.def, err.Error())
+			continue
+		}
+		res := ApplyTransforms(rows, []*Transform{tr})
+		for i, exp := range d.expected {
+			v := res[i].Values[0]
+			if (exp < 0 && v.Valid) || (exp >= 0 && (!v.Valid || v.Value != exp)) {
+				t.Errorf("%s: wrong value on %d: %v, expected %v", d.def, i, v, exp)
+			}
+		}
+	}
+	if rows[1].Values[0].Value != 3 {
+		t.Errorf("ApplyTransforms modified input rows")
+	}
+
+	for _, def := range []string{"sma", "sma:0", "foo:3", "ewma:-1", "median:1x"} {
+		if _, err := ParseTransform(def); err == nil {
+			t.Errorf("ParseTransform %s: expected error", def)
+		}
+	}
+}
+
+func TestForecast(t *testing.T) {
+	forecasts, err := ParseForecastDef("1:10:50:hw")
+	if err != nil || len(forecasts) != 1 || forecasts[0].Season != 10 || forecasts[0].Rows != 50 {
+		t.Fatalf("ParseForecastDef error: %v, %+v", err, forecasts)
+	}
+	r, err := NewRRD("tmp.rdb", []RRDColumn{{Name: "c1", Function: FLast}},
+		[]RRDArchive{{Name: "a0", Step: 1, Rows: 100}}, forecasts...)
+	if err != nil {
+		t.Fatalf("NewRRD error: %s", err.Error())
+	}
+	// seasonal data with noise; anomaly in 61-68
+	for ts := int64(1); ts <= 68; ts++ {
+		v := float32(10+ts%10) + float32(ts%3)*0.3
+		if ts > 60 {
+			v = 100
+		}
+		if err := r.Put(ts, 0, v); err != nil {
+			t.Fatalf("Put error: %s", err.Error())
+		}
+	}
+	closeTestDb(t, r)
+
+	// forecasts should survive file modification
+	if err := ModifySetForecasts("tmp.rdb", forecasts); err != nil {
+		t.Fatalf("ModifySetForecasts error: %s", err.Error())
+	}
+
+	r, err = OpenRRD("tmp.rdb", true)
+	if err != nil {
+		t.Fatalf("OpenRRD error: %s", err.Error())
+	}
+	defer closeTestDb(t, r)
+	if len(r.Forecasts()) != 1 || r.Forecasts()[0] != forecasts[0] {
+		t.Errorf("wrong forecasts: %+v", r.Forecasts())
+	}
+
+	fr, err := r.GetForecastRange(0, 0, -1, nil)
+	if err != nil {
+		t.Fatalf("GetForecastRange error: %s", err.Error())
+	}
+	if len(fr.Rows) != 50 || fr.Rows[49].TS != 68 {
+		t.Errorf("wrong forecast rows: %d", len(fr.Rows))
+	}
+	fv, ok := fr.Get(55, 0)
+	if !ok || !fv.Valid || !fv.HasObserved || fv.Violation || math.Abs(float64(fv.Predicted-fv.Observed)) > 0.5 {
+		t.Errorf("wrong prediction for 55: %+v", fv)
+	}
+	if fv.Lower > fv.Observed || fv.Upper < fv.Observed {
+		t.Errorf("wrong confidence band for 55: %+v", fv)
+	}
+
+	anomalies, err := r.Anomalies(0, 0, -1, nil, false)
+	if err != nil {
+		t.Fatalf("Anomalies error: %s", err.Error())
+	}
+	if len(anomalies) != 2 || anomalies[0].TS != 67 || anomalies[1].TS != 68 {
+		t.Errorf("wrong anomalies: %+v", anomalies)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	thresholds := []struct {
+		def   string
+		value float64
+		alert bool
+	}{
+		{"10", 5, false}, {"10", 11, true}, {"10", -1, true},
+		{"10:", 9, true}, {"10:", 100, false},
+		{"~:10", -5, false}, {"~:10", 11, true},
+		{"5:10", 7, false}, {"@5:10", 7, true}, {"@5:10", 11, false},
+	}
+	for _, tc := range thresholds {
+		th, err := ParseThreshold(tc.def)
+		if err != nil {
+			t.Errorf("ParseThreshold(%s) error: %s", tc.def, err.Error())
+			continue
+		}
+		if th.Alert(tc.value) != tc.alert {
+			t.Errorf("Threshold %s: alert for %v should be %v", tc.def, tc.value, tc.alert)
+		}
+	}
+	if _, err := ParseThreshold("10:5"); err == nil {
+		t.Errorf("ParseThreshold should fail on invalid range")
+	}
+
+	r, _, _ := createTestDB(t)
+	defer closeTestDb(t, r)
+	if errors := putTestDataInts(r, []int{1, 2, 3, 4, 5, 6}, 0, 1); len(errors) > 0 {
+		t.Fatalf("Put data error: %v", errors)
+	}
+	warn, _ := ParseThreshold("5")
+	crit, _ := ParseThreshold("10")
+	res, err := r.Check(CheckOptions{Column: 0, Warning: warn, Critical: crit, Now: 6})
+	if err != nil || res.Status != CheckWarning || res.Value != 6 {
+		t.Errorf("wrong check result: %+v, %v", res, err)
+	} else if res.Perfdata != "'col1'=6;5;10;0;1000000" {
+		t.Errorf("wrong perfdata: %s", res.Perfdata)
+	}
+
+	inside, _ := ParseThreshold("@4:6")
+	res, err = r.Check(CheckOptions{Column: 1, Stat: "avg", Window: 3, Critical: inside, Now: 6})
+	if err != nil || res.Status != CheckCritical || res.Value != 5 || res.Label != "col2_avg" {
+		t.Errorf("wrong check result: %+v, %v", res, err)
+	}
+	res, err = r.Check(CheckOptions{Column: 1, Stat: "p50", Window: 6, Now: 6})
+	if err != nil || res.Status != CheckOK || res.Value != 3.5 {
+		t.Errorf("wrong check result: %+v, %v", res, err)
+	}
+
+	// old or missing data
+	res, err = r.Check(CheckOptions{Column: 0, MaxAge: 10, Now: 100})
+	if err != nil || res.Status != CheckUnknown {
+		t.Errorf("wrong check result for old data: %+v, %v", res, err)
+	}
+	res, err = r.Check(CheckOptions{Column: 1, Stat: "avg", Window: 3, Now: 100})
+	if err != nil || res.Status != CheckUnknown {
+		t.Errorf("wrong check result for stale window: %+v, %v", res, err)
+	}
+	res, err = r.Check(CheckOptions{Column: 2, Now: 6})
+	if err != nil || res.Status != CheckUnknown {
+		t.Errorf("wrong check result for no data: %+v, %v", res, err)
+	}
+	if _, err = r.Check(CheckOptions{Column: 0, Stat: "avg"}); err == nil {
+		t.Errorf("Check should fail without window")
+	}
+}
+
+func TestTrend(t *testing.T) {
+	// 10 per day, one outlier
+	var rows Rows
+	for i := int64(0); i < 24; i++ {
+		v := float32(50 + i*10/24)
+		if i == 20 {
+			v = 500
+		}
+		rows = append(rows, Row{TS: 1000 + i*3600, Values: []Value{{Value: float32(50) + float32(i)*10/24, Valid: true}, {Value: v, Valid: true}}})
+	}
+	rows = append(rows, Row{TS: 1000 + 24*3600, Values: []Value{{}, {}}})
+
+	trend, err := FitTrend(rows, 0, TrendLeastSquares)
+	if err != nil {
+		t.Fatalf("FitTrend error: %s", err.Error())
+	}
+	if math.Abs(trend.SlopePerDay()-10) > 0.001 || trend.Points != 24 || math.Abs(trend.R2-1) > 0.0001 {
+		t.Errorf("wrong trend: %+v", trend)
+	}
+	if v := trend.ValueAt(1000 + 48*3600); math.Abs(v-70) > 0.001 {
+		t.Errorf("wrong trend value: %v", v)
+	}
+	if ts, c := trend.Crossing(100, trend.End); c != CrossingFuture || math.Abs(float64(ts-(1000+5*86400))) > 1 {
+		t.Errorf("wrong crossing: %v, %v", ts, c)
+	}
+	if ts, c := trend.Crossing(55, trend.End); c != CrossingReached || math.Abs(float64(ts-(1000+12*3600))) > 1 {
+		t.Errorf("threshold should be already reached: %v, %v", ts, c)
+	}
+	flat := &Trend{Intercept: 10, RefTS: 1000}
+	if _, c := flat.Crossing(20, 1000); c != CrossingNever {
+		t.Errorf("flat trend should never reach threshold: %v", c)
+	}
+
+	// outlier affect least squares but not theil-sen
+	lsq, _ := FitTrend(rows, 1, TrendLeastSquares)
+	robust, err := FitTrend(rows, 1, TrendTheilSen)
+	if err != nil {
+		t.Fatalf("FitTrend error: %s", err.Error())
+	}
+	if math.Abs(robust.SlopePerDay()-10) > 1 || math.Abs(lsq.SlopePerDay()-10) < 1 {
+		t.Errorf("wrong trends: lsq=%+v, theil-sen=%+v", lsq, robust)
+	}
+
+	if _, err := FitTrend(rows[:1], 0, TrendLeastSquares); err == nil {
+		t.Errorf("FitTrend should fail on one point")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	shifts, err := ParseShifts("1d, 7d")
+	if err != nil || len(shifts) != 2 || shifts[0] != 86400 || shifts[1] != 7*86400 {
+		t.Fatalf("invalid shifts: %v, %v", shifts, err)
+	}
+	if _, err := ParseShifts("1d,abc"); err == nil {
+		t.Error("expected error for invalid shift")
+	}
+	if mode, ok := ParseCompareMode("pct"); !ok || mode != ComparePercent {
+		t.Errorf("invalid mode: %v", mode)
+	}
+
+	row := func(ts int64, values ...float32) Row {
+		r := Row{TS: ts}
+		for _, v := range values {
+			r.Values = append(r.Values, Value{TS: ts, Value: v, Valid: true})
+		}
+		return r
+	}
+	rows := Rows{row(100, 10), row(110, 20), row(120, 30)}
+	// coarser shifted rows: one row cover 20s
+	shifted := []Rows{{row(0, 5), row(20, 40)}}
+
+	res := CompareRows(rows, shifted, []int64{100}, CompareValues)
+	expected := []float32{5, 5, 40}
+	for i, r := range res {
+		if len(r.Values) != 2 || !r.Values[1].Valid || r.Values[1].Value != expected[i] {
+			t.Errorf("invalid row %d: %+v; expected %v", i, r, expected[i])
+		}
+	}
+
+	res = CompareRows(rows, shifted, []int64{100}, CompareDiff)
+	if v := res[1].Values[1]; !v.Valid || v.Value != 15 {
+		t.Errorf("invalid diff: %+v", v)
+	}
+	res = CompareRows(rows, shifted, []int64{100}, ComparePercent)
+	if v := res[2].Values[1]; !v.Valid || v.Value != -25 {
+		t.Errorf("invalid pct: %+v", v)
+	}
+
+	// no shifted data for ts
+	res = CompareRows(rows, shifted, []int64{200}, CompareValues)
+	if v := res[0].Values[1]; v.Valid {
+		t.Errorf("expected invalid value: %+v", v)
+	}
+
+	labels := CompareLabels([]string{"c1"}, []int64{86400}, CompareDiff)
+	if len(labels) != 1 || labels[0] != "c1 diff -1d" {
+		t.Errorf("invalid labels: %v", labels)
+	}
+}
+
+func TestTimeExpr(t *testing.T) {
+	loc := TimeLocation
+	defer func() { TimeLocation = loc }()
+	if err := SetTimeZone("UTC"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTimeZone("Invalid/Zone"); err == nil {
+		t.Error("expected error for invalid zone")
+	}
+
+	// wednesday
+	now := time.Date(2016, 3, 16, 12, 30, 0, 0, time.UTC)
+	date := func(y int, m time.Month, d, h, mi, s int) int64 {
+		return time.Date(y, m, d, h, mi, s, 0, time.UTC).Unix()
+	}
+	tests := map[string]int64{
+		"1458131400":        1458131400,
+		"2016-03-01":        date(2016, 3, 1, 0, 0, 0),
+		"now":               now.Unix(),
+		"-2d":               date(2016, 3, 14, 12, 30, 0),
+		"now-1w":            date(2016, 3, 9, 12, 30, 0),
+		"-1h30m":            date(2016, 3, 16, 11, 0, 0),
+		"today":             date(2016, 3, 16, 0, 0, 0),
+		"yesterday 06:00":   date(2016, 3, 15, 6, 0, 0),
+		"tomorrow+1h":       date(2016, 3, 17, 1, 0, 0),
+		"start of month":    date(2016, 3, 1, 0, 0, 0),
+		"start of week":     date(2016, 3, 14, 0, 0, 0),
+		"end of day":        date(2016, 3, 16, 23, 59, 59),
+		"start of year-1mo": date(2015, 12, 1, 0, 0, 0),
+	}
+	for expr, expected := range tests {
+		ts, err := ParseTimeExpr(expr, now, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", expr, err)
+		} else if ts != expected {
+			t.Errorf("%s: expected %s, got %s", expr, time.Unix(expected, 0).UTC(), time.Unix(ts, 0).UTC())
+		}
+	}
+	for _, expr := range []string{"abc", "today 25:00", "start of decade", "end-1h", "now-1x"} {
+		if _, err := ParseTimeExpr(expr, now, nil); err == nil {
+			t.Errorf("%s: expected error", expr)
+		}
+	}
+
+	tsMin, tsMax, err := ParseTimeRange("end-1h", "today", now)
+	if err != nil || tsMax != date(2016, 3, 16, 0, 0, 0) || tsMin != tsMax-3600 {
+		t.Errorf("invalid range: %d, %d, %v", tsMin, tsMax, err)
+	}
+	tsMin, tsMax, err = ParseTimeRange("yesterday", "begin+12h", now)
+	if err != nil || tsMin != date(2016, 3, 15, 0, 0, 0) || tsMax != tsMin+12*3600 {
+		t.Errorf("invalid range: %d, %d, %v", tsMin, tsMax, err)
+	}
+
+	// time zone
+	if err := SetTimeZone("Europe/Warsaw"); err == nil {
+		ts, _ := ParseTimeExpr("2016-03-01 12:00", now, nil)
+		if ts != date(2016, 3, 1, 11, 0, 0) {
+			t.Errorf("invalid date in time zone: %s", time.Unix(ts, 0).UTC())
+		}
+	}
+}
+
+func TestAverageByCalendar(t *testing.T) {
+	if u, ok := ParseCalendarUnit("monthly"); !ok || u != CalendarMonth {
+		t.Errorf("invalid unit: %v", u)
+	}
+	loc, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		loc = time.FixedZone("CET", 3600)
+	}
+	columns := []RRDColumn{{Name: "sum", Function: FSum}, {Name: "avg", Function: FAverage}}
+	var rows Rows
+	// every 6 hours from 2016-01-30 00:00 (saturday) to 2016-02-02 18:00 local time
+	for ts := time.Date(2016, 1, 30, 0, 0, 0, 0, loc); ts.Before(time.Date(2016, 2, 3, 0, 0, 0, 0, loc)); ts = ts.Add(6 * time.Hour) {
+		rows = append(rows, Row{TS: ts.Unix(), Values: []Value{
+			{TS: ts.Unix(), Column: 0, Value: 1, Valid: true, Counter: 1},
+			{TS: ts.Unix(), Column: 1, Value: float32(ts.Day()), Valid: true, Counter: 1},
+		}})
+	}
+
+	res := AverageByCalendar(rows, CalendarDay, loc, columns)
+	if len(res) != 4 {
+		t.Fatalf("expected 4 days, got %d: %+v", len(res), res)
+	}
+	for i, day := range []int{30, 31, 1, 2} {
+		r := res[i]
+		if tm := time.Unix(r.TS, 0).In(loc); tm.Day() != day || tm.Hour() != 0 {
+			t.Errorf("invalid bucket %d start: %s", i, tm)
+		}
+		if r.Values[0].Value != 4 || r.Values[1].Value != float32(day) {
+			t.Errorf("invalid bucket %d values: %+v", i, r.Values)
+		}
+	}
+
+	res = AverageByCalendar(rows, CalendarWeek, loc, columns)
+	if len(res) != 2 || res[0].Values[0].Value != 8 || res[1].Values[0].Value != 8 {
+		t.Errorf("invalid weeks: %+v", res)
+	} else if tm := time.Unix(res[1].TS, 0).In(loc); tm.Weekday() != time.Monday || tm.Day() != 1 {
+		t.Errorf("invalid week start: %s", tm)
+	}
+
+	res = AverageByCalendar(rows, CalendarMonth, loc, columns)
+	if len(res) != 2 || res[0].Values[0].Value != 8 || res[1].TS != time.Date(2016, 2, 1, 0, 0, 0, 0, loc).Unix() {
+		t.Errorf("invalid months: %+v", res)
+	}
+
+	res = AverageByCalendar(rows, CalendarYear, loc, columns)
+	if len(res) != 1 || res[0].Values[0].Value != 16 {
+		t.Errorf("invalid years: %+v", res)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	if g, ok := ParseProfileGroup("dow"); !ok || g != ProfileWeekday {
+		t.Errorf("invalid group: %v", g)
+	}
+	r, err := NewRRD("tmp.rdb", []RRDColumn{{Name: "c1", Function: FLast}},
+		[]RRDArchive{{Name: "a0", Step: 3600, Rows: 400}})
+	if err != nil {
+		t.Fatalf("NewRRD error: %s", err.Error())
+	}
+	defer closeTestDb(t, r)
+	// two weeks of hourly data from monday; value = weekday * 100 + hour
+	begin := time.Date(2016, 3, 7, 0, 0, 0, 0, time.UTC).Unix()
+	for i := int64(0); i < 14*24; i++ {
+		v := float32((i/24)%7*100 + i%24)
+		if err := r.Put(begin+i*3600, 0, v); err != nil {
+			t.Fatalf("Put error: %s", err.Error())
+		}
+	}
+	end := begin + 14*24*3600 - 1
+
+	p, err := r.Profile(begin, end, nil, ProfileHour, []float64{50}, time.UTC, RangeOptions{})
+	if err != nil {
+		t.Fatalf("Profile error: %s", err.Error())
+	}
+	if len(p.Buckets) != 24 || p.Buckets[6].Label() != "06" {
+		t.Fatalf("invalid buckets: %+v", p.Buckets)
+	}
+	if s := p.Buckets[6].Columns[0]; s.Count != 14 || s.Min != 6 || s.Max != 606 || math.Abs(s.Mean-306) > 1e-6 ||
+		len(s.Percentiles) != 1 || s.Percentiles[0].Value != 306 {
+		t.Errorf("invalid hour bucket: %+v", s)
+	}
+
+	p, err = r.Profile(begin, end, []int{0}, ProfileWeekdayHour, nil, time.UTC, RangeOptions{})
+	if err != nil {
+		t.Fatalf("Profile error: %s", err.Error())
+	}
+	b := p.Buckets[2*24+5]
+	if len(p.Buckets) != 168 || b.Label() != "Wed 05" || b.Columns[0].Count != 2 || b.Columns[0].Mean != 205 {
+		t.Errorf("invalid weekday-hour bucket: %s %+v", b.Label(), b.Columns[0])
+	}
+
+	// monday in UTC+12 starts at sunday 12:00 UTC
+	p, err = r.Profile(begin, end, nil, ProfileWeekday, nil, time.FixedZone("X", 12*3600), RangeOptions{})
+	if err != nil {
+		t.Fatalf("Profile error: %s", err.Error())
+	}
+	if s := p.Buckets[0].Columns[0]; p.Buckets[0].Label() != "Mon" || s.Count != 12+24+12 {
+		t.Errorf("invalid weekday bucket: %+v", s)
+	}
+}
+
+func TestForecastChangeArchive(t *testing.T) {
+	forecasts, _ := ParseForecastDef("1:10:50")
+	r, err := NewRRD("tmp.rdb", []RRDColumn{{Name: "c1", Function: FLast}},
+		[]RRDArchive{{Name: "a0", Step: 1, Rows: 100}}, forecasts...)
+	if err != nil {
+		t.Fatalf("NewRRD error: %s", err.Error())
+	}
+	for ts := int64(1); ts <= 40; ts++ {
+		if err := r.Put(ts, 0, float32(10+ts%10)); err != nil {
+			t.Fatalf("Put error: %s", err.Error())
+		}
+	}
+	state, _ := r.storage.LoadForecastState(0)
+	before, _ := r.GetForecastRange(0, 0, -1, nil)
+	closeTestDb(t, r)
+
+	if err := ModifyChangeArchive("tmp.rdb", 0, "", 2); err != nil {
+		t.Fatalf("ModifyChangeArchive error: %s", err.Error())
+	}
+
+	r, err = OpenRRD("tmp.rdb", true)
+	if err != nil {
+		t.Fatalf("OpenRRD error: %s", err.Error())
+	}
+	defer closeTestDb(t, r)
+	nstate, err := r.storage.LoadForecastState(0)
+	if err != nil {
+		t.Fatalf("LoadForecastState error: %s", err.Error())
+	}
+	if nstate.LastTS != state.LastTS || nstate.Columns[0].Level != state.Columns[0].Level ||
+		nstate.Columns[0].Updates != state.Columns[0].Updates {
+		t.Errorf("forecast state not copied: %+v, expected %+v", nstate, state)
+	}
+	after, _ := r.GetForecastRange(0, 0, -1, nil)
+	if len(after.Rows) != len(before.Rows) || len(after.Rows) == 0 {
+		t.Errorf("forecast rows not copied: %d, expected %d", len(after.Rows), len(before.Rows))
+	}
+}
+
+func TestForecastMerge(t *testing.T) {
+	forecasts, _ := ParseForecastDef("1:10:50")
+	cols := []RRDColumn{{Name: "c1", Function: FLast}}
+	archs := []RRDArchive{{Name: "a0", Step: 1, Rows: 100}}
+	var newest *ForecastState
+	for i, fname := range []string{"tmp.rdb", "tmp3.rdb"} {
+		os.Remove(fname)
+		r, err := NewRRD(fname, cols, archs, forecasts...)
+		if err != nil {
+			t.Fatalf("NewRRD error: %s", err.Error())
+		}
+		// second file has newer data
+		for ts := int64(1); ts <= int64(30+i*10); ts++ {
+			if err := r.Put(ts, 0, float32(10+ts%10)); err != nil {
+				t.Fatalf("Put error: %s", err.Error())
+			}
+		}
+		newest, _ = r.storage.LoadForecastState(0)
+		closeTestDb(t, r)
+	}
+
+	os.Remove("tmp2.rdb")
+	if err := MergeRRD("tmp2.rdb", []string{"tmp.rdb", "tmp3.rdb"}, MergeNewer); err != nil {
+		t.Fatalf("MergeRRD error: %s", err.Error())
+	}
+	m, err := OpenRRD("tmp2.rdb", true)
+	if err != nil {
+		t.Fatalf("OpenRRD error: %s", err.Error())
+	}
+	state, err := m.storage.LoadForecastState(0)
+	if err != nil || state.LastTS != 40 || state.Columns[0].Level != newest.Columns[0].Level ||
+		state.Columns[0].Updates != newest.Columns[0].Updates {
+		t.Errorf("forecast state not copied from newest source: %+v, expected %+v (%v)", state, newest, err)
+	}
+	if fr, _ := m.GetForecastRange(0, 0, -1, nil); fr == nil || len(fr.Rows) == 0 {
+		t.Errorf("forecast rows not copied: %v", fr)
+	}
+	closeTestDb(t, m)
+
+	// different forecasts definitions
+	other, _ := ParseForecastDef("1:5:50")
+	os.Remove("tmp3.rdb")
+	r3, _ := NewRRD("tmp3.rdb", cols, archs, other...)
+	closeTestDb(t, r3)
+	os.Remove("tmp2.rdb")
+	if err := MergeRRD("tmp2.rdb", []string{"tmp.rdb", "tmp3.rdb"}, MergeNewer); err == nil {
+		t.Errorf("missing error for different forecasts")
+	}
+}
+
+func TestModAddArchives(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	if errors := putTestDataInts(r, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 1); len(errors) > 0 {
+		t.Fatalf("Put data error: %v", errors)
+	}
+	before, _ := r.getFromArchive(1, 0, []int{1})
+	closeTestDb(t, r)
+
+	// archive with smaller step than a1 should be placed before it
+	if err := ModifyAddArchives("tmp.rdb", []RRDArchive{{Name: "a5", Step: 5, Rows: 10}}); err != nil {
+		t.Fatalf("ModifyAddArchives error: %s", err.Error())
+	}
+	r2, _ := OpenRRD("tmp.rdb", true)
+	defer closeTestDb(t, r2)
+	for i, name := range []string{"a0", "a5", "a1", "a2"} {
+		if i >= len(r2.archives) || r2.archives[i].Name != name {
+			t.Fatalf("wrong archives order: %v", r2.archives)
+		}
+	}
+	if vs, err := r2.getFromArchive(0, 7, []int{1}); err != nil || !vs[0].Valid || vs[0].Value != 7 {
+		t.Errorf("wrong value in a0: %v, %v", vs, err)
+	}
+	if vs, err := r2.getFromArchive(2, 0, []int{1}); err != nil || vs[0].Value != before[0].Value ||
+		vs[0].Counter != before[0].Counter || !vs[0].Valid {
+		t.Errorf("wrong value in a1: %v, expected %v (%v)", vs, before, err)
+	}
+}
+
+func TestModChangeArchiveWrapped(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	// archive a0 keeps 10 rows; ts 10-15 overwrite rows of ts 0-5
+	if errors := putTestDataInts(r, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, 0); len(errors) > 0 {
+		t.Fatalf("Put data error: %v", errors)
+	}
+	closeTestDb(t, r)
+
+	// bucket 8-11 is split between end and begin of ring
+	if err := ModifyChangeArchive("tmp.rdb", 0, "", 4); err != nil {
+		t.Fatalf("ModifyChangeArchive error: %s", err.Error())
+	}
+	r2, _ := OpenRRD("tmp.rdb", true)
+	defer closeTestDb(t, r2)
+	vs, err := r2.getFromArchive(0, 8, []int{0})
+	if err != nil || len(vs) != 1 || !vs[0].Valid || vs[0].Value != 11 {
+		t.Errorf("wrong last value in bucket 8: %v, %v", vs, err)
+	}
+}
+
+func TestModChangeArchive(t *testing.T) {
+	r, _, _ := createTestDB(t)
+	testV := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if errors := putTestDataInts(r, testV, 1, 2, 4); len(errors) > 0 {
+		t.Errorf("Put data error: %v", errors)
+		return
+	}
+	closeTestDb(t, r)
+
+	if err := ModifyChangeArchive("tmp.rdb", 0, "", 5); err != nil {
+		t.Errorf("ModifyChangeArchive error: %s", err.Error())
+		return
+	}
+	r2, _ := OpenRRD("tmp.rdb", true)
+	// retention of 10 sec is kept
+	if a := r2.archives[0]; a.Name != "a0" || a.Step != 5 || a.Rows != 2 {
+		t.Errorf("invalid archive 0: %v", a)
+	}
+	vs, err := r2.getFromArchive(0, 5, []int{1, 2, 4})
+	if err != nil || len(vs) != 3 {
+		t.Errorf("Get error: %v, %v", err, vs)
+	} else {
+		for i, exp := range []float32{7, 35, 9} {
+			if !vs[i].Valid || vs[i].Value != exp || vs[i].Counter != 5 {
+				t.Errorf("wrong value %d: %v, expected %v", i, vs[i], exp)
+			}
+		}
+	}
+	r2.Close()
+
+	// move archive after a1 and rename
+	if err := ModifyChangeArchive("tmp.rdb", 0, "a50", 50); err != nil {
+		t.Errorf("ModifyChangeArchive error: %s", err.Error())
+		return
+	}
+	r2, _ = OpenRRD("tmp.rdb", true)
+	names := []string{"a1", "a50", "a2"}
+	for i, name := range names {
+		if r2.archives[i].Name != name {
+			t.Errorf("wrong archives order: %v", r2.archives)
+			break
+		}
+	}
+	if a := r2.archives[1]; a.Rows != 1 {
+		t.Errorf("wrong rows in archive a50: %v", a)
+	}
+	vs, err = r2.getFromArchive(1, 0, []int{1, 2, 4})
+	if err != nil || len(vs) != 3 {
+		t.Errorf("Get error: %v, %v", err, vs)
+	} else {
+		// only rows from ts 5 are kept in a0
+		for i, exp := range []float32{7.5, 45, 10} {
+			if !vs[i].Valid || vs[i].Value != exp || vs[i].Counter != 6 {
+				t.Errorf("wrong value %d: %v, expected %v", i, vs[i], exp)
+			}
+		}
+	}
+	r2.Close()
+
+	if err := ModifyChangeArchive("tmp.rdb", 0, "a2", 0); err == nil {
+		t.Errorf("missing error for duplicated name")
+	}
+}
+
+func TestDurations(t *testing.T) {
+	for inp, exp := range map[string]int64{
+		"60": 60, "5m": 300, "1h30m": 5400, "2d": 172800, "1w": 604800,
+		"1y": 31536000, "1.5h": 5400, "-1d": -86400,
+	} {
+		if d, err := ParseDuration(inp); err != nil || d != exp {
+			t.Errorf("ParseDuration(%s) = %d, %v; expected %d", inp, d, err, exp)
+		}
+	}
+	for _, inp := range []string{"", "1x", "h", "1h-"} {
+		if _, err := ParseDuration(inp); err == nil {
+			t.Errorf("ParseDuration(%s) expected error", inp)
+		}
+	}
+	for secs, exp := range map[int64]string{
+		60: "1m", 172800: "2d", 5400: "1h30m", 31536000: "1y", 1209600: "2w", 864000: "10d",
+	} {
+		if s := FormatDuration(secs); s != exp {
+			t.Errorf("FormatDuration(%d) = %s; expected %s", secs, s, exp)
+		}
+	}
+
+	archives, err := parseArchiveDef("1m:2d,1h:1y:hours,10:60")
+	if err != nil {
+		t.Fatalf("parseArchiveDef error: %s", err)
+	}
+	if a := archives[0]; a.Step != 60 || a.Rows != 2880 {
+		t.Errorf("wrong archive 0: %+v", a)
+	}
+	if a := archives[1]; a.Step != 3600 || a.Rows != 8760 || a.Name != "hours" {
+		t.Errorf("wrong archive 1: %+v", a)
+	}
+	if a := archives[2]; a.Step != 60 || a.Rows != 10 {
+		t.Errorf("wrong archive 2: %+v", a)
+	}
+	if _, err := parseArchiveDef("1d:1h"); err == nil {
+		t.Errorf("parseArchiveDef expected error for retention < step")
+	}
+	// mixed rows:step and step:retention forms
+	for _, inp := range []string{"1m:2880", "10:1m", "60s:1440:minutes"} {
+		if _, err := parseArchiveDef(inp); err == nil {
+			t.Errorf("parseArchiveDef expected error for ambiguous definition %s", inp)
+		}
+	}
+}
+
 func createTestDB(t *testing.T) (*RRD, []RRDColumn, []RRDArchive) {
 	c := []RRDColumn{
 		RRDColumn{Name: "col1", Function: FLast, Minimum: 0, Maximum: 1000000, HasMinimum: true, HasMaximum: true},
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+Schema file format (json):
+{
+	"columns": [
+		{"name": "load", "function": "average", "min": 0, "max": 100},
+		...
+	],
+	"archives": [
+		{"name": "minutes", "step": 60, "rows": 1440},
+		{"name": "hours", "step": 3600, "retention": "1y"},
+		...
+	],
+	"forecasts": [
+		{"name": "daily", "step": 300, "season": "1d", "retention": "1w", "alpha": 0.1},
+		...
+	]
+}
+*/
+
+type (
+	// Schema describe columns and archives of rrd file
+	Schema struct {
+		Columns   []SchemaColumn   `json:"columns"`
+		Archives  []SchemaArchive  `json:"archives"`
+		Forecasts []SchemaForecast `json:"forecasts,omitempty"`
+	}
+
+	// SchemaColumn is column definition in schema file
+	SchemaColumn struct {
+		Name     string   `json:"name"`
+		Function string   `json:"function,omitempty"`
+		Minimum  *float32 `json:"min,omitempty"`
+		Maximum  *float32 `json:"max,omitempty"`
+	}
+
+	// SchemaArchive is archive definition in schema file; number of rows
+	// may be given directly or calculated from retention (i.e. "2d")
+	SchemaArchive struct {
+		Name      string `json:"name"`
+		Step      int64  `json:"step"`
+		Rows      int32  `json:"rows,omitempty"`
+		Retention string `json:"retention,omitempty"`
+	}
+
+	// SchemaForecast is Holt-Winters forecast definition in schema file;
+	// season and retention are durations; not given parameters have
+	// default values
+	SchemaForecast struct {
+		Name      string  `json:"name"`
+		Step      int64   `json:"step"`
+		Season    string  `json:"season"`
+		Retention string  `json:"retention"`
+		Alpha     float32 `json:"alpha,omitempty"`
+		Beta      float32 `json:"beta,omitempty"`
+		Gamma     float32 `json:"gamma,omitempty"`
+		Delta     float32 `json:"delta,omitempty"`
+		Window    int32   `json:"window,omitempty"`
+		Threshold int32   `json:"threshold,omitempty"`
+	}
+
+	// SchemaChange is one operation required to apply schema to rrd file
+	SchemaChange struct {
+		Description string
+		apply       func(filename string) error
+	}
+)
+
+// LoadSchema read schema from json file; yaml and toml files are rejected
+func LoadSchema(filename string) (*Schema, error) {
+	LogDebug("LoadSchema filename=%s", filename)
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml", ".toml":
+		return nil, fmt.Errorf("unsupported schema format %s; only json is supported", filepath.Ext(filename))
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var schema Schema
+	dec := json.NewDecoder(f)
+	if err := dec.Decode(&schema); err != nil {
+		return nil, fmt.Errorf("parse schema error: %s", err.Error())
+	}
+	return &schema, nil
+}
+
+// LoadRRDSchema read columns, archives and forecasts definitions from existing rrd file
+func LoadRRDSchema(filename string) (columns []RRDColumn, archives []RRDArchive, forecasts []RRDForecast, err error) {
+	LogDebug("LoadRRDSchema filename=%s", filename)
+
+	r, err := OpenRRD(filename, true)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer r.Close()
+
+	columns = append(columns, r.Columns()...)
+	archives = append(archives, r.Archives()...)
+	forecasts = append(forecasts, r.Forecasts()...)
+	return
+}
+
+// RRDColumns convert and validate columns definitions
+func (s *Schema) RRDColumns() (columns []RRDColumn, err error) {
+	if len(s.Columns) == 0 {
+		return nil, fmt.Errorf("no columns defined")
+	}
+	names := make(map[string]bool)
+	for idx, sc := range s.Columns {
+		c := RRDColumn{Name: strings.TrimSpace(sc.Name)}
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("c%02d", idx+1)
+		}
+		if len(c.Name) > 16 {
+			c.Name = c.Name[:16]
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicated column name %s", c.Name)
+		}
+		names[c.Name] = true
+		funcID, ok := ParseFunctionName(sc.Function)
+		if !ok {
+			return nil, fmt.Errorf("invalid function '%s' for column %s", sc.Function, c.Name)
+		}
+		c.Function = funcID
+		if sc.Minimum != nil {
+			c.Minimum = *sc.Minimum
+			c.HasMinimum = true
+		}
+		if sc.Maximum != nil {
+			c.Maximum = *sc.Maximum
+			c.HasMaximum = true
+		}
+		columns = append(columns, c)
+	}
+	return
+}
+
+// RRDArchives convert and validate archives definitions
+func (s *Schema) RRDArchives() (archives []RRDArchive, err error) {
+	if len(s.Archives) == 0 {
+		return nil, fmt.Errorf("no archives defined")
+	}
+	names := make(map[string]bool)
+	for idx, sa := range s.Archives {
+		a := RRDArchive{
+			Name: strings.TrimSpace(sa.Name),
+			Step: sa.Step,
+			Rows: sa.Rows,
+		}
+		if a.Name == "" {
+			a.Name = fmt.Sprintf("a%02d", idx+1)
+		}
+		if len(a.Name) > 16 {
+			a.Name = a.Name[:16]
+		}
+		if names[a.Name] {
+			return nil, fmt.Errorf("duplicated archive name %s", a.Name)
+		}
+		names[a.Name] = true
+		if sa.Retention != "" && a.Step > 0 {
+			retention, err := ParseDuration(sa.Retention)
+			if err != nil {
+				return nil, fmt.Errorf("invalid retention in archive %s: %s", a.Name, err.Error())
+			}
+			a.Rows = int32((retention + a.Step - 1) / a.Step)
+		}
+		if a.Step < 1 || a.Rows < 1 {
+			return nil, fmt.Errorf("invalid step or rows in archive %s", a.Name)
+		}
+		archives = append(archives, a)
+	}
+	return
+}
+
+// RRDForecasts convert and validate forecasts definitions
+func (s *Schema) RRDForecasts() (forecasts []RRDForecast, err error) {
+	names := make(map[string]bool)
+	for idx, sf := range s.Forecasts {
+		f := RRDForecast{
+			Name:      strings.TrimSpace(sf.Name),
+			Step:      sf.Step,
+			Alpha:     sf.Alpha,
+			Beta:      sf.Beta,
+			Gamma:     sf.Gamma,
+			Delta:     sf.Delta,
+			Window:    sf.Window,
+			Threshold: sf.Threshold,
+		}
+		if f.Name == "" {
+			f.Name = fmt.Sprintf("f%02d", idx+1)
+		}
+		if names[f.Name] {
+			return nil, fmt.Errorf("duplicated forecast name %s", f.Name)
+		}
+		names[f.Name] = true
+		if f.Step < 1 {
+			return nil, fmt.Errorf("invalid step in forecast %s", f.Name)
+		}
+		season, err := ParseDuration(sf.Season)
+		if err != nil || season%f.Step != 0 {
+			return nil, fmt.Errorf("invalid season in forecast %s", f.Name)
+		}
+		f.Season = int32(season / f.Step)
+		retention, err := ParseDuration(sf.Retention)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention in forecast %s", f.Name)
+		}
+		f.Rows = int32((retention + f.Step - 1) / f.Step)
+		if err := f.check(); err != nil {
+			return nil, fmt.Errorf("invalid forecast %s: %s", f.Name, err.Error())
+		}
+		forecasts = append(forecasts, f)
+	}
+	return
+}
+
+// PlanSchemaChanges compare rrd file with schema and return list of operations
+// required to update file. Columns and archives are matched by names.
+func PlanSchemaChanges(r *RRD, s *Schema) ([]SchemaChange, error) {
+	columns, err := s.RRDColumns()
+	if err != nil {
+		return nil, err
+	}
+	archives, err := s.RRDArchives()
+	if err != nil {
+		return nil, err
+	}
+	forecasts, err := s.RRDForecasts()
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []SchemaChange
+	changes = append(changes, planColumnsChanges(r.columns, columns)...)
+	changes = append(changes, planArchivesChanges(r.archives, archives)...)
+	changes = append(changes, planForecastsChanges(r.forecasts, forecasts)...)
+	return changes, nil
+}
+
+// ApplySchemaChanges run all operations on file
+func ApplySchemaChanges(filename string, changes []SchemaChange) error {
+	for _, ch := range changes {
+		LogDebug("ApplySchemaChanges %s", ch.Description)
+		if err := ch.apply(filename); err != nil {
+			return fmt.Errorf("%s error: %s", ch.Description, err.Error())
+		}
+	}
+	return nil
+}
+
+func planColumnsChanges(current, columns []RRDColumn) (changes []SchemaChange) {
+	wanted := make(map[string]RRDColumn)
+	for _, c := range columns {
+		wanted[c.Name] = c
+	}
+
+	// delete
+	var cur []RRDColumn
+	var toDel []int
+	var names []string
+	for idx, c := range current {
+		if _, ok := wanted[c.Name]; ok {
+			cur = append(cur, c)
+		} else {
+			toDel = append(toDel, idx)
+			names = append(names, c.Name)
+		}
+	}
+	if len(toDel) > 0 {
+		changes = append(changes, SchemaChange{
+			Description: "delete columns " + strings.Join(names, ", "),
+			apply: func(filename string) error {
+				return ModifyDelColumns(filename, toDel)
+			},
+		})
+	}
+
+	// change
+	for idx, c := range cur {
+		if w := wanted[c.Name]; !sameColumn(w, c) {
+			colIdx, col := idx, w
+			changes = append(changes, SchemaChange{
+				Description: "change column " + c.Name,
+				apply: func(filename string) error {
+					return ModifyChangeColumn(filename, colIdx, col)
+				},
+			})
+			cur[idx] = w
+		}
+	}
+
+	// add
+	var toAdd []RRDColumn
+	names = nil
+	for _, c := range columns {
+		if findColumn(cur, c.Name) < 0 {
+			toAdd = append(toAdd, c)
+			names = append(names, c.Name)
+		}
+	}
+	if len(toAdd) > 0 {
+		changes = append(changes, SchemaChange{
+			Description: "add columns " + strings.Join(names, ", "),
+			apply: func(filename string) error {
+				return ModifyAddColumns(filename, toAdd)
+			},
+		})
+		cur = append(cur, toAdd...)
+	}
+
+	// reorder
+	var order []int
+	reorder := false
+	for idx, c := range columns {
+		cIdx := findColumn(cur, c.Name)
+		order = append(order, cIdx)
+		reorder = reorder || cIdx != idx
+	}
+	if reorder {
+		changes = append(changes, SchemaChange{
+			Description: "reorder columns",
+			apply: func(filename string) error {
+				return ModifyReorderColumns(filename, order)
+			},
+		})
+	}
+	return
+}
+
+func planArchivesChanges(current, archives []RRDArchive) (changes []SchemaChange) {
+	wanted := make(map[string]RRDArchive)
+	for _, a := range archives {
+		wanted[a.Name] = a
+	}
+
+	// delete
+	var cur []RRDArchive
+	var toDel []int
+	var names []string
+	for idx, a := range current {
+		if _, ok := wanted[a.Name]; ok {
+			cur = append(cur, a)
+		} else {
+			toDel = append(toDel, idx)
+			names = append(names, a.Name)
+		}
+	}
+	if len(toDel) > 0 {
+		changes = append(changes, SchemaChange{
+			Description: "delete archives " + strings.Join(names, ", "),
+			apply: func(filename string) error {
+				return ModifyDelArchives(filename, toDel)
+			},
+		})
+	}
+
+	// change step before resize; archives are reordered by step after each change
+	// and number of rows is recalculated to keep retention
+	for _, w := range archives {
+		aIdx := findArchive(cur, w.Name)
+		if aIdx < 0 || cur[aIdx].Step == w.Step {
+			continue
+		}
+		step := w.Step
+		changes = append(changes, SchemaChange{
+			Description: fmt.Sprintf("change archive %s step to %d", w.Name, step),
+			apply: func(filename string) error {
+				return ModifyChangeArchive(filename, aIdx, "", step)
+			},
+		})
+		cur[aIdx].Rows = cur[aIdx].rowsForStep(step)
+		cur[aIdx].Step = step
+		sort.SliceStable(cur, func(i, j int) bool { return cur[i].Step < cur[j].Step })
+	}
+
+	// resize
+	for idx, a := range cur {
+		if w := wanted[a.Name]; w.Rows != a.Rows {
+			aIdx, rows := idx, int(w.Rows)
+			changes = append(changes, SchemaChange{
+				Description: fmt.Sprintf("resize archive %s to %d rows", a.Name, rows),
+				apply: func(filename string) error {
+					return ModifyResizeArchive(filename, aIdx, rows)
+				},
+			})
+			cur[idx].Rows = w.Rows
+		}
+	}
+
+	// add
+	var toAdd []RRDArchive
+	names = nil
+	for _, a := range archives {
+		if findArchive(cur, a.Name) < 0 {
+			toAdd = append(toAdd, a)
+			names = append(names, a.Name)
+		}
+	}
+	if len(toAdd) > 0 {
+		changes = append(changes, SchemaChange{
+			Description: "add archives " + strings.Join(names, ", "),
+			apply: func(filename string) error {
+				return ModifyAddArchives(filename, toAdd)
+			},
+		})
+	}
+	return
+}
+
+func planForecastsChanges(current, forecasts []RRDForecast) (changes []SchemaChange) {
+	same := len(current) == len(forecasts)
+	var names []string
+	for idx, f := range forecasts {
+		names = append(names, f.Name)
+		same = same && current[idx] == f
+	}
+	if same {
+		return nil
+	}
+	desc := "remove forecasts"
+	if len(names) > 0 {
+		desc = "set forecasts " + strings.Join(names, ", ")
+	}
+	return []SchemaChange{{
+		Description: desc,
+		apply: func(filename string) error {
+			return ModifySetForecasts(filename, forecasts)
+		},
+	}}
+}
+
+func sameColumn(c1, c2 RRDColumn) bool {
+	return c1.Name == c2.Name && c1.Function == c2.Function &&
+		c1.HasMinimum == c2.HasMinimum && (!c1.HasMinimum || c1.Minimum == c2.Minimum) &&
+		c1.HasMaximum == c2.HasMaximum && (!c1.HasMaximum || c1.Maximum == c2.Maximum)
+}
+
+func findColumn(columns []RRDColumn, name string) int {
+	for idx, c := range columns {
+		if c.Name == name {
+			return idx
+		}
+	}
+	return -1
+}
+
+func findArchive(archives []RRDArchive, name string) int {
+	for idx, a := range archives {
+		if a.Name == name {
+			return idx
+		}
+	}
+	return -1
+}
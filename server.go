@@ -21,10 +21,24 @@ Sample requests:
 }
 
 
+/stats
+{
+    "begin":"-7d",
+    "columns":"load",
+    "percentiles":[50, 95]
+}
+
 /query
 {
     "begin":"-10m",
-    "end":"now"
+    "end":"now",
+    "step":"1m",
+    "max_points":500,
+    "downsample":"lttb",
+    "transforms": ["median:5"],
+    "expressions": ["total=rx+tx"],
+    "fill":"linear",
+    "max_gap":"5m"
 }
 */
 
@@ -35,6 +49,22 @@ type (
 		Begin          string `json:"begin,omitempty"`
 		End            string `json:"end,omitempty"`
 		IncludeInvalid bool   `json:"include_invalid,omitempty"`
+		Fill           string `json:"fill,omitempty"`
+		MaxGap         string `json:"max_gap,omitempty"`
+		Stitch         bool   `json:"stitch,omitempty"`
+		Archive        string `json:"archive,omitempty"`
+		Step           string `json:"step,omitempty"`
+		// Expressions define computed columns in form name=expression
+		Expressions []string `json:"expressions,omitempty"`
+		// MaxPoints limit number of returned rows using Downsample method
+		MaxPoints  int    `json:"max_points,omitempty"`
+		Downsample string `json:"downsample,omitempty"`
+		// Transforms define smoothing applied to result (i.e. "sma:5", "ewma:0.3")
+		Transforms []string `json:"transforms,omitempty"`
+		// AverageBy consolidate result in calendar periods (day, week, month, year)
+		// in TimeZone (default server time zone)
+		AverageBy string `json:"average_by,omitempty"`
+		TimeZone  string `json:"timezone,omitempty"`
 	}
 
 	// QueryResponse for query
@@ -43,6 +73,36 @@ type (
 		End     int64       `json:"end"`
 		Columns []string    `json:"columns"`
 		Data    [][]float32 `json:"data"`
+		// Steps keep archive step for each row in stitched query
+		Steps []int64 `json:"steps,omitempty"`
+	}
+
+	// StatsRequest is request for range statistics
+	StatsRequest struct {
+		Columns     string    `json:"columns,omitempty"`
+		Begin       string    `json:"begin,omitempty"`
+		End         string    `json:"end,omitempty"`
+		Archive     string    `json:"archive,omitempty"`
+		Percentiles []float64 `json:"percentiles,omitempty"`
+	}
+
+	// ProfileRequest is request for seasonal profile
+	ProfileRequest struct {
+		Columns string `json:"columns,omitempty"`
+		Begin   string `json:"begin,omitempty"`
+		End     string `json:"end,omitempty"`
+		Archive string `json:"archive,omitempty"`
+		// Group is one of: hour, weekday, weekday-hour
+		Group       string    `json:"group,omitempty"`
+		Percentiles []float64 `json:"percentiles,omitempty"`
+		TimeZone    string    `json:"timezone,omitempty"`
+	}
+
+	// StatsResponse for stats request
+	StatsResponse struct {
+		Begin   int64          `json:"begin"`
+		End     int64          `json:"end"`
+		Columns []*ColumnStats `json:"columns"`
 	}
 
 	// PutValue is one value to put with PutRequest
@@ -72,6 +132,8 @@ func (s *Server) Start() {
 	s.router = mux.NewRouter()
 	s.router.HandleFunc("/query", s.queryHandler).Methods("POST")
 	s.router.HandleFunc("/put", s.putHandler).Methods("POST")
+	s.router.HandleFunc("/stats", s.statsHandler).Methods("POST")
+	s.router.HandleFunc("/profile", s.profileHandler).Methods("POST")
 	http.Handle("/", s.router)
 
 	f, err := OpenRRD(s.DbFilename, false)
@@ -110,19 +172,12 @@ func (s *Server) queryHandler(w http.ResponseWriter, r *http.Request) {
 	if req.Begin == "" {
 		req.Begin = "0"
 	}
-
-	tsMin, ok := dateToTs(req.Begin)
-	if !ok {
-		http.Error(w, "bad begin date", http.StatusBadRequest)
-		return
-	}
-
 	if req.End == "" {
 		req.End = "now"
 	}
-	tsMax, ok := dateToTs(req.End)
-	if !ok {
-		http.Error(w, "bad end date", http.StatusBadRequest)
+	tsMin, tsMax, err := ParseTimeRange(req.Begin, req.End, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -137,15 +192,101 @@ func (s *Server) queryHandler(w http.ResponseWriter, r *http.Request) {
 		columns = cols
 	}
 
+	opts := RangeOptions{
+		IncludeInvalid: req.IncludeInvalid,
+		RealTime:       true,
+		Stitch:         req.Stitch,
+	}
+	if opts.Fill, opts.FillValue, err = ParseFill(req.Fill); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.MaxGap != "" {
+		if opts.MaxGap, err = ParseDuration(req.MaxGap); err != nil {
+			http.Error(w, "bad max_gap: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Archive != "" {
+		if opts.Archive, err = s.db.ParseArchiveName(req.Archive); err != nil {
+			http.Error(w, "bad archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.HasArchive = true
+	}
+	if req.Step != "" {
+		if opts.Step, err = ParseDuration(req.Step); err != nil || opts.Step < 1 {
+			http.Error(w, "bad step", http.StatusBadRequest)
+			return
+		}
+	}
+
+	downsample, ok := ParseDownsampleMethod(req.Downsample)
+	if !ok {
+		http.Error(w, "bad downsample method", http.StatusBadRequest)
+		return
+	}
+
+	transforms, err := ParseTransforms(req.Transforms)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var averageBy CalendarUnit
+	loc := TimeLocation
+	if req.AverageBy != "" {
+		if averageBy, ok = ParseCalendarUnit(req.AverageBy); !ok {
+			http.Error(w, "bad average_by", http.StatusBadRequest)
+			return
+		}
+		if req.TimeZone != "" {
+			if loc, err = time.LoadLocation(req.TimeZone); err != nil {
+				http.Error(w, "bad timezone", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	var exprs []*Expr
+	for _, def := range req.Expressions {
+		e, err := ParseExprDef(def, s.db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		exprs = append(exprs, e)
+	}
+	loadCols := columns
+	if len(exprs) > 0 {
+		if len(columns) == 0 {
+			columns = s.db.allColumnsIDs()
+		}
+		loadCols = ExprsColumns(columns, exprs)
+	}
+
 	resp := QueryResponse{
 		Begin: tsMin,
 		End:   tsMax,
 	}
-	if rows, err := s.db.GetRange(tsMin, tsMax, columns, req.IncludeInvalid, true); err == nil {
+	if rows, err := s.db.GetRangeOpts(tsMin, tsMax, loadCols, opts); err == nil {
+		if len(exprs) > 0 {
+			rows = ApplyExprs(rows, loadCols, len(columns), exprs, len(s.db.Columns()))
+		}
+		if req.AverageBy != "" {
+			rows = AverageByCalendar(rows, averageBy, loc, s.db.Columns())
+		} else if req.MaxPoints > 1 {
+			rows = Downsample(rows, req.MaxPoints, downsample, s.db.Columns())
+		}
+		rows = ApplyTransforms(rows, transforms)
 		for idx, row := range rows {
 			if idx == 0 {
 				for _, col := range row.Values {
-					resp.Columns = append(resp.Columns, s.db.ColumnName(col.Column))
+					if col.Column < len(s.db.Columns()) {
+						resp.Columns = append(resp.Columns, s.db.ColumnName(col.Column))
+					} else {
+						resp.Columns = append(resp.Columns, exprs[col.Column-len(s.db.Columns())].Name)
+					}
 				}
 			}
 			var rrow []float32
@@ -157,6 +298,9 @@ func (s *Server) queryHandler(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 			resp.Data = append(resp.Data, rrow)
+			if req.Stitch && len(row.Values) > 0 {
+				resp.Steps = append(resp.Steps, s.db.Archives()[row.Values[0].ArchiveID].Step)
+			}
 		}
 	}
 
@@ -222,3 +366,130 @@ func (s *Server) putHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
+
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	Log("Server.statsHandler %s from %s", r.RequestURI, r.RemoteAddr)
+	var req StatsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("decode error %s\n", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	LogDebug("Server.statsHandler req: %+v", req)
+
+	if req.Begin == "" {
+		req.Begin = "0"
+	}
+	if req.End == "" {
+		req.End = "now"
+	}
+	tsMin, tsMax, err := ParseTimeRange(req.Begin, req.End, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var columns []int
+	if len(req.Columns) > 0 {
+		if columns, err = s.db.ParseColumnsNames(strings.Split(req.Columns, ",")); err != nil {
+			http.Error(w, fmt.Sprintf("wrong columns: %s\n", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts := RangeOptions{RealTime: true}
+	if req.Archive != "" {
+		if opts.Archive, err = s.db.ParseArchiveName(req.Archive); err != nil {
+			http.Error(w, "bad archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.HasArchive = true
+	}
+	if len(req.Percentiles) == 0 {
+		req.Percentiles = DefaultPercentiles
+	}
+
+	stats, err := s.db.Stats(tsMin, tsMax, columns, req.Percentiles, opts)
+	if err != nil {
+		http.Error(w, "stats error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j, err := json.Marshal(StatsResponse{Begin: tsMin, End: tsMax, Columns: stats})
+	if err != nil {
+		fmt.Printf("encode error %s\n", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+}
+
+func (s *Server) profileHandler(w http.ResponseWriter, r *http.Request) {
+	Log("Server.profileHandler %s from %s", r.RequestURI, r.RemoteAddr)
+	var req ProfileRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("decode error %s\n", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	LogDebug("Server.profileHandler req: %+v", req)
+
+	if req.Begin == "" {
+		req.Begin = "0"
+	}
+	if req.End == "" {
+		req.End = "now"
+	}
+	tsMin, tsMax, err := ParseTimeRange(req.Begin, req.End, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var columns []int
+	if len(req.Columns) > 0 {
+		if columns, err = s.db.ParseColumnsNames(strings.Split(req.Columns, ",")); err != nil {
+			http.Error(w, fmt.Sprintf("wrong columns: %s\n", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts := RangeOptions{RealTime: true}
+	if req.Archive != "" {
+		if opts.Archive, err = s.db.ParseArchiveName(req.Archive); err != nil {
+			http.Error(w, "bad archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.HasArchive = true
+	}
+	group, ok := ParseProfileGroup(req.Group)
+	if !ok {
+		http.Error(w, "bad group", http.StatusBadRequest)
+		return
+	}
+	loc := TimeLocation
+	if req.TimeZone != "" {
+		if loc, err = time.LoadLocation(req.TimeZone); err != nil {
+			http.Error(w, "bad timezone", http.StatusBadRequest)
+			return
+		}
+	}
+
+	profile, err := s.db.Profile(tsMin, tsMax, columns, group, req.Percentiles, loc, opts)
+	if err != nil {
+		http.Error(w, "profile error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j, err := json.Marshal(profile)
+	if err != nil {
+		fmt.Printf("encode error %s\n", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// DefaultPercentiles are calculated when no percentiles are given
+var DefaultPercentiles = []float64{50, 90, 95, 99}
+
+type (
+	// ColumnStats keep statistics for one column in range
+	ColumnStats struct {
+		Column      int          `json:"column"`
+		Name        string       `json:"name"`
+		Count       int64        `json:"count"`
+		Min         float64      `json:"min"`
+		MinTS       int64        `json:"min_ts"`
+		Max         float64      `json:"max"`
+		MaxTS       int64        `json:"max_ts"`
+		Mean        float64      `json:"mean"`
+		Sum         float64      `json:"sum"`
+		StdDev      float64      `json:"stddev"`
+		First       float64      `json:"first"`
+		FirstTS     int64        `json:"first_ts"`
+		Last        float64      `json:"last"`
+		LastTS      int64        `json:"last_ts"`
+		Percentiles []Percentile `json:"percentiles"`
+
+		m2     float64
+		values []float64
+	}
+
+	// Percentile is value of p-th percentile
+	Percentile struct {
+		P     float64 `json:"p"`
+		Value float64 `json:"value"`
+	}
+)
+
+// Stats calculate statistics of valid values in range for given columns.
+// Archive is selected like in GetRangeOpts (only RealTime, HasArchive and
+// Archive options are used). Data are read row by row from archive.
+func (r *RRD) Stats(minTS, maxTS int64, columns []int, percentiles []float64, opts RangeOptions) ([]*ColumnStats, error) {
+	LogDebug("RRD.Stats minTS=%d, maxTS=%d, columns=%v, percentiles=%v", minTS, maxTS, columns, percentiles)
+
+	for _, p := range percentiles {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile %v", p)
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(columns) == 0 {
+		columns = r.allColumnsIDs()
+	}
+
+	archiveID := opts.Archive
+	if opts.HasArchive {
+		if archiveID < 0 || archiveID >= len(r.archives) {
+			return nil, fmt.Errorf("invalid archive %d", archiveID)
+		}
+		minTS = r.archives[archiveID].calcTS(minTS)
+	} else {
+		last := time.Now().Unix()
+		if !opts.RealTime {
+			var err error
+			if last, err = r.last(); err != nil {
+				return nil, err
+			}
+		}
+		archiveID, minTS, _ = r.findArchiveForRange(minTS, maxTS, last)
+	}
+	LogDebug("RRD.Stats using archive=%d, minTS=%d", archiveID, minTS)
+
+	stats := make([]*ColumnStats, 0, len(columns))
+	for _, col := range columns {
+		stats = append(stats, &ColumnStats{Column: col, Name: r.columns[col].Name})
+	}
+
+	iter, err := r.storage.Iterate(archiveID, minTS, -1, columns)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if err := iter.Next(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		ts := iter.TS()
+		if maxTS > -1 && ts > maxTS {
+			continue
+		}
+		values, err := iter.Values()
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if v.Valid {
+				stats[i].add(ts, float64(v.Value))
+			}
+		}
+	}
+
+	for _, s := range stats {
+		s.finish(percentiles)
+	}
+	return stats, nil
+}
+
+func (s *ColumnStats) add(ts int64, v float64) {
+	s.Count++
+	if s.Count == 1 || v < s.Min {
+		s.Min, s.MinTS = v, ts
+	}
+	if s.Count == 1 || v > s.Max {
+		s.Max, s.MaxTS = v, ts
+	}
+	if s.Count == 1 || ts < s.FirstTS {
+		s.First, s.FirstTS = v, ts
+	}
+	if s.Count == 1 || ts > s.LastTS {
+		s.Last, s.LastTS = v, ts
+	}
+	s.Sum += v
+	// Welford's algorithm
+	delta := v - s.Mean
+	s.Mean += delta / float64(s.Count)
+	s.m2 += delta * (v - s.Mean)
+	s.values = append(s.values, v)
+}
+
+func (s *ColumnStats) finish(percentiles []float64) {
+	if s.Count > 1 {
+		s.StdDev = math.Sqrt(s.m2 / float64(s.Count))
+	}
+	if s.Count == 0 {
+		return
+	}
+	sort.Float64s(s.values)
+	for _, p := range percentiles {
+		s.Percentiles = append(s.Percentiles, Percentile{P: p, Value: percentile(s.values, p)})
+	}
+	s.values = nil
+}
+
+// percentile calculate p-th percentile of sorted values with linear interpolation
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	frac := rank - float64(lower)
+	return sorted[lower] + (sorted[lower+1]-sorted[lower])*frac
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -16,7 +18,12 @@ File format:
 header
 columns definitions[columns count]
 archives definitions[archives count]
+version 3:
+	forecasts count int32
+	forecasts definitions[forecasts count]
 archives[archives count]
+version 3:
+	forecasts[forecasts count]
 
 column[
 	name byte[16]
@@ -27,6 +34,26 @@ column[
 	minimum float32
 	maximum float32
 ]
+
+forecast[
+	rows[forecast rows] - like archive rows; value is:
+		predicted float32
+		deviation float32
+		observed float32
+		flags int32
+	state:
+		last ts int64
+		columns[columns count][
+			level float64
+			trend float64
+			updates int64
+			ts int64
+		]
+		season[columns count][season][
+			seasonal float32
+			deviation float32
+		]
+]
 */
 
 type (
@@ -38,8 +65,9 @@ type (
 		header   bfHeader
 		readonly bool
 
-		columns  []bfColumn
-		archives []bfArchive
+		columns   []bfColumn
+		archives  []bfArchive
+		forecasts []bfForecast
 
 		f     *os.File
 		fLock io.Closer
@@ -70,6 +98,15 @@ type (
 		rowSize       int64
 	}
 
+	// forecast definition
+	bfForecast struct {
+		RRDForecast
+
+		forecastOffset int64
+		forecastSize   int64
+		rowSize        int64
+	}
+
 	// BinaryFileIterator is iterator for binary encoded file
 	BinaryFileIterator struct {
 		mu         sync.RWMutex
@@ -85,21 +122,30 @@ type (
 )
 
 const (
-	fileVersion     = int32(2)
+	fileVersion     = int32(3)
 	fileMagic       = int64(1038472294759683202)
 	rrdHeaderSize   = 4 + 2 + 2 + 8
 	rrdColumnSize   = 16 + 4
 	rrdColumnSizeV2 = 16 + 4 + 4 + 4 + 4
 	rrdArchiveSize  = 16 + 8 + 4 + 8 + 8
+	rrdForecastSize = 16 + 8 + 4 + 4 + 4*4 + 4 + 4 + 8 + 8
 	valueSize       = 4 + 4 + 8
 
 	hasMinimumFlag = 1
 	hasMaximumFlag = 2
+
+	forecastValidFlag     = 1
+	forecastObservedFlag  = 2
+	forecastViolationFlag = 4
+	forecastFailureFlag   = 8
 )
 
+// errOlderValue is returned by Put when row in archive keeps newer data
+var errOlderValue = errors.New("updating by older value not allowed")
+
 // Create new file
-func (b *BinaryFileStorage) Create(filename string, columns []RRDColumn, archives []RRDArchive) error {
-	LogDebug("BFS.Create filename=%s, columns=%v, archives=%v", filename, columns, archives)
+func (b *BinaryFileStorage) Create(filename string, columns []RRDColumn, archives []RRDArchive, forecasts []RRDForecast) error {
+	LogDebug("BFS.Create filename=%s, columns=%v, archives=%v, forecasts=%v", filename, columns, archives, forecasts)
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -142,9 +188,17 @@ func (b *BinaryFileStorage) Create(filename string, columns []RRDColumn, archive
 	} else {
 		allHeadersLen += rrdColumnSizeV2 * len(columns)
 	}
+	if b.header.Version > 2 {
+		allHeadersLen += 4 + rrdForecastSize*len(forecasts)
+	}
 
 	b.rowSize = valueSize*len(b.columns) + 8 // ts
 	b.archives = calcArchiveOffsetSize(archives, b.rowSize, allHeadersLen)
+	dataOffset := allHeadersLen
+	for _, a := range b.archives {
+		dataOffset += int(a.archiveSize)
+	}
+	b.forecasts = calcForecastOffsetSize(forecasts, b.rowSize, len(columns), dataOffset)
 
 	LogDebug("BFS.Create rowSize=%d, allHeadersLen=%d", b.rowSize, allHeadersLen)
 
@@ -157,6 +211,11 @@ func (b *BinaryFileStorage) Create(filename string, columns []RRDColumn, archive
 	if err = writeArchivesDef(f, b.archives); err != nil {
 		return err
 	}
+	if b.header.Version > 2 {
+		if err = writeForecastsDef(f, b.forecasts); err != nil {
+			return err
+		}
+	}
 
 	LogDebug("BFS.Create creating archive space")
 
@@ -167,6 +226,18 @@ func (b *BinaryFileStorage) Create(filename string, columns []RRDColumn, archive
 			}
 		}
 	}
+	for _, fc := range b.forecasts {
+		for i := 0; i < int(fc.Rows); i++ {
+			if err := b.writeEmptyRow(-1); err != nil {
+				return err
+			}
+		}
+		// empty state
+		state := make([]byte, fc.forecastSize-int64(fc.Rows)*fc.rowSize)
+		if _, err := f.Write(state); err != nil {
+			return err
+		}
+	}
 
 	LogDebug("BFS.Create creating done")
 
@@ -174,21 +245,21 @@ func (b *BinaryFileStorage) Create(filename string, columns []RRDColumn, archive
 }
 
 // Open existing file
-func (b *BinaryFileStorage) Open(filename string, readonly bool) ([]RRDColumn, []RRDArchive, error) {
+func (b *BinaryFileStorage) Open(filename string, readonly bool) ([]RRDColumn, []RRDArchive, []RRDForecast, error) {
 	LogDebug("BFS.Open filename=%s, readonly=%v", filename, readonly)
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
 	if b.f != nil {
-		return nil, nil, fmt.Errorf("already open")
+		return nil, nil, nil, fmt.Errorf("already open")
 	}
 
 	LogDebug("BFS.Open locking file")
 	{
 		flock, err := lock.Lock(filename + ".lock")
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		b.fLock = flock
 	}
@@ -200,7 +271,7 @@ func (b *BinaryFileStorage) Open(filename string, readonly bool) ([]RRDColumn, [
 	}
 	f, err := os.OpenFile(filename, flag, 0660)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	b.f = f
@@ -209,21 +280,27 @@ func (b *BinaryFileStorage) Open(filename string, readonly bool) ([]RRDColumn, [
 
 	LogDebug("BFS.Open loading headers")
 	if _, err = f.Seek(0, 0); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	b.header, err = loadHeader(b.f)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	b.columns, err = loadColumnsDef(f, int(b.header.ColumnsCount), b.header.Version)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	b.rowSize = valueSize*len(b.columns) + 8 // ts
 	b.archives, err = loadArchiveDef(f, int(b.header.ArchivesCount), b.rowSize)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	if b.header.Version > 2 {
+		b.forecasts, err = loadForecastsDef(f, b.rowSize)
+		if err != nil {
+			return nil, nil, nil, err
+		}
 	}
 
 	// check file size
@@ -237,13 +314,20 @@ func (b *BinaryFileStorage) Open(filename string, readonly bool) ([]RRDColumn, [
 	for _, a := range b.archives {
 		calculatedSize += a.archiveSize
 	}
+	if b.header.Version > 2 {
+		calculatedSize += int64(4 + rrdForecastSize*len(b.forecasts))
+		for _, fc := range b.forecasts {
+			calculatedSize += fc.forecastSize
+		}
+	}
 
 	if fs, _ := f.Stat(); fs.Size() != calculatedSize {
-		return nil, nil, fmt.Errorf("invalid file size - expected %d, is %d", calculatedSize, fs.Size())
+		return nil, nil, nil, fmt.Errorf("invalid file size - expected %d, is %d", calculatedSize, fs.Size())
 	}
 
 	LogDebug("BFS.Open opening finished")
-	return bfColumnToRRDColumn(b.columns), bfArchiveToRRDArchive(b.archives), err
+	return bfColumnToRRDColumn(b.columns), bfArchiveToRRDArchive(b.archives),
+		bfForecastToRRDForecast(b.forecasts), err
 }
 
 // Close file
@@ -368,6 +452,170 @@ func (b *BinaryFileStorage) Iterate(archive int, begin, end int64, columns []int
 	}, nil
 }
 
+// PutForecast write forecast values into forecast rows
+func (b *BinaryFileStorage) PutForecast(forecast int, ts int64, values ...ForecastValue) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	LogDebug2("BFS.PutForecast forecast=%d, ts=%d, values=%v", forecast, ts, values)
+
+	if b.f == nil {
+		return fmt.Errorf("closed file")
+	}
+	if b.readonly {
+		return fmt.Errorf("RRD file open as read-only")
+	}
+
+	rowOffset := b.forecasts[forecast].calcRowOffset(ts)
+	if err := b.checkAndCleanRow(ts, rowOffset); err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		if _, err := b.f.Seek(rowOffset+8+int64(valueSize*v.Column), 0); err != nil {
+			return err
+		}
+		if err := writeForecastValue(b.f, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetForecast load forecast values for selected columns; return nil when
+// there is no row for given ts
+func (b *BinaryFileStorage) GetForecast(forecast int, ts int64, columns []int) ([]ForecastValue, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	LogDebug2("BFS.GetForecast forecast=%d, ts=%d, columns=%v", forecast, ts, columns)
+
+	if b.f == nil {
+		return nil, fmt.Errorf("closed file")
+	}
+
+	rowOffset := b.forecasts[forecast].calcRowOffset(ts)
+	if _, err := b.f.Seek(rowOffset, 0); err != nil {
+		return nil, err
+	}
+	var rowTS int64
+	if err := binary.Read(b.f, binary.LittleEndian, &rowTS); err != nil {
+		return nil, err
+	}
+	if rowTS != ts {
+		return nil, nil
+	}
+
+	var values []ForecastValue
+	for _, col := range columns {
+		if _, err := b.f.Seek(rowOffset+8+int64(col*valueSize), 0); err != nil {
+			return nil, err
+		}
+		v, err := loadForecastValue(b.f)
+		if err != nil {
+			return nil, err
+		}
+		v.TS = ts
+		v.Column = col
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// LoadForecastState read Holt-Winters model state of forecast
+func (b *BinaryFileStorage) LoadForecastState(forecast int) (*ForecastState, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	LogDebug2("BFS.LoadForecastState forecast=%d", forecast)
+
+	if b.f == nil {
+		return nil, fmt.Errorf("closed file")
+	}
+
+	fc := b.forecasts[forecast]
+	stateOffset := fc.forecastOffset + int64(fc.Rows)*fc.rowSize
+	if _, err := b.f.Seek(stateOffset, 0); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, fc.forecastSize-int64(fc.Rows)*fc.rowSize)
+	if _, err := io.ReadFull(b.f, buf); err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(buf)
+	state := &ForecastState{Columns: make([]ForecastColumnState, len(b.columns))}
+	if err := binary.Read(r, binary.LittleEndian, &state.LastTS); err != nil {
+		return nil, err
+	}
+	for i := range state.Columns {
+		cs := &state.Columns[i]
+		for _, v := range []interface{}{&cs.Level, &cs.Trend, &cs.Updates, &cs.TS} {
+			if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i := range state.Columns {
+		cs := &state.Columns[i]
+		cs.Seasonal = make([]float32, fc.Season)
+		cs.Deviation = make([]float32, fc.Season)
+		for j := 0; j < int(fc.Season); j++ {
+			if err := binary.Read(r, binary.LittleEndian, &cs.Seasonal[j]); err != nil {
+				return nil, err
+			}
+			if err := binary.Read(r, binary.LittleEndian, &cs.Deviation[j]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return state, nil
+}
+
+// SaveForecastState write Holt-Winters model state of forecast
+func (b *BinaryFileStorage) SaveForecastState(forecast int, state *ForecastState) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	LogDebug2("BFS.SaveForecastState forecast=%d", forecast)
+
+	if b.f == nil {
+		return fmt.Errorf("closed file")
+	}
+	if b.readonly {
+		return fmt.Errorf("RRD file open as read-only")
+	}
+
+	fc := b.forecasts[forecast]
+	if len(state.Columns) != len(b.columns) {
+		return fmt.Errorf("invalid forecast state - wrong number of columns")
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, state.LastTS)
+	for _, cs := range state.Columns {
+		binary.Write(&buf, binary.LittleEndian, cs.Level)
+		binary.Write(&buf, binary.LittleEndian, cs.Trend)
+		binary.Write(&buf, binary.LittleEndian, cs.Updates)
+		binary.Write(&buf, binary.LittleEndian, cs.TS)
+	}
+	for _, cs := range state.Columns {
+		if len(cs.Seasonal) != int(fc.Season) || len(cs.Deviation) != int(fc.Season) {
+			return fmt.Errorf("invalid forecast state - wrong season length")
+		}
+		for j := 0; j < int(fc.Season); j++ {
+			binary.Write(&buf, binary.LittleEndian, cs.Seasonal[j])
+			binary.Write(&buf, binary.LittleEndian, cs.Deviation[j])
+		}
+	}
+
+	if _, err := b.f.Seek(fc.forecastOffset+int64(fc.Rows)*fc.rowSize, 0); err != nil {
+		return err
+	}
+	_, err := b.f.Write(buf.Bytes())
+	return err
+}
+
 func (b *BinaryFileStorage) loadValue(ts int64, column, archive int) (v Value, err error) {
 	LogDebug2("BFS.loadValue ts=%d, column=%d, archive=%d", ts, column, archive)
 	v = Value{
@@ -421,7 +669,7 @@ func (b *BinaryFileStorage) checkAndCleanRow(ts int64, tsOffset int64) error {
 	}
 	LogDebug2("BFS.checkAndCleanRow cleaning")
 	if storeTS > ts {
-		return fmt.Errorf("updating by older value not allowed")
+		return errOlderValue
 	}
 	if _, err := b.f.Seek(tsOffset, 0); err != nil {
 		return err
@@ -552,6 +800,12 @@ func (a *bfArchive) calcRowOffset(ts int64) (rowOffset int64) {
 	return
 }
 
+func (f *bfForecast) calcRowOffset(ts int64) (rowOffset int64) {
+	rowNum := (ts / f.Step) % int64(f.Rows)
+	rowOffset = f.forecastOffset + f.rowSize*rowNum
+	return
+}
+
 func bfColumnToRRDColumn(cols []bfColumn) (res []RRDColumn) {
 	for _, c := range cols {
 		res = append(res, c.RRDColumn)
@@ -566,6 +820,13 @@ func bfArchiveToRRDArchive(a []bfArchive) (res []RRDArchive) {
 	return
 }
 
+func bfForecastToRRDForecast(f []bfForecast) (res []RRDForecast) {
+	for _, c := range f {
+		res = append(res, c.RRDForecast)
+	}
+	return
+}
+
 func calcArchiveOffsetSize(archives []RRDArchive, rowSize int, baseOffset int) (out []bfArchive) {
 	offset := int64(baseOffset)
 	for _, a := range archives {
@@ -581,6 +842,22 @@ func calcArchiveOffsetSize(archives []RRDArchive, rowSize int, baseOffset int) (
 	return
 }
 
+func calcForecastOffsetSize(forecasts []RRDForecast, rowSize, columns int, baseOffset int) (out []bfForecast) {
+	offset := int64(baseOffset)
+	for _, f := range forecasts {
+		bff := bfForecast{
+			RRDForecast:    f,
+			rowSize:        int64(rowSize),
+			forecastOffset: offset,
+		}
+		stateSize := 8 + columns*(8+8+8+8) + columns*int(f.Season)*(4+4)
+		bff.forecastSize = int64(int(f.Rows)*rowSize + stateSize)
+		out = append(out, bff)
+		offset += bff.forecastSize
+	}
+	return
+}
+
 func loadHeader(r io.Reader) (header bfHeader, err error) {
 	LogDebug("BFS.loadHeader")
 	header = bfHeader{}
@@ -765,6 +1042,99 @@ func writeArchivesDef(w io.Writer, archives []bfArchive) (err error) {
 	return
 }
 
+func loadForecastsDef(r io.Reader, rowSize int) (forecasts []bfForecast, err error) {
+	LogDebug("BFS.loadForecastsDef rowSize=%d", rowSize)
+	var count int32
+	if err = binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return
+	}
+	for i := 0; i < int(count); i++ {
+		buf := make([]byte, 16, 16)
+		if err = binary.Read(r, binary.LittleEndian, &buf); err != nil {
+			return
+		}
+		f := bfForecast{
+			RRDForecast: RRDForecast{
+				Name: strings.TrimRight(string(buf), "\x00"),
+			},
+			rowSize: int64(rowSize),
+		}
+		for _, v := range []interface{}{&f.Step, &f.Rows, &f.Season, &f.Alpha,
+			&f.Beta, &f.Gamma, &f.Delta, &f.Window, &f.Threshold,
+			&f.forecastSize, &f.forecastOffset} {
+			if err = binary.Read(r, binary.LittleEndian, v); err != nil {
+				return
+			}
+		}
+		forecasts = append(forecasts, f)
+	}
+	LogDebug("BFS.loadForecastsDef count=%d", len(forecasts))
+	return
+}
+
+func writeForecastsDef(w io.Writer, forecasts []bfForecast) (err error) {
+	LogDebug("BFS.writeForecastsDef")
+	if err = binary.Write(w, binary.LittleEndian, int32(len(forecasts))); err != nil {
+		return
+	}
+	for _, f := range forecasts {
+		name := make([]byte, 16, 16)
+		if len(f.Name) > 16 {
+			copy(name, []byte(f.Name[:16]))
+		} else {
+			copy(name, []byte(f.Name))
+		}
+		if err = binary.Write(w, binary.LittleEndian, name); err != nil {
+			return
+		}
+		for _, v := range []interface{}{f.Step, f.Rows, f.Season, f.Alpha,
+			f.Beta, f.Gamma, f.Delta, f.Window, f.Threshold,
+			f.forecastSize, f.forecastOffset} {
+			if err = binary.Write(w, binary.LittleEndian, v); err != nil {
+				return
+			}
+		}
+	}
+	LogDebug("BFS.writeForecastsDef finished")
+	return
+}
+
+func writeForecastValue(w io.Writer, v ForecastValue) (err error) {
+	var flags int32
+	if v.Valid {
+		flags |= forecastValidFlag
+	}
+	if v.HasObserved {
+		flags |= forecastObservedFlag
+	}
+	if v.Violation {
+		flags |= forecastViolationFlag
+	}
+	if v.Failure {
+		flags |= forecastFailureFlag
+	}
+	for _, val := range []interface{}{v.Predicted, v.Deviation, v.Observed, flags} {
+		if err = binary.Write(w, binary.LittleEndian, val); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func loadForecastValue(r io.Reader) (v ForecastValue, err error) {
+	var flags int32
+	for _, val := range []interface{}{&v.Predicted, &v.Deviation, &v.Observed, &flags} {
+		if err = binary.Read(r, binary.LittleEndian, val); err != nil {
+			return
+		}
+	}
+	v.Valid = flags&forecastValidFlag != 0
+	v.HasObserved = flags&forecastObservedFlag != 0
+	v.Violation = flags&forecastViolationFlag != 0
+	v.Failure = flags&forecastFailureFlag != 0
+	return
+}
+
 func writeValue(w io.Writer, v Value) (err error) {
 	if err = binary.Write(w, binary.LittleEndian, v.Value); err != nil {
 		return
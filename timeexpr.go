@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeLocation is time zone used to parse and format dates (--timezone)
+var TimeLocation = time.Local
+
+var timeFormats = []string{
+	time.RFC822,
+	time.RFC822Z,
+	time.RFC3339,
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02T15",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02 15",
+	"2006-01-02",
+}
+
+// SetTimeZone set TimeLocation by name: Local, UTC or IANA zone name (i.e. Europe/Warsaw)
+func SetTimeZone(name string) error {
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "" {
+		return fmt.Errorf("invalid time zone '%s'", name)
+	}
+	TimeLocation = loc
+	return nil
+}
+
+// ParseTimeExpr parse time expression and return time stamp.
+// Expression is time stamp (integer), date in one of timeFormats or
+// base followed by optional time of day (HH:MM[:SS]) and offsets.
+// Bases: now, today, yesterday, tomorrow, start of/end of minute, hour, day,
+// week, month, year, begin/start and end (time stamps from refs).
+// Offsets are durations prefixed by sign (i.e. -2d, +1h30m, -1w); units:
+// s, m, h, d, w, mo (months), y. Days, weeks, months and years are calendar
+// aware. When base is omitted - offsets are relative to now.
+// Dates are interpreted in TimeLocation.
+func ParseTimeExpr(expr string, now time.Time, refs map[string]int64) (int64, error) {
+	s := strings.TrimSpace(expr)
+	if s == "" {
+		return 0, fmt.Errorf("empty time expression")
+	}
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	for _, format := range timeFormats {
+		if t, err := time.ParseInLocation(format, s, TimeLocation); err == nil {
+			return t.Unix(), nil
+		}
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d).Unix(), nil
+	}
+
+	t, rest, err := parseTimeBase(s, now.In(TimeLocation), refs)
+	if err != nil {
+		return 0, err
+	}
+	if t, rest, err = parseTimeOfDay(t, rest); err != nil {
+		return 0, fmt.Errorf("invalid time expression '%s': %s", expr, err.Error())
+	}
+	if t, err = addTimeOffsets(t, rest); err != nil {
+		return 0, fmt.Errorf("invalid time expression '%s': %s", expr, err.Error())
+	}
+	return t.Unix(), nil
+}
+
+// ParseTimeRange parse begin and end time expressions; begin may refer
+// to end ("end-1h") and end to begin ("begin+1d")
+func ParseTimeRange(begin, end string, now time.Time) (tsMin, tsMax int64, err error) {
+	refs := make(map[string]int64)
+	tsMin, errMin := ParseTimeExpr(begin, now, refs)
+	if errMin == nil {
+		refs["begin"] = tsMin
+	}
+	if tsMax, err = ParseTimeExpr(end, now, refs); err != nil {
+		if errMin != nil {
+			return 0, 0, fmt.Errorf("invalid begin date: %s", errMin.Error())
+		}
+		return 0, 0, fmt.Errorf("invalid end date: %s", err.Error())
+	}
+	if errMin != nil {
+		refs["end"] = tsMax
+		if tsMin, err = ParseTimeExpr(begin, now, refs); err != nil {
+			return 0, 0, fmt.Errorf("invalid begin date: %s", err.Error())
+		}
+	}
+	return
+}
+
+// parseTimeBase find base of time expression; return base time and rest of expression
+func parseTimeBase(s string, now time.Time, refs map[string]int64) (time.Time, string, error) {
+	ls := strings.ToLower(s)
+	for _, prefix := range []string{"start of ", "end of "} {
+		if !strings.HasPrefix(ls, prefix) {
+			continue
+		}
+		rest := strings.TrimSpace(ls[len(prefix):])
+		unitEnd := strings.IndexAny(rest, " +-")
+		if unitEnd < 0 {
+			unitEnd = len(rest)
+		}
+		start, next, ok := calendarPeriod(now, rest[:unitEnd])
+		if !ok {
+			return now, "", fmt.Errorf("invalid time expression '%s' - unknown period '%s'", s, rest[:unitEnd])
+		}
+		if prefix == "end of " {
+			start = next.Add(-time.Second)
+		}
+		return start, rest[unitEnd:], nil
+	}
+
+	year, month, day := now.Date()
+	bases := []struct {
+		name string
+		base func() (time.Time, bool)
+	}{
+		{"now", func() (time.Time, bool) { return now, true }},
+		{"n", func() (time.Time, bool) { return now, true }},
+		{"today", func() (time.Time, bool) { return time.Date(year, month, day, 0, 0, 0, 0, TimeLocation), true }},
+		{"yesterday", func() (time.Time, bool) { return time.Date(year, month, day-1, 0, 0, 0, 0, TimeLocation), true }},
+		{"tomorrow", func() (time.Time, bool) { return time.Date(year, month, day+1, 0, 0, 0, 0, TimeLocation), true }},
+		{"begin", func() (time.Time, bool) { return timeRef(refs, "begin") }},
+		{"start", func() (time.Time, bool) { return timeRef(refs, "begin") }},
+		{"end", func() (time.Time, bool) { return timeRef(refs, "end") }},
+	}
+	for _, b := range bases {
+		if !hasTimeKeyword(ls, b.name) {
+			continue
+		}
+		t, ok := b.base()
+		if !ok {
+			return now, "", fmt.Errorf("invalid time expression '%s' - '%s' not available", s, b.name)
+		}
+		return t, s[len(b.name):], nil
+	}
+	// no base - relative to now
+	return now, s, nil
+}
+
+// hasTimeKeyword check if s starts with keyword followed by end of string,
+// space or sign
+func hasTimeKeyword(s, keyword string) bool {
+	if !strings.HasPrefix(s, keyword) {
+		return false
+	}
+	rest := s[len(keyword):]
+	return rest == "" || strings.IndexAny(rest[:1], " +-") == 0
+}
+
+func timeRef(refs map[string]int64, name string) (time.Time, bool) {
+	ts, ok := refs[name]
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(ts, 0).In(TimeLocation), true
+}
+
+// calendarPeriod return start of period containing t and start of next period
+// (in location of t)
+func calendarPeriod(t time.Time, period string) (start, next time.Time, ok bool) {
+	year, month, day := t.Date()
+	loc := t.Location()
+	switch period {
+	case "minute":
+		start = t.Truncate(time.Minute)
+		next = start.Add(time.Minute)
+	case "hour":
+		start = time.Date(year, month, day, t.Hour(), 0, 0, 0, loc)
+		next = start.Add(time.Hour)
+	case "day":
+		start = time.Date(year, month, day, 0, 0, 0, 0, loc)
+		next = start.AddDate(0, 0, 1)
+	case "week":
+		// weeks start on monday
+		start = time.Date(year, month, day-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc)
+		next = start.AddDate(0, 0, 7)
+	case "month":
+		start = time.Date(year, month, 1, 0, 0, 0, 0, loc)
+		next = start.AddDate(0, 1, 0)
+	case "year":
+		start = time.Date(year, 1, 1, 0, 0, 0, 0, loc)
+		next = start.AddDate(1, 0, 0)
+	default:
+		return t, t, false
+	}
+	return start, next, true
+}
+
+// parseTimeOfDay set time of day when expression contains HH:MM[:SS]
+func parseTimeOfDay(t time.Time, s string) (time.Time, string, error) {
+	s = strings.TrimSpace(s)
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != ':'
+	})
+	if end < 0 {
+		end = len(s)
+	}
+	clock := s[:end]
+	if !strings.Contains(clock, ":") {
+		return t, s, nil
+	}
+	var hour, min, sec int
+	parts := strings.Split(clock, ":")
+	if len(parts) > 3 {
+		return t, s, fmt.Errorf("invalid time '%s'", clock)
+	}
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 || (i == 0 && v > 23) || (i > 0 && v > 59) {
+			return t, s, fmt.Errorf("invalid time '%s'", clock)
+		}
+		switch i {
+		case 0:
+			hour = v
+		case 1:
+			min = v
+		case 2:
+			sec = v
+		}
+	}
+	year, month, day := t.Date()
+	return time.Date(year, month, day, hour, min, sec, 0, TimeLocation), s[end:], nil
+}
+
+// addTimeOffsets add to t sequence of signed durations (i.e. -1d+6h)
+func addTimeOffsets(t time.Time, s string) (time.Time, error) {
+	s = strings.Replace(s, " ", "", -1)
+	for s != "" {
+		sign := 1.0
+		switch s[0] {
+		case '-':
+			sign = -1
+		case '+':
+		default:
+			return t, fmt.Errorf("unexpected '%s'", s)
+		}
+		s = s[1:]
+		end := strings.IndexAny(s, "+-")
+		if end < 0 {
+			end = len(s)
+		}
+		term := s[:end]
+		s = s[end:]
+		if term == "" {
+			return t, fmt.Errorf("missing duration")
+		}
+		for term != "" {
+			numEnd := strings.IndexFunc(term, func(r rune) bool {
+				return (r < '0' || r > '9') && r != '.'
+			})
+			if numEnd == 0 {
+				return t, fmt.Errorf("invalid duration '%s'", term)
+			}
+			if numEnd < 0 {
+				numEnd = len(term)
+			}
+			num, err := strconv.ParseFloat(term[:numEnd], 64)
+			if err != nil {
+				return t, fmt.Errorf("invalid duration '%s'", term)
+			}
+			term = term[numEnd:]
+			unitEnd := strings.IndexFunc(term, func(r rune) bool {
+				return (r >= '0' && r <= '9') || r == '.'
+			})
+			if unitEnd < 0 {
+				unitEnd = len(term)
+			}
+			unit := strings.ToLower(term[:unitEnd])
+			term = term[unitEnd:]
+
+			num *= sign
+			whole := num == math.Trunc(num)
+			switch {
+			case unit == "mo" && whole:
+				t = t.AddDate(0, int(num), 0)
+			case unit == "y" && whole:
+				t = t.AddDate(int(num), 0, 0)
+			case unit == "w" && whole:
+				t = t.AddDate(0, 0, 7*int(num))
+			case unit == "d" && whole:
+				t = t.AddDate(0, 0, int(num))
+			case unit == "" || unit == "mo":
+				return t, fmt.Errorf("invalid duration '%g%s'", num, unit)
+			default:
+				mult, ok := durationUnitSeconds(unit)
+				if !ok {
+					return t, fmt.Errorf("unknown unit '%s'", unit)
+				}
+				t = t.Add(time.Duration(num*float64(mult)) * time.Second)
+			}
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TransformKind is type of transformation
+type TransformKind int
+
+const (
+	// TransformSMA is simple moving average
+	TransformSMA TransformKind = iota
+	// TransformEWMA is exponentially weighted moving average
+	TransformEWMA
+	// TransformMedian is rolling median
+	TransformMedian
+)
+
+func (k TransformKind) String() string {
+	switch k {
+	case TransformSMA:
+		return "sma"
+	case TransformEWMA:
+		return "ewma"
+	case TransformMedian:
+		return "median"
+	}
+	return "unknown transform"
+}
+
+// Transform define one smoothing operation applied to rows. Window is
+// defined as number of points (Points) or duration in seconds (Window).
+type Transform struct {
+	Kind   TransformKind
+	Points int
+	Window int64
+	// Alpha is smoothing factor for EWMA
+	Alpha float64
+}
+
+// ParseTransform parse transformation definition in form kind:param.
+// Accepted: sma:N or sma:duration (moving average over N points or duration,
+// i.e. sma:5m), median:N or median:duration (rolling median), ewma:alpha or
+// ewma:N (EWMA with smoothing factor alpha in (0, 1] or span of N points).
+func ParseTransform(def string) (*Transform, error) {
+	parts := strings.SplitN(strings.TrimSpace(def), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid transform '%s'; expected kind:param", def)
+	}
+	param := strings.TrimSpace(parts[1])
+
+	t := &Transform{}
+	switch strings.ToLower(parts[0]) {
+	case "sma", "ma", "avg", "average":
+		t.Kind = TransformSMA
+	case "median", "med":
+		t.Kind = TransformMedian
+	case "ewma", "ema":
+		t.Kind = TransformEWMA
+		alpha, err := strconv.ParseFloat(param, 64)
+		if err != nil || alpha <= 0 {
+			return nil, fmt.Errorf("invalid ewma parameter '%s'", param)
+		}
+		if alpha > 1 {
+			// span
+			alpha = 2 / (alpha + 1)
+		}
+		t.Alpha = alpha
+		return t, nil
+	default:
+		return nil, fmt.Errorf("unknown transform '%s'", parts[0])
+	}
+
+	if n, err := strconv.Atoi(param); err == nil {
+		if n < 1 {
+			return nil, fmt.Errorf("invalid number of points in transform '%s'", def)
+		}
+		t.Points = n
+		return t, nil
+	}
+	window, err := ParseDuration(param)
+	if err != nil || window < 1 {
+		return nil, fmt.Errorf("invalid window in transform '%s'", def)
+	}
+	t.Window = window
+	return t, nil
+}
+
+// ParseTransforms parse list of transformations definitions
+func ParseTransforms(defs []string) (transforms []*Transform, err error) {
+	for _, def := range defs {
+		t, err := ParseTransform(def)
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, t)
+	}
+	return
+}
+
+// ApplyTransforms apply transformations to all columns in rows. Invalid values
+// are skipped in calculations and remain invalid in result.
+func ApplyTransforms(rows Rows, transforms []*Transform) Rows {
+	for _, t := range transforms {
+		rows = t.Apply(rows)
+	}
+	return rows
+}
+
+// Apply transformation to rows; return new rows
+func (t *Transform) Apply(rows Rows) Rows {
+	LogDebug("Transform.Apply rows=%d, transform=%+v", len(rows), t)
+
+	out := make(Rows, len(rows))
+	for i, row := range rows {
+		out[i] = Row{TS: row.TS, Values: append([]Value(nil), row.Values...)}
+	}
+	if len(rows) == 0 {
+		return out
+	}
+
+	for c := range rows[0].Values {
+		if t.Kind == TransformEWMA {
+			t.applyEWMA(rows, out, c)
+		} else {
+			t.applyWindow(rows, out, c)
+		}
+	}
+	return out
+}
+
+func (t *Transform) applyEWMA(rows, out Rows, c int) {
+	var s float64
+	started := false
+	for i, row := range rows {
+		v := row.Values[c]
+		if !v.Valid {
+			continue
+		}
+		if started {
+			s = t.Alpha*float64(v.Value) + (1-t.Alpha)*s
+		} else {
+			s = float64(v.Value)
+			started = true
+		}
+		out[i].Values[c].Value = float32(s)
+	}
+}
+
+func (t *Transform) applyWindow(rows, out Rows, c int) {
+	var window []float64
+	var windowTS []int64
+	for i, row := range rows {
+		v := row.Values[c]
+		if v.Valid {
+			window = append(window, float64(v.Value))
+			windowTS = append(windowTS, row.TS)
+		}
+		// remove values out of window
+		start := 0
+		if t.Points > 0 {
+			// window of Points rows (valid or not) ending on current row
+			for start < len(windowTS) && windowTS[start] <= rowTSBefore(rows, i, t.Points) {
+				start++
+			}
+		} else {
+			for start < len(windowTS) && windowTS[start] <= row.TS-t.Window {
+				start++
+			}
+		}
+		window, windowTS = window[start:], windowTS[start:]
+
+		if !v.Valid || len(window) == 0 {
+			continue
+		}
+		if t.Kind == TransformMedian {
+			out[i].Values[c].Value = float32(median(window))
+		} else {
+			var sum float64
+			for _, w := range window {
+				sum += w
+			}
+			out[i].Values[c].Value = float32(sum / float64(len(window)))
+		}
+	}
+}
+
+// rowTSBefore return ts of row preceding window of n rows ending on row i
+func rowTSBefore(rows Rows, i, n int) int64 {
+	if i-n < 0 {
+		return rows[0].TS - 1
+	}
+	return rows[i-n].TS
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	l := len(sorted)
+	if l%2 == 1 {
+		return sorted[l/2]
+	}
+	return (sorted[l/2-1] + sorted[l/2]) / 2
+}
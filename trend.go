@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// TrendMethod define algorithm used for fitting trend line
+type TrendMethod int
+
+const (
+	// TrendLeastSquares is ordinary least squares regression
+	TrendLeastSquares TrendMethod = iota
+	// TrendTheilSen is robust Theil-Sen estimator (median of slopes)
+	TrendTheilSen
+)
+
+// maxTheilSenPoints limit number of points used by Theil-Sen estimator
+// (number of pairs grows quadratically)
+const maxTheilSenPoints = 1000
+
+func (m TrendMethod) String() string {
+	switch m {
+	case TrendLeastSquares:
+		return "lsq"
+	case TrendTheilSen:
+		return "theil-sen"
+	}
+	return "unknown trend method"
+}
+
+// ParseTrendMethod return trend method by name
+func ParseTrendMethod(name string) (TrendMethod, bool) {
+	switch strings.ToLower(name) {
+	case "", "lsq", "least-squares", "linear":
+		return TrendLeastSquares, true
+	case "theil-sen", "theilsen", "robust":
+		return TrendTheilSen, true
+	}
+	return TrendLeastSquares, false
+}
+
+// Trend is linear function fitted to values: value = Intercept + Slope * (ts - RefTS)
+type Trend struct {
+	Method TrendMethod
+	// Slope is change of value per second
+	Slope     float64
+	Intercept float64
+	RefTS     int64
+	// Points is number of values used to fit trend
+	Points int
+	// R2 is coefficient of determination
+	R2 float64
+	// Begin and End are time stamps of first and last value
+	Begin int64
+	End   int64
+}
+
+// FitTrend fit linear trend to valid values of column (index in rows values)
+func FitTrend(rows Rows, column int, method TrendMethod) (*Trend, error) {
+	var xs, ys []float64
+	t := &Trend{Method: method}
+	for _, row := range rows {
+		if column >= len(row.Values) || !row.Values[column].Valid {
+			continue
+		}
+		if len(xs) == 0 {
+			t.RefTS, t.Begin = row.TS, row.TS
+		}
+		xs = append(xs, float64(row.TS-t.RefTS))
+		ys = append(ys, float64(row.Values[column].Value))
+		t.End = row.TS
+	}
+	t.Points = len(xs)
+	if t.Points < 2 || t.Begin == t.End {
+		return nil, fmt.Errorf("not enough data to fit trend")
+	}
+
+	if method == TrendTheilSen {
+		t.fitTheilSen(xs, ys)
+	} else {
+		t.fitLeastSquares(xs, ys)
+	}
+
+	// coefficient of determination
+	var meanY, ssTot, ssRes float64
+	for _, y := range ys {
+		meanY += y
+	}
+	meanY /= float64(len(ys))
+	for i, x := range xs {
+		ssTot += (ys[i] - meanY) * (ys[i] - meanY)
+		e := ys[i] - (t.Intercept + t.Slope*x)
+		ssRes += e * e
+	}
+	if ssTot > 0 {
+		t.R2 = 1 - ssRes/ssTot
+	} else {
+		t.R2 = 1
+	}
+	return t, nil
+}
+
+func (t *Trend) fitLeastSquares(xs, ys []float64) {
+	n := float64(len(xs))
+	var sx, sy, sxx, sxy float64
+	for i, x := range xs {
+		sx += x
+		sy += ys[i]
+		sxx += x * x
+		sxy += x * ys[i]
+	}
+	t.Slope = (n*sxy - sx*sy) / (n*sxx - sx*sx)
+	t.Intercept = (sy - t.Slope*sx) / n
+}
+
+func (t *Trend) fitTheilSen(xs, ys []float64) {
+	// thin data to limit number of pairs
+	if every := len(xs)/maxTheilSenPoints + 1; every > 1 {
+		var txs, tys []float64
+		for i := 0; i < len(xs); i += every {
+			txs, tys = append(txs, xs[i]), append(tys, ys[i])
+		}
+		xs, ys = txs, tys
+	}
+
+	var slopes []float64
+	for i := range xs {
+		for j := i + 1; j < len(xs); j++ {
+			if dx := xs[j] - xs[i]; dx != 0 {
+				slopes = append(slopes, (ys[j]-ys[i])/dx)
+			}
+		}
+	}
+	t.Slope = median(slopes)
+
+	intercepts := make([]float64, len(xs))
+	for i, x := range xs {
+		intercepts[i] = ys[i] - t.Slope*x
+	}
+	t.Intercept = median(intercepts)
+}
+
+// ValueAt return trend value in ts
+func (t *Trend) ValueAt(ts int64) float64 {
+	return t.Intercept + t.Slope*float64(ts-t.RefTS)
+}
+
+// SlopePerDay return change of value per day
+func (t *Trend) SlopePerDay() float64 {
+	return t.Slope * 86400
+}
+
+// TrendCrossing describe when trend reach threshold
+type TrendCrossing int
+
+const (
+	// CrossingNever - trend never reach threshold
+	CrossingNever TrendCrossing = iota
+	// CrossingFuture - trend will reach threshold
+	CrossingFuture
+	// CrossingReached - threshold was already reached
+	CrossingReached
+)
+
+func (c TrendCrossing) String() string {
+	switch c {
+	case CrossingNever:
+		return "never"
+	case CrossingFuture:
+		return "future"
+	case CrossingReached:
+		return "reached"
+	}
+	return "unknown crossing"
+}
+
+// Crossing return time stamp when trend reach threshold and whether it
+// happen after given ts, was already reached or never happen
+func (t *Trend) Crossing(threshold float64, after int64) (int64, TrendCrossing) {
+	if t.Slope == 0 {
+		if t.Intercept == threshold {
+			return t.RefTS, CrossingReached
+		}
+		return 0, CrossingNever
+	}
+	dx := (threshold - t.Intercept) / t.Slope
+	if math.IsInf(dx, 0) || math.IsNaN(dx) || math.Abs(dx) > math.MaxInt64/2 {
+		return 0, CrossingNever
+	}
+	ts := t.RefTS + int64(math.Ceil(dx))
+	if ts <= after {
+		return ts, CrossingReached
+	}
+	return ts, CrossingFuture
+}